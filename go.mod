@@ -6,6 +6,7 @@ require (
 	github.com/sirupsen/logrus v1.9.3
 	go.mongodb.org/atlas-sdk/v20250312005 v20250312005.0.0
 	go.mongodb.org/mongo-driver/v2 v2.2.2
+	golang.org/x/text v0.27.0
 	google.golang.org/genai v1.15.0
 )
 
@@ -31,7 +32,6 @@ require (
 	golang.org/x/oauth2 v0.30.0 // indirect
 	golang.org/x/sync v0.16.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
-	golang.org/x/text v0.27.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
 	google.golang.org/grpc v1.66.2 // indirect
 	google.golang.org/protobuf v1.34.2 // indirect
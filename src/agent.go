@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/genai"
+)
+
+const (
+	defaultAgentMaxSteps       = 8
+	defaultAgentTokenBudget    = 500000
+	defaultAgentMaxResultChars = 8000
+	// Documents returned by the aggregate tool at most.
+	maxAgentAggregateDocs = 50
+	// Time an aggregation of the aggregate tool can run for, on the server and the client.
+	agentAggregateTimeout = 30 * time.Second
+)
+
+// agentCollections are the run database collections the aggregate tool can read.
+var agentCollections = []string{
+	"slowQueries", "slowQueriesByDriver", "slowQueryTargetingByNamespace", "queryAntiPatterns",
+	"primaryChangeEvents", "clientMetadata", "metricFindings", "slowQueryMetricCorrelations",
+	"mongosSlowQueries", "mongosQueryShapes", "shardDistribution",
+}
+
+// agentAllowedStages are the aggregation stages the aggregate tool accepts. The others write,
+// read other collections, or inspect the server. The sub-pipelines of $facet, $lookup and
+// $unionWith are checked like the pipeline itself.
+var agentAllowedStages = map[string]bool{
+	"$match": true, "$group": true, "$sort": true, "$limit": true, "$skip": true, "$project": true,
+	"$addFields": true, "$set": true, "$unset": true, "$unwind": true, "$count": true, "$sortByCount": true,
+	"$bucket": true, "$bucketAuto": true, "$replaceRoot": true, "$replaceWith": true, "$sample": true,
+	"$facet": true, "$lookup": true, "$unionWith": true,
+}
+
+// agentForbiddenOperators run server-side JavaScript.
+var agentForbiddenOperators = map[string]bool{"$where": true, "$function": true, "$accumulator": true}
+
+type AgentConfig struct {
+	Enabled        bool `json:"enabled"`
+	MaxSteps       int  `json:"maxSteps"`
+	TokenBudget    int  `json:"tokenBudget"`
+	MaxResultChars int  `json:"maxResultChars"`
+}
+
+func (ac AgentConfig) withDefaults() AgentConfig {
+	if ac.MaxSteps <= 0 {
+		ac.MaxSteps = defaultAgentMaxSteps
+	}
+	if ac.TokenBudget <= 0 {
+		ac.TokenBudget = defaultAgentTokenBudget
+	}
+	if ac.MaxResultChars <= 0 {
+		ac.MaxResultChars = defaultAgentMaxResultChars
+	}
+	return ac
+}
+
+// AgentTool is a function the model can call while investigating.
+type AgentTool struct {
+	Declaration *genai.FunctionDeclaration
+	Call        func(ctx context.Context, args map[string]any) (any, error)
+}
+
+// ToolCallRecord is the audit record of a tool call.
+type ToolCallRecord struct {
+	Step     int            `bson:"step" json:"step"`
+	Tool     string         `bson:"tool" json:"tool"`
+	Args     map[string]any `bson:"args" json:"args"`
+	Result   string         `bson:"result" json:"result"`
+	Error    string         `bson:"error,omitempty" json:"error,omitempty"`
+	Duration time.Duration  `bson:"duration" json:"duration"`
+}
+
+// Agent lets the model call tools backed by the run's data before it writes a report, within a
+// step and token budget.
+type Agent struct {
+	LLM    *LLMClient
+	Tools  map[string]AgentTool
+	Config AgentConfig
+	Calls  []ToolCallRecord
+}
+
+func NewAgent(llm *LLMClient, tools []AgentTool, cfg AgentConfig) *Agent {
+	agent := &Agent{LLM: llm, Tools: make(map[string]AgentTool), Config: cfg.withDefaults()}
+	for _, tool := range tools {
+		agent.Tools[tool.Declaration.Name] = tool
+	}
+	return agent
+}
+
+// ToolCalls returns the tool calls of the agent, which may be nil.
+func (a *Agent) ToolCalls() []ToolCallRecord {
+	if a == nil {
+		return nil
+	}
+	return a.Calls
+}
+
+// Run sends the prompt, with the files attached, and answers the model's tool calls until it
+// writes its report. When the budget runs out, the model is asked to write the report with
+// what it has. The agent doesn't use the LLM response cache, as its answers depend on the tool
+// results.
+func (a *Agent) Run(ctx context.Context, modelName string, prompt string, files []string) (string, error) {
+	instructions, err := renderPrompt(agentInstructionsTemplate, AgentInstructionsData{MaxSteps: a.Config.MaxSteps})
+	if err != nil {
+		return "", err
+	}
+	uris, err := a.LLM.uploadContextFiles(ctx, files)
+	if err != nil {
+		return "", err
+	}
+	var parts []*genai.Part
+	for _, file := range uris {
+		parts = append(parts, genai.NewPartFromURI(file.URI, file.MIMEType))
+	}
+	parts = append(parts, genai.NewPartFromText(prompt+"\n"+instructions))
+	text, _, err := a.Converse(ctx, modelName, []*genai.Content{genai.NewContentFromParts(parts, "user")})
+	return text, err
+}
+
+// Converse answers the model's tool calls until it replies with text, within the step and
+// token budget, and returns the reply along with the conversation it was added to.
+func (a *Agent) Converse(ctx context.Context, modelName string, contents []*genai.Content) (string, []*genai.Content, error) {
+	var declarations []*genai.FunctionDeclaration
+	for _, tool := range a.Tools {
+		declarations = append(declarations, tool.Declaration)
+	}
+	config := &genai.GenerateContentConfig{Tools: []*genai.Tool{{FunctionDeclarations: declarations}}}
+
+	tokens := 0
+	for step := 1; ; step++ {
+		if step > a.Config.MaxSteps || tokens >= a.Config.TokenBudget {
+			Logger.WithFields(logrus.Fields{"steps": step - 1, "tokens": tokens}).Warn("Agent budget exhausted, asking for the answer")
+			contents = append(contents, genai.NewContentFromText(
+				"The investigation budget is exhausted: don't call any more tools, and answer with the data you have.", "user"))
+			final := &genai.GenerateContentConfig{
+				Tools:      config.Tools,
+				ToolConfig: &genai.ToolConfig{FunctionCallingConfig: &genai.FunctionCallingConfig{Mode: genai.FunctionCallingConfigModeNone}},
+			}
+			response, err := a.LLM.generateContent(ctx, modelName, contents, final)
+			if err != nil {
+				return "", contents, err
+			}
+			return response.Text(), appendReply(contents, response), nil
+		}
+		response, err := a.LLM.generateContent(ctx, modelName, contents, config)
+		if err != nil {
+			return "", contents, err
+		}
+		if response.UsageMetadata != nil {
+			tokens += int(response.UsageMetadata.TotalTokenCount)
+		}
+		calls := response.FunctionCalls()
+		if len(calls) == 0 || len(response.Candidates) == 0 {
+			Logger.WithFields(logrus.Fields{"steps": step, "toolCalls": len(a.Calls), "tokens": tokens}).Info("Agent finished")
+			return response.Text(), appendReply(contents, response), nil
+		}
+		contents = append(contents, response.Candidates[0].Content)
+		var results []*genai.Part
+		for _, call := range calls {
+			output := a.call(ctx, step, call)
+			part := genai.NewPartFromFunctionResponse(call.Name, output)
+			part.FunctionResponse.ID = call.ID
+			results = append(results, part)
+		}
+		contents = append(contents, genai.NewContentFromParts(results, "user"))
+	}
+}
+
+func appendReply(contents []*genai.Content, response *genai.GenerateContentResponse) []*genai.Content {
+	if len(response.Candidates) == 0 || response.Candidates[0].Content == nil {
+		return contents
+	}
+	return append(contents, response.Candidates[0].Content)
+}
+
+// call runs a tool call and records it. Errors are returned to the model, which can recover
+// from them.
+func (a *Agent) call(ctx context.Context, step int, call *genai.FunctionCall) map[string]any {
+	record := ToolCallRecord{Step: step, Tool: call.Name, Args: call.Args}
+	start := time.Now()
+	var result any
+	err := fmt.Errorf("unknown tool %q", call.Name)
+	if tool, ok := a.Tools[call.Name]; ok {
+		result, err = tool.Call(ctx, call.Args)
+	}
+	record.Duration = time.Since(start)
+	output := map[string]any{}
+	if err != nil {
+		record.Error = err.Error()
+		output["error"] = record.Error
+	} else {
+		js, jsonErr := marshalJSON(result, "")
+		if jsonErr != nil {
+			record.Error = jsonErr.Error()
+			output["error"] = record.Error
+		} else {
+			record.Result = truncateToolResult(string(js), a.Config.MaxResultChars)
+			output["output"] = record.Result
+		}
+	}
+	a.Calls = append(a.Calls, record)
+	Logger.WithFields(logrus.Fields{
+		"step":     step,
+		"tool":     call.Name,
+		"args":     call.Args,
+		"duration": record.Duration,
+		"error":    record.Error,
+		"chars":    len(record.Result),
+	}).Info("Agent tool call")
+	return output
+}
+
+func truncateToolResult(result string, maxChars int) string {
+	if len(result) <= maxChars {
+		return result
+	}
+	return fmt.Sprintf("%s[... %d more characters]", result[:maxChars], len(result)-maxChars)
+}
+
+func argString(args map[string]any, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
+
+func argInt(args map[string]any, name string, def int) int {
+	// JSON numbers are decoded as float64.
+	if f, ok := args[name].(float64); ok && f > 0 {
+		return int(f)
+	}
+	return def
+}
+
+func argStrings(args map[string]any, name string) []string {
+	var values []string
+	items, _ := args[name].([]any)
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+func objectSchema(required []string, properties map[string]*genai.Schema) *genai.Schema {
+	return &genai.Schema{Type: genai.TypeObject, Properties: properties, Required: required}
+}
+
+// NewAgentTools returns the tools of an investigation of the given run.
+func NewAgentTools(ac *AtlasClient, dbName string) []AgentTool {
+	tools := []AgentTool{
+		{
+			Declaration: &genai.FunctionDeclaration{
+				Name:        "list_hosts",
+				Description: "Lists the hosts (host:port) whose logs were analyzed.",
+			},
+			Call: func(ctx context.Context, args map[string]any) (any, error) {
+				return GetHostNames(ctx, dbName)
+			},
+		},
+		{
+			Declaration: &genai.FunctionDeclaration{
+				Name:        "top_query_shapes",
+				Description: "Ranks the slow query shapes of the run, with their stats and the reason they were selected.",
+				Parameters: objectSchema(nil, map[string]*genai.Schema{
+					"limit":    {Type: genai.TypeInteger, Description: "Number of shapes to return, 10 by default."},
+					"strategy": {Type: genai.TypeString, Description: "Ranking strategy: totalTime, maxTime, p99, count, bytesRead, docsExamined, collscanFirst or composite. The configured strategy by default."},
+				}),
+			},
+			Call: func(ctx context.Context, args map[string]any) (any, error) {
+				strategy := argString(args, "strategy")
+				if strategy == "" {
+					if cfg, err := GetConfig(); err == nil {
+						strategy = cfg.RankQueryShapesBy
+					}
+				}
+				return GetTopQueryShapesByExecutionTime(ctx, dbName, argInt(args, "limit", 10), strategy)
+			},
+		},
+		{
+			Declaration: &genai.FunctionDeclaration{
+				Name:        "slowest_query_by_shape",
+				Description: "Returns the slowest logged operation of a query shape.",
+				Parameters: objectSchema([]string{"namespace"}, map[string]*genai.Schema{
+					"queryHash": {Type: genai.TypeString, Description: "Query hash of the shape; empty for inserts."},
+					"namespace": {Type: genai.TypeString, Description: "Namespace (db.collection) of the shape."},
+					"opType":    {Type: genai.TypeString, Description: "Operation type of a write shape, such as update or insert."},
+				}),
+			},
+			Call: func(ctx context.Context, args map[string]any) (any, error) {
+				sq, err := GetSlowestQueryByShape(ctx, dbName, SlowQueryByID{
+					Hash:      argString(args, "queryHash"),
+					Namespace: argString(args, "namespace"),
+					OpType:    argString(args, "opType"),
+				})
+				if err != nil {
+					return nil, err
+				}
+				return TruncateLiterals(GetRedactor().Command(sq.Attr)), nil
+			},
+		},
+		{
+			Declaration: &genai.FunctionDeclaration{
+				Name:        "host_measurements",
+				Description: "Summarizes the Atlas metrics of a host over the analyzed period: min, mean, p95, max, trend and top spikes of each series.",
+				Parameters: objectSchema([]string{"host"}, map[string]*genai.Schema{
+					"host": {Type: genai.TypeString, Description: "Host, as host:port."},
+					"metrics": {
+						Type:        genai.TypeArray,
+						Items:       &genai.Schema{Type: genai.TypeString},
+						Description: "Atlas metric names or metric groups such as cpu, memory, cache, tickets or replication. The configured metrics by default.",
+					},
+				}),
+			},
+			Call: func(ctx context.Context, args map[string]any) (any, error) {
+				cfg, err := GetConfig()
+				if err != nil {
+					return nil, err
+				}
+				names := argStrings(args, "metrics")
+				if len(names) == 0 {
+					names = cfg.Metrics
+				}
+				selection, err := ResolveMetricSelection(names)
+				if err != nil {
+					return nil, err
+				}
+				manifest, err := GetRunManifest(ctx, dbName)
+				if err != nil {
+					return nil, err
+				}
+				start, end := manifest.Window()
+				host := argString(args, "host")
+				res, err := ac.GetMeasurementsForProcess(ctx, cfg.ProjectId, host, selection.Host, &start, &end, nil, &cfg.MetricsGranularity)
+				if err != nil {
+					return nil, err
+				}
+				profile, err := LoadThresholdProfile(cfg)
+				if err != nil {
+					return nil, err
+				}
+				return SummarizeSeries(DeriveSeries(MeasurementSeries(host, "", res)), ThresholdResolver{Profile: profile}), nil
+			},
+		},
+		{
+			Declaration: &genai.FunctionDeclaration{
+				Name:        "primary_elections",
+				Description: "Lists when nodes became primary during the analyzed period.",
+			},
+			Call: func(ctx context.Context, args map[string]any) (any, error) {
+				return GetPrimaryElectionEvents(ctx, dbName)
+			},
+		},
+		{
+			Declaration: &genai.FunctionDeclaration{
+				Name: "aggregate",
+				Description: fmt.Sprintf("Runs a read-only aggregation pipeline on a collection of the run database and returns at most %d documents. Collections: %s. Stages: %s.",
+					maxAgentAggregateDocs, strings.Join(agentCollections, ", "), strings.Join(sortedKeys(agentAllowedStages), ", ")),
+				Parameters: objectSchema([]string{"collection", "pipeline"}, map[string]*genai.Schema{
+					"collection": {Type: genai.TypeString, Enum: agentCollections},
+					"pipeline":   {Type: genai.TypeString, Description: "The pipeline, as a JSON array of stages in MongoDB Extended JSON."},
+				}),
+			},
+			Call: func(ctx context.Context, args map[string]any) (any, error) {
+				pipeline, err := parseReadOnlyPipeline(argString(args, "pipeline"))
+				if err != nil {
+					return nil, err
+				}
+				collection := argString(args, "collection")
+				if !contains(agentCollections, collection) {
+					return nil, fmt.Errorf("collection %q can't be aggregated", collection)
+				}
+				docs, err := AggregateRunCollection(ctx, dbName, collection, pipeline, maxAgentAggregateDocs, agentAggregateTimeout)
+				if err != nil {
+					return nil, err
+				}
+				return TruncateLiterals(docs), nil
+			},
+		},
+	}
+	// The aggregate tool is left out when literals are redacted, as its pipelines can copy them
+	// out of the fields the redactor knows about.
+	if !GetRedactor().Disabled() {
+		tools = slices.DeleteFunc(tools, func(t AgentTool) bool { return t.Declaration.Name == "aggregate" })
+	}
+	return tools
+}
+
+// parseReadOnlyPipeline parses an aggregation pipeline, rejecting the stages that aren't allowed
+// and the operators that run JavaScript.
+func parseReadOnlyPipeline(text string) (bson.A, error) {
+	var pipeline bson.A
+	if err := bson.UnmarshalExtJSON([]byte(`{"pipeline":`+text+`}`), false, &struct {
+		Pipeline *bson.A `bson:"pipeline"`
+	}{&pipeline}); err != nil {
+		return nil, fmt.Errorf("invalid pipeline: %w", err)
+	}
+	if err := checkReadOnlyPipeline(pipeline); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+// checkReadOnlyPipeline checks the stages of a pipeline, and the sub-pipelines of its $facet,
+// $lookup and $unionWith stages, which can only read the collections of the aggregate tool.
+func checkReadOnlyPipeline(pipeline bson.A) error {
+	for _, stage := range pipeline {
+		doc, ok := stage.(bson.D)
+		if !ok || len(doc) != 1 {
+			return fmt.Errorf("invalid pipeline stage %v", stage)
+		}
+		name, spec := doc[0].Key, doc[0].Value
+		if !agentAllowedStages[name] {
+			return fmt.Errorf("stage %s isn't allowed in a read-only pipeline", name)
+		}
+		if op := findOperator(spec, agentForbiddenOperators); op != "" {
+			return fmt.Errorf("operator %s isn't allowed in a read-only pipeline", op)
+		}
+		var subPipelines []bson.A
+		switch name {
+		case "$facet":
+			facets, ok := spec.(bson.D)
+			if !ok {
+				return fmt.Errorf("invalid $facet stage %v", spec)
+			}
+			for _, facet := range facets {
+				sub, ok := facet.Value.(bson.A)
+				if !ok {
+					return fmt.Errorf("invalid $facet pipeline %s", facet.Key)
+				}
+				subPipelines = append(subPipelines, sub)
+			}
+		case "$lookup", "$unionWith":
+			collection, sub, err := lookupSource(name, spec)
+			if err != nil {
+				return err
+			}
+			if !contains(agentCollections, collection) {
+				return fmt.Errorf("%s can't read collection %q", name, collection)
+			}
+			subPipelines = append(subPipelines, sub)
+		}
+		for _, sub := range subPipelines {
+			if err := checkReadOnlyPipeline(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookupSource returns the collection a $lookup or $unionWith stage reads, and its pipeline.
+// A collection in another database is rejected, as the tool only reads the run database.
+func lookupSource(name string, spec any) (string, bson.A, error) {
+	if collection, ok := spec.(string); ok && name == "$unionWith" {
+		return collection, nil, nil
+	}
+	doc, ok := spec.(bson.D)
+	if !ok {
+		return "", nil, fmt.Errorf("invalid %s stage %v", name, spec)
+	}
+	collectionKey := "from"
+	if name == "$unionWith" {
+		collectionKey = "coll"
+	}
+	var collection string
+	var pipeline bson.A
+	for _, e := range doc {
+		switch e.Key {
+		case collectionKey:
+			if collection, ok = e.Value.(string); !ok {
+				return "", nil, fmt.Errorf("%s can only read a collection of the run database", name)
+			}
+		case "db":
+			return "", nil, fmt.Errorf("%s can only read a collection of the run database", name)
+		case "pipeline":
+			if pipeline, ok = e.Value.(bson.A); !ok {
+				return "", nil, fmt.Errorf("invalid %s pipeline %v", name, e.Value)
+			}
+		}
+	}
+	return collection, pipeline, nil
+}
+
+// findOperator returns the first of the operators found in a document, at any depth.
+func findOperator(v any, operators map[string]bool) string {
+	switch t := v.(type) {
+	case bson.D:
+		for _, e := range t {
+			if operators[e.Key] {
+				return e.Key
+			}
+			if op := findOperator(e.Value, operators); op != "" {
+				return op
+			}
+		}
+	case bson.A:
+		for _, item := range t {
+			if op := findOperator(item, operators); op != "" {
+				return op
+			}
+		}
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RenderToolCallsSection renders the audit log of an agent's tool calls as a Markdown appendix.
+func RenderToolCallsSection(calls []ToolCallRecord) string {
+	if len(calls) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("## Appendix: agent tool calls\n\n")
+	sb.WriteString("The analysis above was written by an agent that called the following tools, in this order.\n")
+	for i, call := range calls {
+		args, _ := json.Marshal(call.Args)
+		fmt.Fprintf(&sb, "\n### %d. `%s` (step %d, %s)\n\n", i+1, call.Tool, call.Step, call.Duration.Round(time.Millisecond))
+		fmt.Fprintf(&sb, "Arguments: `%s`\n\n", args)
+		if call.Error != "" {
+			fmt.Fprintf(&sb, "Error: %s\n", call.Error)
+			continue
+		}
+		sb.WriteString("```json\n" + call.Result + "\n```\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReadOnlyPipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline string
+		wantErr  string
+	}{
+		{
+			name:     "read-only stages",
+			pipeline: `[{"$match": {"attr.ns": "db.c"}}, {"$group": {"_id": "$attr.queryHash", "count": {"$sum": 1}}}, {"$sort": {"count": -1}}, {"$limit": 5}]`,
+		},
+		{
+			name:     "$out",
+			pipeline: `[{"$match": {}}, {"$out": "stolen"}]`,
+			wantErr:  "stage $out isn't allowed",
+		},
+		{
+			name:     "$merge",
+			pipeline: `[{"$merge": {"into": "slowQueries"}}]`,
+			wantErr:  "stage $merge isn't allowed",
+		},
+		{
+			name:     "$lookup on a run collection",
+			pipeline: `[{"$lookup": {"from": "queryAntiPatterns", "localField": "_id", "foreignField": "queryHash", "as": "hits"}}]`,
+		},
+		{
+			name:     "$lookup with a db",
+			pipeline: `[{"$lookup": {"from": "slowQueries", "db": "admin", "pipeline": [], "as": "x"}}]`,
+			wantErr:  "can only read a collection of the run database",
+		},
+		{
+			name:     "$lookup on a foreign collection",
+			pipeline: `[{"$lookup": {"from": "runManifest", "pipeline": [], "as": "x"}}]`,
+			wantErr:  `$lookup can't read collection "runManifest"`,
+		},
+		{
+			name:     "$lookup sub-pipeline writing",
+			pipeline: `[{"$lookup": {"from": "slowQueries", "pipeline": [{"$out": "x"}], "as": "x"}}]`,
+			wantErr:  "stage $out isn't allowed",
+		},
+		{
+			name:     "$unionWith by name",
+			pipeline: `[{"$unionWith": "mongosSlowQueries"}]`,
+		},
+		{
+			name:     "$unionWith on a foreign collection by name",
+			pipeline: `[{"$unionWith": "system.users"}]`,
+			wantErr:  `$unionWith can't read collection "system.users"`,
+		},
+		{
+			name:     "$facet nesting a $unionWith on a foreign collection",
+			pipeline: `[{"$facet": {"a": [{"$match": {}}], "b": [{"$unionWith": {"coll": "runManifest", "pipeline": []}}]}}]`,
+			wantErr:  `$unionWith can't read collection "runManifest"`,
+		},
+		{
+			name:     "$facet nesting a $unionWith with a db",
+			pipeline: `[{"$facet": {"a": [{"$unionWith": {"coll": "slowQueries", "db": "config"}}]}}]`,
+			wantErr:  "can only read a collection of the run database",
+		},
+		{
+			name:     "$function in $expr",
+			pipeline: `[{"$match": {"$expr": {"$function": {"body": "function() { return true }", "args": [], "lang": "js"}}}}]`,
+			wantErr:  "operator $function isn't allowed",
+		},
+		{
+			name:     "$where",
+			pipeline: `[{"$match": {"$where": "sleep(1000)"}}]`,
+			wantErr:  "operator $where isn't allowed",
+		},
+		{
+			name:     "$accumulator nested in a $facet",
+			pipeline: `[{"$facet": {"a": [{"$group": {"_id": null, "x": {"$accumulator": {}}}}]}}]`,
+			wantErr:  "operator $accumulator isn't allowed",
+		},
+		{
+			name:     "stage with two keys",
+			pipeline: `[{"$match": {}, "$limit": 1}]`,
+			wantErr:  "invalid pipeline stage",
+		},
+		{
+			name:     "not an array",
+			pipeline: `{"$match": {}}`,
+			wantErr:  "invalid pipeline",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseReadOnlyPipeline(tt.pipeline)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("parseReadOnlyPipeline() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseReadOnlyPipeline() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
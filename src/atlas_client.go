@@ -25,28 +25,53 @@ var (
 type AtlasClient struct {
 	HTTPClient *http.Client
 	AtlasSDK   *admin.APIClient
+	Resilience *Resilience
 }
 
-func NewAtlasClient(sdk *admin.APIClient) *AtlasClient {
+func NewAtlasClient(sdk *admin.APIClient) (*AtlasClient, error) {
 	if sdk == nil {
 		cfg, err := GetConfig()
 		if err != nil {
 			Logger.Error("Error getting config")
-			panic(err)
+			return nil, fmt.Errorf("failed to load configuration: %w", err)
 		}
 		sdk, err = admin.NewClient(admin.UseDigestAuth(cfg.AtlasPublicKey, cfg.AtlasPrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Atlas client: %w", err)
+		}
 	}
 
+	retry := defaultAtlasRetry
+	if cfg, err := GetConfig(); err == nil {
+		retry = cfg.AtlasRetry.withDefaults(defaultAtlasRetry)
+	}
 	return &AtlasClient{
-		AtlasSDK: sdk,
+		AtlasSDK:   sdk,
+		Resilience: NewResilience("atlas", retry),
+	}, nil
+}
+
+// atlasExecute runs an Atlas Admin API request through the client's resilience layer.
+func atlasExecute[T any](ctx context.Context, c *AtlasClient, operation string, request func(ctx context.Context) (T, *http.Response, error)) (T, *http.Response, error) {
+	var result T
+	var response *http.Response
+	err := c.Resilience.Do(ctx, operation, func(ctx context.Context) (*http.Response, error) {
+		var err error
+		result, response, err = request(ctx)
+		return response, err
+	})
+	if err != nil {
+		return result, response, newAtlasAPIError(operation, response, err)
 	}
+	return result, response, nil
 }
 
-func (c *AtlasClient) GetMeasurementsForProcess(ctx context.Context, projectID string, host string, startDate *time.Time, endDate *time.Time, period *string, granularity *string) (*admin.ApiMeasurementsGeneralViewAtlas, error) {
+func (c *AtlasClient) GetMeasurementsForProcess(ctx context.Context, projectID string, host string, metrics []string, startDate *time.Time, endDate *time.Time, period *string, granularity *string) (*admin.ApiMeasurementsGeneralViewAtlas, error) {
 	params := &admin.GetHostMeasurementsApiParams{
 		GroupId:     projectID,
 		ProcessId:   host,
 		Granularity: granularity,
+		M:           optionalMetrics(metrics),
 	}
 	if period != nil {
 		params.Period = period
@@ -54,7 +79,9 @@ func (c *AtlasClient) GetMeasurementsForProcess(ctx context.Context, projectID s
 		params.Start = startDate
 		params.End = endDate
 	}
-	measurements, response, err := c.AtlasSDK.MonitoringAndLogsApi.GetHostMeasurementsWithParams(ctx, params).Execute()
+	measurements, response, err := atlasExecute(ctx, c, "getHostMeasurements", func(ctx context.Context) (*admin.ApiMeasurementsGeneralViewAtlas, *http.Response, error) {
+		return c.AtlasSDK.MonitoringAndLogsApi.GetHostMeasurementsWithParams(ctx, params).Execute()
+	})
 	if err != nil {
 		Logger.Error("Failed to get host metrics: ", err)
 		return nil, err
@@ -75,13 +102,15 @@ func (c *AtlasClient) GetDisksOnHost(ctx context.Context, projectID string, host
 	includeCount := true
 
 	for hasNextPage == true {
-		partitions, response, err := c.AtlasSDK.MonitoringAndLogsApi.ListDiskPartitionsWithParams(ctx, &admin.ListDiskPartitionsApiParams{
-			GroupId:      projectID,
-			ProcessId:    host,
-			PageNum:      &pageNum,
-			ItemsPerPage: &perPage,
-			IncludeCount: &includeCount,
-		}).Execute()
+		partitions, response, err := atlasExecute(ctx, c, "listDiskPartitions", func(ctx context.Context) (*admin.PaginatedDiskPartition, *http.Response, error) {
+			return c.AtlasSDK.MonitoringAndLogsApi.ListDiskPartitionsWithParams(ctx, &admin.ListDiskPartitionsApiParams{
+				GroupId:      projectID,
+				ProcessId:    host,
+				PageNum:      &pageNum,
+				ItemsPerPage: &perPage,
+				IncludeCount: &includeCount,
+			}).Execute()
+		})
 		if err != nil {
 			Logger.Error("Failed to get host partitions: ", err)
 			return nil, err
@@ -105,7 +134,9 @@ func (c *AtlasClient) GetAtlasClusterInfo(ctx context.Context, projectID, cluste
 		GroupId:     projectID,
 		ClusterName: clusterName,
 	}
-	desc, response, err := c.AtlasSDK.ClustersApi.GetClusterWithParams(ctx, params).Execute()
+	desc, response, err := atlasExecute(ctx, c, "getCluster", func(ctx context.Context) (*admin.ClusterDescription20240805, *http.Response, error) {
+		return c.AtlasSDK.ClustersApi.GetClusterWithParams(ctx, params).Execute()
+	})
 	if err != nil {
 		Logger.Error("Failed to get host metrics: ", err)
 		return nil, err
@@ -117,16 +148,106 @@ func (c *AtlasClient) GetAtlasClusterInfo(ctx context.Context, projectID, cluste
 	return desc, nil
 }
 
+// ListProcesses returns every MongoDB process of the project.
+func (c *AtlasClient) ListProcesses(ctx context.Context, projectID string) ([]admin.ApiHostViewAtlas, error) {
+	var result []admin.ApiHostViewAtlas
+	hasNextPage := true
+	pageNum := 1
+	perPage := 100
+	includeCount := true
+
+	for hasNextPage {
+		processes, response, err := atlasExecute(ctx, c, "listProcesses", func(ctx context.Context) (*admin.PaginatedHostViewAtlas, *http.Response, error) {
+			return c.AtlasSDK.MonitoringAndLogsApi.ListAtlasProcessesWithParams(ctx, &admin.ListAtlasProcessesApiParams{
+				GroupId:      projectID,
+				PageNum:      &pageNum,
+				ItemsPerPage: &perPage,
+				IncludeCount: &includeCount,
+			}).Execute()
+		})
+		if err != nil {
+			Logger.Error("Failed to list processes: ", err)
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			Logger.Error("Process list request not OK")
+			return nil, fmt.Errorf("process list returned a non-200 response: %d", response.StatusCode)
+		}
+		result = append(result, processes.GetResults()...)
+		if len(result) >= processes.GetTotalCount() || len(processes.GetResults()) == 0 {
+			hasNextPage = false
+		} else {
+			pageNum++
+		}
+	}
+	return result, nil
+}
+
+// processRoles maps Atlas process types to the host roles used in threshold overrides.
+var processRoles = map[string]string{
+	"REPLICA_PRIMARY":        "primary",
+	"REPLICA_SECONDARY":      "secondary",
+	"REPLICA_ARBITER":        "arbiter",
+	"SHARD_PRIMARY":          "primary",
+	"SHARD_SECONDARY":        "secondary",
+	"SHARD_MONGOS":           "mongos",
+	"SHARD_CONFIG_PRIMARY":   "config",
+	"SHARD_CONFIG_SECONDARY": "config",
+}
+
+// GetProcessRoles returns the current role of each of the given "host:port" processes.
+func (c *AtlasClient) GetProcessRoles(ctx context.Context, projectID string, hosts []string) (map[string]string, error) {
+	processes, err := c.ListProcesses(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		wanted[h] = true
+	}
+	roles := make(map[string]string)
+	for _, p := range processes {
+		if !wanted[p.GetId()] {
+			continue
+		}
+		role, ok := processRoles[p.GetTypeName()]
+		if !ok {
+			role = strings.ToLower(p.GetTypeName())
+		}
+		roles[p.GetId()] = role
+	}
+	return roles, nil
+}
+
+// GetClusterTier returns the instance size of the cluster's electable nodes, e.g. M30.
+func (c *AtlasClient) GetClusterTier(ctx context.Context, projectID, clusterName string) (string, error) {
+	info, err := c.GetAtlasClusterInfo(ctx, projectID, clusterName)
+	if err != nil {
+		return "", err
+	}
+	for _, rs := range info.GetReplicationSpecs() {
+		for _, rc := range rs.GetRegionConfigs() {
+			if rc.ElectableSpecs != nil && rc.ElectableSpecs.InstanceSize != nil {
+				return *rc.ElectableSpecs.InstanceSize, nil
+			}
+		}
+	}
+	return "", nil
+}
+
 func (c *AtlasClient) GetAtlasClusterInfoString(ctx context.Context, projectID, clusterName string) (string, error) {
 	info, err := c.GetAtlasClusterInfo(ctx, projectID, clusterName)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	var specs []string
-	for _, rs := range *info.ReplicationSpecs {
-		for _, rc := range *rs.RegionConfigs {
+	for _, rs := range info.GetReplicationSpecs() {
+		for _, rc := range rs.GetRegionConfigs() {
+			if rc.ElectableSpecs == nil {
+				continue
+			}
 			es := rc.ElectableSpecs
-			str := fmt.Sprintf("There are %d IOPS available, as the cluster's base Atlas tier is %s.", es.DiskIOPS, *es.InstanceSize)
+			str := fmt.Sprintf("There are %d IOPS available, as the cluster's base Atlas tier is %s.", es.GetDiskIOPS(), es.GetInstanceSize())
 			specs = append(specs, str)
 		}
 	}
@@ -150,10 +271,111 @@ func (c *AtlasClient) DeleteClusterLogs(ctx context.Context, logFiles []string)
 	return nil
 }
 
-func (c *AtlasClient) DownloadClusterLogs(ctx context.Context, projectID, clusterName string, startDate int64, endDate int64) (map[string]string, error) {
-	// TODO: Support sharded clusters!
+// Atlas logs of a process.
+const (
+	logMongod = "mongodb"
+	logMongos = "mongos"
+)
+
+// HostLog is the log file downloaded for a process, and the Atlas log it was downloaded from.
+type HostLog struct {
+	Path    string
+	LogName string
+}
+
+// logTarget is a process whose log is to be downloaded.
+type logTarget struct {
+	key     string
+	host    string
+	logName string
+}
+
+// isShardedCluster tells whether a cluster type is sharded.
+func isShardedCluster(clusterType string) bool {
+	return clusterType == "SHARDED" || clusterType == "GEOSHARDED"
+}
+
+// GetShardCount returns the number of shards of a sharded cluster, and 0 for a replica set.
+func (c *AtlasClient) GetShardCount(ctx context.Context, projectID, clusterName string) (int, error) {
+	info, err := c.GetAtlasClusterInfo(ctx, projectID, clusterName)
+	if err != nil {
+		return 0, err
+	}
+	if !isShardedCluster(info.GetClusterType()) {
+		return 0, nil
+	}
+	return len(info.GetReplicationSpecs()), nil
+}
+
+// clusterNodeStem returns the part of an Atlas node host name that the cluster's nodes share,
+// e.g. "cluster0-" and ".abcde.mongodb.net" for cluster0-shard-00-00.abcde.mongodb.net, or
+// false when the host name doesn't follow the Atlas naming.
+func clusterNodeStem(host string) (string, string, bool) {
+	label, domain, ok := strings.Cut(host, ".")
+	if !ok {
+		return "", "", false
+	}
+	for _, node := range []string{"-shard-", "-config-"} {
+		if i := strings.LastIndex(label, node); i > 0 {
+			return label[:i+1], "." + domain, true
+		}
+	}
+	return "", "", false
+}
+
+// inCluster tells whether a process is a node of the cluster whose connection string lists
+// the given hosts. Atlas names the nodes of a cluster after it, so a process belongs to the
+// cluster when its alias, the host name of the connection strings, shares their stem.
+func inCluster(p admin.ApiHostViewAtlas, hosts []string) bool {
+	alias := p.GetUserAlias()
+	if alias == "" {
+		alias = p.GetHostname()
+	}
+	prefix, domain, ok := clusterNodeStem(alias)
+	for _, host := range hosts {
+		if host == alias || host == p.GetHostname() {
+			return true
+		}
+		if hostPrefix, hostDomain, hostOK := clusterNodeStem(host); ok && hostOK && hostPrefix == prefix && hostDomain == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// shardedLogTargets returns the mongos and shard member processes of a sharded cluster. The
+// processes of the project are picked by cluster, rather than by the hosts of the connection
+// string, which only lists the hosts of some of the mongos routers.
+func (c *AtlasClient) shardedLogTargets(ctx context.Context, projectID string, hosts []string) ([]logTarget, error) {
+	processes, err := c.ListProcesses(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the cluster's processes: %w", err)
+	}
+	var targets []logTarget
+	for _, p := range processes {
+		if !inCluster(p, hosts) {
+			continue
+		}
+		switch processRoles[p.GetTypeName()] {
+		case "mongos":
+			targets = append(targets, logTarget{p.GetId(), p.GetHostname(), logMongos})
+		case "primary", "secondary":
+			targets = append(targets, logTarget{p.GetId(), p.GetHostname(), logMongod})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no mongos or shard member process of the project belongs to the cluster of %s", strings.Join(hosts, ", "))
+	}
+	return targets, nil
+}
+
+// DownloadClusterLogs downloads the logs of every process of the cluster over the given
+// window: the replica set members of a replica set, and the mongos routers and shard members
+// of a sharded cluster. A host whose logs can't be downloaded is recorded as a data gap of the
+// slow query report; it only fails when no host's logs could be downloaded.
+func (c *AtlasClient) DownloadClusterLogs(ctx context.Context, projectID, clusterName string, startDate int64, endDate int64) (map[string]HostLog, error) {
 	Logger.Info("Downloading Atlas cluster logs")
-	var hostLogMapping = make(map[string]string)
+	var hostLogMapping = make(map[string]HostLog)
 	info, err := c.GetAtlasClusterInfo(ctx, projectID, clusterName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cluster info: %w", err)
@@ -162,47 +384,53 @@ func (c *AtlasClient) DownloadClusterLogs(ctx context.Context, projectID, cluste
 	if err != nil {
 		return nil, fmt.Errorf("failed to get hosts from connection string: %w", err)
 	}
-	var logFiles []string
-	var mu sync.Mutex
+	var targets []logTarget
+	if isShardedCluster(info.GetClusterType()) {
+		targets, err = c.shardedLogTargets(ctx, projectID, hosts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for i, host := range hosts {
+			targets = append(targets, logTarget{fmt.Sprintf("%s:%s", host, ports[i]), host, logMongod})
+		}
+	}
 	var wg sync.WaitGroup
-	errChan := make(chan error, len(hosts))
+	errChan := make(chan error, len(targets))
 	hostLogMappingChan := make(chan struct {
-		key     string
-		logFile string
-	}, len(hosts))
+		key string
+		log HostLog
+	}, len(targets))
 
-	for i, host := range hosts {
+	for _, target := range targets {
 		wg.Add(1)
-		go func(i int, host string) {
+		go func(target logTarget) {
 			defer wg.Done()
-			Logger.WithFields(logrus.Fields{"host": host}).Info("Downloading logs for host")
-			logFile, err := c.GetClusterLogsForHost(ctx, projectID, host, &startDate, &endDate)
+			Logger.WithFields(logrus.Fields{"host": target.key, "log": target.logName}).Info("Downloading logs for host")
+			logFile, err := c.GetClusterLogsForHost(ctx, projectID, target.host, target.logName, &startDate, &endDate)
 			if err != nil {
-				errChan <- fmt.Errorf("failed to download logs for host %s: %w", host, err)
+				err = fmt.Errorf("failed to download %s logs for host %s: %w", target.logName, target.key, err)
+				Logger.Error(err)
+				GetRunSummary().RecordGap(slowQueryReport, gapHost, target.key, err)
+				errChan <- err
 				return
 			}
 			hostLogMappingChan <- struct {
-				key     string
-				logFile string
-			}{fmt.Sprintf("%s:%s", host, ports[i]), logFile}
-			mu.Lock()
-			logFiles = append(logFiles, logFile)
-			mu.Unlock()
-		}(i, host)
+				key string
+				log HostLog
+			}{target.key, HostLog{Path: logFile, LogName: target.logName}}
+		}(target)
 	}
 
 	wg.Wait()
 	close(errChan)
 	close(hostLogMappingChan)
 
-	// Check for errors
-	if len(errChan) > 0 {
-		_ = c.DeleteClusterLogs(ctx, logFiles)
-		return nil, <-errChan
-	}
-
 	for entry := range hostLogMappingChan {
-		hostLogMapping[entry.key] = entry.logFile
+		hostLogMapping[entry.key] = entry.log
+	}
+	if len(hostLogMapping) == 0 {
+		return nil, <-errChan
 	}
 	return hostLogMapping, nil
 }
@@ -236,39 +464,51 @@ func GetHostsFromConnectionString(connectionString string) ([]string, []string,
 	return hosts, ports, nil
 }
 
-func (c *AtlasClient) GetClusterLogsForHost(ctx context.Context, projectID, host string, startDate *int64, endDate *int64) (string, error) {
+func (c *AtlasClient) GetClusterLogsForHost(ctx context.Context, projectID, host string, logName string, startDate *int64, endDate *int64) (string, error) {
 	params := &admin.GetHostLogsApiParams{
 		GroupId:   projectID,
 		HostName:  host,
-		LogName:   "mongodb",
+		LogName:   logName,
 		StartDate: startDate,
 		EndDate:   endDate,
 	}
-	log, response, err := c.AtlasSDK.MonitoringAndLogsApi.GetHostLogsWithParams(ctx, params).Execute()
-	if err != nil {
-		Logger.Error("Failed to get host logs: ", err)
-		return "", err
-	}
-	if response.StatusCode != http.StatusOK {
-		Logger.Error("Host log request not OK")
-		return "", fmt.Errorf("host logs returned a non-200 response: %d", response.StatusCode)
-	}
+	// The log is streamed within the retried call, so that a download cut short is retried too.
+	// Archives of busy hosts take far longer than an API call, so they get the download timeout.
+	timeout := time.Duration(c.Resilience.Config.DownloadTimeoutSeconds) * time.Second
+	var logFile string
+	var lastResponse *http.Response
+	err := c.Resilience.DoWithTimeout(ctx, "getHostLogs", timeout, func(ctx context.Context) (*http.Response, error) {
+		log, response, err := c.AtlasSDK.MonitoringAndLogsApi.GetHostLogsWithParams(ctx, params).Execute()
+		lastResponse = response
+		if err != nil {
+			return response, err
+		}
+		defer log.Close()
+		if response.StatusCode != http.StatusOK {
+			return response, fmt.Errorf("host logs returned a non-200 response: %d", response.StatusCode)
+		}
 
-	tmpFile, err := os.CreateTemp("", fmt.Sprintf("mongod_%s_%d_%d_*.log.gz", host, startDate, endDate))
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
-	}
-	defer tmpFile.Close()
-	defer log.Close()
+		tmpFile, err := os.CreateTemp("", fmt.Sprintf("%s_%s_%d_%d_*.log.gz", logName, host, *startDate, *endDate))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp file: %w", err)
+		}
+		defer tmpFile.Close()
 
-	_, err = io.Copy(tmpFile, log)
+		if _, err := io.Copy(tmpFile, log); err != nil {
+			os.Remove(tmpFile.Name())
+			return nil, fmt.Errorf("failed to download host logs: %w", err)
+		}
+		logFile = tmpFile.Name()
+		return response, nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		Logger.Error("Failed to get host logs: ", err)
+		return "", newAtlasAPIError("getHostLogs", lastResponse, err)
 	}
-	return tmpFile.Name(), nil
+	return logFile, nil
 }
 
-func (c *AtlasClient) GetDiskMetrics(ctx context.Context, projectID, host, partition *string, startDate *time.Time, endDate *time.Time, period *string, granularity *string) (*admin.ApiMeasurementsGeneralViewAtlas, error) {
+func (c *AtlasClient) GetDiskMetrics(ctx context.Context, projectID, host, partition *string, metrics []string, startDate *time.Time, endDate *time.Time, period *string, granularity *string) (*admin.ApiMeasurementsGeneralViewAtlas, error) {
 	params := &admin.GetDiskMeasurementsApiParams{
 		GroupId:       *projectID,
 		PartitionName: *partition,
@@ -276,6 +516,7 @@ func (c *AtlasClient) GetDiskMetrics(ctx context.Context, projectID, host, parti
 		Start:         startDate,
 		End:           endDate,
 		Granularity:   granularity,
+		M:             optionalMetrics(metrics),
 	}
 	if period != nil {
 		params.Period = period
@@ -283,7 +524,9 @@ func (c *AtlasClient) GetDiskMetrics(ctx context.Context, projectID, host, parti
 		params.Start = startDate
 		params.End = endDate
 	}
-	measurements, response, err := c.AtlasSDK.MonitoringAndLogsApi.GetDiskMeasurementsWithParams(ctx, params).Execute()
+	measurements, response, err := atlasExecute(ctx, c, "getDiskMeasurements", func(ctx context.Context) (*admin.ApiMeasurementsGeneralViewAtlas, *http.Response, error) {
+		return c.AtlasSDK.MonitoringAndLogsApi.GetDiskMeasurementsWithParams(ctx, params).Execute()
+	})
 	if err != nil {
 		Logger.Error("Failed to get disk metrics: ", err)
 		return nil, err
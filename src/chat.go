@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genai"
+)
+
+const (
+	defaultChatSession = "default"
+	// Size of a chat request body at most.
+	maxChatRequestBytes = 64 * 1024
+	// Sessions the HTTP endpoint keeps at most, and how long an idle one is kept.
+	maxChatSessions = 32
+	chatSessionTTL  = time.Hour
+	// Contents of the seed of a session: the seed prompt and the model's acknowledgment.
+	chatSeedContents = 2
+	// Environment variable holding the bearer token of the HTTP endpoint.
+	chatTokenEnv = "REPORT_INSIGHTS_CHAT_TOKEN"
+)
+
+// ChatSession is a multi-turn conversation over a completed run, seeded with the run's
+// aggregates and reports. The model answers by querying the run database with the agent
+// tools.
+type ChatSession struct {
+	Agent *Agent
+	Model string
+	// Budget is the token budget of the conversation, past which its oldest questions are
+	// dropped.
+	Budget   int
+	mu       sync.Mutex
+	contents []*genai.Content
+}
+
+// NewChatSession seeds a chat over the given run. The run's data that can't be fetched is
+// left out of the seed, as the model can still query it.
+func NewChatSession(ctx context.Context, lc *LLMClient, ac *AtlasClient, runID string) (*ChatSession, error) {
+	cfg, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	m, err := GetRunManifest(ctx, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load run %s: %w", runID, err)
+	}
+	agent := NewAgent(lc, NewAgentTools(ac, runID), cfg.Agent)
+	start, end := m.Window()
+	data := ChatPromptData{
+		Language:    GetReportLocale().LanguageName(),
+		RunID:       m.RunID,
+		ClusterName: m.ClusterName,
+		WindowStart: start,
+		WindowEnd:   end,
+		Hosts:       m.Hosts,
+		MaxSteps:    agent.Config.MaxSteps,
+	}
+	fields := logrus.Fields{"run": runID}
+	if shapes, err := GetTopQueryShapesByExecutionTime(ctx, runID, cfg.NumAnalyzedQueries, cfg.RankQueryShapesBy); err != nil {
+		Logger.WithFields(fields).Warn("Failed to fetch the query shapes of the run: ", err)
+	} else if writes, err := GetTopWriteShapes(ctx, runID, cfg.NumAnalyzedQueries, cfg.RankQueryShapesBy); err != nil {
+		Logger.WithFields(fields).Warn("Failed to fetch the write shapes of the run: ", err)
+	} else {
+		shapes = append(shapes, writes...)
+		data.Shapes = RenderShapeSelectionSection(shapes) + "\n" + RenderTimeBreakdownSection(shapes)
+	}
+	if hits, err := ListQueryAntiPatterns(ctx, runID); err != nil {
+		Logger.WithFields(fields).Warn("Failed to fetch the anti-patterns of the run: ", err)
+	} else {
+		data.AntiPatterns = RenderAntiPatternsSection(hits)
+	}
+	if findings, err := ListMetricFindings(ctx, runID); err != nil {
+		Logger.WithFields(fields).Warn("Failed to fetch the metric findings of the run: ", err)
+	} else {
+		data.Findings = RenderMetricFindingsSection(findings)
+	}
+	if windows, err := ListCorrelatedWindows(ctx, runID); err != nil {
+		Logger.WithFields(fields).Warn("Failed to fetch the correlated windows of the run: ", err)
+	} else {
+		data.Correlations = RenderCorrelationSection(windows)
+	}
+	reports, err := ListReports(ctx, runID)
+	if err != nil {
+		Logger.WithFields(fields).Warn("Failed to fetch the reports of the run: ", err)
+	}
+	// Each report gets a share of the prompt budget.
+	maxChars := PromptTokenBudget(cfg) * charsPerToken / 4
+	for _, report := range reports {
+		report.Text = truncateToolResult(report.Text, maxChars)
+		data.Reports = append(data.Reports, report)
+	}
+	seed, err := renderPrompt(chatInstructionsTemplate, data)
+	if err != nil {
+		return nil, err
+	}
+	modelName := cfg.GeminiModel
+	if modelName == "" {
+		modelName = defaultModel
+	}
+	Logger.WithFields(logrus.Fields{"run": runID, "reports": len(data.Reports), "tokens": EstimateTokens(seed)}).Info("Chat session seeded")
+	return &ChatSession{
+		Agent:  agent,
+		Model:  modelName,
+		Budget: PromptTokenBudget(cfg),
+		contents: []*genai.Content{
+			genai.NewContentFromText(seed, "user"),
+			genai.NewContentFromText("I have the run's aggregates and reports. What would you like to know?", "model"),
+		},
+	}, nil
+}
+
+// Ask answers a question, and returns the answer along with the tool calls it took. The agent
+// only keeps the tool calls of the current question, and the conversation is trimmed to the
+// session's budget.
+func (s *ChatSession) Ask(ctx context.Context, question string) (string, []ToolCallRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Agent.Calls = nil
+	contents := append(s.contents, genai.NewContentFromText(question, "user"))
+	answer, contents, err := s.Agent.Converse(ctx, s.Model, contents)
+	if err != nil {
+		return "", s.Agent.Calls, err
+	}
+	s.contents = trimChatHistory(contents, s.Budget)
+	return answer, s.Agent.Calls, nil
+}
+
+// contentTokens estimates the tokens of a conversation entry, tool calls and results included.
+func contentTokens(c *genai.Content) int {
+	tokens := 0
+	for _, part := range c.Parts {
+		switch {
+		case part.FunctionCall != nil:
+			args, _ := json.Marshal(part.FunctionCall.Args)
+			tokens += EstimateTokens(part.FunctionCall.Name + string(args))
+		case part.FunctionResponse != nil:
+			response, _ := json.Marshal(part.FunctionResponse.Response)
+			tokens += EstimateTokens(part.FunctionResponse.Name + string(response))
+		default:
+			tokens += EstimateTokens(part.Text)
+		}
+	}
+	return tokens
+}
+
+// trimChatHistory drops the oldest questions, with the tool calls and answers that followed
+// them, until the conversation fits in the token budget. The seed and the latest question are
+// always kept.
+func trimChatHistory(contents []*genai.Content, budget int) []*genai.Content {
+	total := 0
+	for _, c := range contents {
+		total += contentTokens(c)
+	}
+	// Questions are the user entries that aren't tool results, where the history can be cut
+	// without separating a tool call from its result.
+	var questions []int
+	for i := chatSeedContents; i < len(contents); i++ {
+		c := contents[i]
+		if c.Role == "user" && len(c.Parts) > 0 && c.Parts[0].FunctionResponse == nil {
+			questions = append(questions, i)
+		}
+	}
+	cut := chatSeedContents
+	for q := 1; total > budget && q < len(questions); q++ {
+		for _, c := range contents[cut:questions[q]] {
+			total -= contentTokens(c)
+		}
+		cut = questions[q]
+	}
+	if cut == chatSeedContents {
+		return contents
+	}
+	Logger.WithFields(logrus.Fields{"dropped": cut - chatSeedContents, "tokens": total}).Info("Trimmed the chat history to the prompt budget")
+	return append(append([]*genai.Content{}, contents[:chatSeedContents]...), contents[cut:]...)
+}
+
+// runChatCommand runs the "chat <run>" subcommand: a REPL over the run, or, with --listen, an
+// HTTP endpoint that requires the bearer token set in REPORT_INSIGHTS_CHAT_TOKEN.
+func runChatCommand(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	listen := fs.String("listen", "", "serve the chat over HTTP on this port or address, such as 8080 or 0.0.0.0:8080, instead of a REPL; a port alone listens on 127.0.0.1")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: chat [--listen <address>] <run>")
+	}
+	runID := fs.Arg(0)
+	token := os.Getenv(chatTokenEnv)
+	if *listen != "" && token == "" {
+		return fmt.Errorf("%s must be set to serve the chat over HTTP", chatTokenEnv)
+	}
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	defer DisconnectMongoClient()
+	geminiClient, err := genai.NewClient(ctx, &genai.ClientConfig{
+		APIKey:  cfg.GeminiAPIKey,
+		Backend: genai.BackendGeminiAPI,
+	})
+	if err != nil {
+		return err
+	}
+	lc, err := NewLLMClient(geminiClient)
+	if err != nil {
+		return err
+	}
+	ac, err := NewAtlasClient(nil)
+	if err != nil {
+		return err
+	}
+	if *listen != "" {
+		address := chatListenAddress(*listen)
+		server := &http.Server{
+			Addr:              address,
+			Handler:           NewChatHandler(lc, ac, runID, token),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		Logger.WithFields(logrus.Fields{"address": address, "run": runID}).Info("Serving the chat over HTTP")
+		return server.ListenAndServe()
+	}
+
+	session, err := NewChatSession(ctx, lc, ac, runID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Chatting about run %s. Type \"exit\" to quit.\n", runID)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		question := strings.TrimSpace(scanner.Text())
+		switch question {
+		case "":
+			continue
+		case "exit", "quit":
+			return nil
+		}
+		answer, calls, err := session.Ask(ctx, question)
+		for _, call := range calls {
+			fmt.Fprintf(out, "[%s %s]\n", call.Tool, toolCallArgs(call))
+		}
+		if err != nil {
+			fmt.Fprintln(out, "Error:", err)
+			continue
+		}
+		fmt.Fprintln(out, answer)
+	}
+}
+
+// chatListenAddress binds a port given alone, such as 8080 or :8080, to the loopback interface,
+// so that the chat is only reachable from other hosts when their interface is named.
+func chatListenAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		host, port = "", strings.TrimPrefix(listen, ":")
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func toolCallArgs(call ToolCallRecord) string {
+	args, _ := json.Marshal(call.Args)
+	return string(args)
+}
+
+type chatRequest struct {
+	Session  string `json:"session"`
+	Question string `json:"question"`
+}
+
+type chatResponse struct {
+	Session   string           `json:"session"`
+	Answer    string           `json:"answer,omitempty"`
+	ToolCalls []ToolCallRecord `json:"toolCalls"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// ChatHandler serves the chat over a run on POST /chat to the requests bearing its token.
+// Requests name their session, and each session keeps its own conversation.
+type ChatHandler struct {
+	lc       *LLMClient
+	ac       *AtlasClient
+	runID    string
+	token    string
+	mu       sync.Mutex
+	sessions map[string]*chatSessionEntry
+}
+
+// chatSessionEntry is a session of the handler, which is ready once it's seeded.
+type chatSessionEntry struct {
+	ready    chan struct{}
+	session  *ChatSession
+	err      error
+	lastUsed time.Time
+}
+
+func NewChatHandler(lc *LLMClient, ac *AtlasClient, runID string, token string) *ChatHandler {
+	return &ChatHandler{lc: lc, ac: ac, runID: runID, token: token, sessions: make(map[string]*chatSessionEntry)}
+}
+
+// session returns the named session, seeding it outside the handler's lock so that the other
+// sessions aren't held up. Sessions idle for longer than chatSessionTTL expire, and the least
+// recently used one is evicted past maxChatSessions.
+func (h *ChatHandler) session(ctx context.Context, name string) (*ChatSession, error) {
+	now := time.Now()
+	h.mu.Lock()
+	var lru string
+	for key, entry := range h.sessions {
+		if now.Sub(entry.lastUsed) > chatSessionTTL {
+			delete(h.sessions, key)
+		} else if lru == "" || entry.lastUsed.Before(h.sessions[lru].lastUsed) {
+			lru = key
+		}
+	}
+	entry, found := h.sessions[name]
+	if !found {
+		if len(h.sessions) >= maxChatSessions {
+			Logger.WithFields(logrus.Fields{"session": lru}).Info("Evicting the least recently used chat session")
+			delete(h.sessions, lru)
+		}
+		entry = &chatSessionEntry{ready: make(chan struct{})}
+		h.sessions[name] = entry
+	}
+	entry.lastUsed = now
+	h.mu.Unlock()
+
+	if !found {
+		entry.session, entry.err = NewChatSession(ctx, h.lc, h.ac, h.runID)
+		close(entry.ready)
+		if entry.err != nil {
+			h.mu.Lock()
+			if h.sessions[name] == entry {
+				delete(h.sessions, name)
+			}
+			h.mu.Unlock()
+		}
+	}
+	select {
+	case <-entry.ready:
+		return entry.session, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (h *ChatHandler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *ChatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/chat" {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeChatResponse(w, http.StatusUnauthorized, chatResponse{Error: "unauthorized"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req chatRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxChatRequestBytes)).Decode(&req); err != nil {
+		writeChatResponse(w, http.StatusBadRequest, chatResponse{Error: "invalid request: " + err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Question) == "" {
+		writeChatResponse(w, http.StatusBadRequest, chatResponse{Error: "question is required"})
+		return
+	}
+	if req.Session == "" {
+		req.Session = defaultChatSession
+	}
+	session, err := h.session(r.Context(), req.Session)
+	if err != nil {
+		Logger.Error(err)
+		writeChatResponse(w, http.StatusInternalServerError, chatResponse{Session: req.Session, Error: err.Error()})
+		return
+	}
+	answer, calls, err := session.Ask(r.Context(), req.Question)
+	res := chatResponse{Session: req.Session, Answer: answer, ToolCalls: calls}
+	if err != nil {
+		Logger.Error(err)
+		res.Error = err.Error()
+		status := http.StatusBadGateway
+		if errors.Is(err, context.Canceled) {
+			status = http.StatusRequestTimeout
+		}
+		writeChatResponse(w, status, res)
+		return
+	}
+	writeChatResponse(w, http.StatusOK, res)
+}
+
+func writeChatResponse(w http.ResponseWriter, status int, res chatResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		Logger.Error(err)
+	}
+}
@@ -7,20 +7,36 @@ import (
 )
 
 type Config struct {
-	GeminiAPIKey                string   `json:"GeminiAPIKey"`
-	AtlasPublicKey              string   `json:"atlasPublicKey"`
-	AtlasPrivateKey             string   `json:"atlasPrivateKey"`
-	Metrics                     []string `json:"metrics"`
-	MetricsReportOutputFile     string   `json:"metricsReportOutputFile"`
-	SlowQueriesReportOutputFile string   `json:"slowQueriesReportOutputFile"`
-	GeminiModel                 string   `json:"geminiModel"`
-	ProjectId                   string   `json:"projectId"`
-	ClusterName                 string   `json:"clusterName"`
-	Period                      string   `json:"period"`
-	MetricsGranularity          string   `json:"metricsGranularity"`
-	LogLevel                    string   `json:"logLevel"`
-	OutputMongoURI              string   `json:"outputMongoUri"`
-	NumAnalyzedQueries          int      `json:"numAnalyzedQueries"`
+	GeminiAPIKey                string                `json:"GeminiAPIKey"`
+	AtlasPublicKey              string                `json:"atlasPublicKey"`
+	AtlasPrivateKey             string                `json:"atlasPrivateKey"`
+	Metrics                     []string              `json:"metrics"`
+	MetricsReportOutputFile     string                `json:"metricsReportOutputFile"`
+	SlowQueriesReportOutputFile string                `json:"slowQueriesReportOutputFile"`
+	GeminiModel                 string                `json:"geminiModel"`
+	ProjectId                   string                `json:"projectId"`
+	ClusterName                 string                `json:"clusterName"`
+	Period                      string                `json:"period"`
+	MetricsGranularity          string                `json:"metricsGranularity"`
+	LogLevel                    string                `json:"logLevel"`
+	OutputMongoURI              string                `json:"outputMongoUri"`
+	NumAnalyzedQueries          int                   `json:"numAnalyzedQueries"`
+	RankQueryShapesBy           string                `json:"rankQueryShapesBy"`
+	RankingWeights              map[string]float64    `json:"rankingWeights"`
+	MinCollscanShapes           int                   `json:"minCollscanShapes"`
+	Thresholds                  *ThresholdProfile     `json:"thresholds"`
+	ThresholdsFile              string                `json:"thresholdsFile"`
+	AttachRawMetrics            bool                  `json:"attachRawMetrics"`
+	PromptTokenBudget           int                   `json:"promptTokenBudget"`
+	AtlasRetry                  RetryConfig           `json:"atlasRetry"`
+	LLMRetry                    RetryConfig           `json:"llmRetry"`
+	LLMCache                    LLMCacheConfig        `json:"llmCache"`
+	PromptTemplatesDir          string                `json:"promptTemplatesDir"`
+	ReportLanguage              string                `json:"reportLanguage"`
+	Agent                       AgentConfig           `json:"agent"`
+	IndexValidation             IndexValidationConfig `json:"indexValidation"`
+	Redaction                   RedactionConfig       `json:"redaction"`
+	Sharding                    ShardingConfig        `json:"sharding"`
 }
 
 var (
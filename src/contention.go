@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Share of a shape's time spent waiting above which it's considered slow because the node
+// was saturated rather than because of its plan.
+const saturationShareThreshold = 0.5
+
+// sumNestedMicrosExpr sums the values of a two-level document such as
+// attr.locks.<resource>.timeAcquiringMicros.<mode>.
+func sumNestedMicrosExpr(path string, leaf string) bson.D {
+	return bson.D{
+		{"$reduce", bson.D{
+			{"input", bson.D{{"$objectToArray", bson.D{{"$ifNull", bson.A{path, bson.D{}}}}}}},
+			{"initialValue", 0},
+			{"in", bson.D{
+				{"$add", bson.A{
+					"$$value",
+					bson.D{{"$reduce", bson.D{
+						{"input", bson.D{{"$objectToArray", bson.D{{"$ifNull", bson.A{"$$this.v." + leaf, bson.D{}}}}}}},
+						{"initialValue", 0},
+						{"in", bson.D{{"$add", bson.A{"$$value", "$$this.v"}}}},
+					}}},
+				}},
+			}},
+		}},
+	}
+}
+
+// sumMicrosExpr sums a field of every sub-document of a document, such as
+// attr.queues.<queue>.totalTimeQueuedMicros. An empty leaf sums the values directly.
+func sumMicrosExpr(path string, leaf string) bson.D {
+	value := "$$this.v"
+	if leaf != "" {
+		value += "." + leaf
+	}
+	return bson.D{
+		{"$reduce", bson.D{
+			{"input", bson.D{{"$objectToArray", bson.D{{"$ifNull", bson.A{path, bson.D{}}}}}}},
+			{"initialValue", 0},
+			{"in", bson.D{{"$add", bson.A{"$$value", bson.D{{"$ifNull", bson.A{value, 0}}}}}}},
+		}},
+	}
+}
+
+// contentionFields are the per-entry wait times, added before grouping.
+func contentionFields() bson.D {
+	return bson.D{
+		{"lockWaitMicros", sumNestedMicrosExpr("$attr.locks", "timeAcquiringMicros")},
+		{"storageWaitMicros", sumMicrosExpr("$attr.storage.data.timeWaitingMicros", "")},
+		{"queueWaitMicros", sumMicrosExpr("$attr.queues", "totalTimeQueuedMicros")},
+	}
+}
+
+// contentionAccumulators are the $group accumulators of the time breakdown.
+func contentionAccumulators() bson.D {
+	return bson.D{
+		{"totalDiskReadMicros", bson.D{{"$sum", "$attr.storage.data.timeReadingMicros"}}},
+		{"totalLockWaitMicros", bson.D{{"$sum", "$lockWaitMicros"}}},
+		{"totalStorageWaitMicros", bson.D{{"$sum", "$storageWaitMicros"}}},
+		{"totalQueueWaitMicros", bson.D{{"$sum", "$queueWaitMicros"}}},
+		{"totalFlowControlMicros", bson.D{{"$sum", "$attr.flowControl.timeAcquiringMicros"}}},
+		{"totalCpuNanos", bson.D{{"$sum", "$attr.cpuNanos"}}},
+	}
+}
+
+// TimeBreakdown splits the total time of a shape into where it was spent, in milliseconds.
+type TimeBreakdown struct {
+	TotalMillis     float64
+	ExecutionMillis float64
+	DiskReadMillis  float64
+	LockWaitMillis  float64
+	QueueWaitMillis float64
+	// CPUMillis is only reported by servers that log cpuNanos (6.3+ on Linux).
+	CPUMillis float64
+}
+
+// GetTimeBreakdown attributes a shape's total duration to disk reads, lock and storage engine
+// waits, and ticket, admission queue and flow control waits. The rest is execution time.
+func GetTimeBreakdown(shape SlowQueryByDriver) TimeBreakdown {
+	b := TimeBreakdown{
+		TotalMillis:     float64(shape.TotalDurationMillis),
+		DiskReadMillis:  shape.TotalDiskReadMicros / 1000,
+		LockWaitMillis:  (shape.TotalLockWaitMicros + shape.TotalStorageWaitMicros) / 1000,
+		QueueWaitMillis: (shape.TotalQueueWaitMicros + shape.TotalFlowControlMicros) / 1000,
+		CPUMillis:       shape.TotalCpuNanos / 1e6,
+	}
+	b.ExecutionMillis = b.TotalMillis - b.DiskReadMillis - b.LockWaitMillis - b.QueueWaitMillis
+	if b.ExecutionMillis < 0 {
+		b.ExecutionMillis = 0
+	}
+	return b
+}
+
+func (b TimeBreakdown) share(millis float64) float64 {
+	if b.TotalMillis == 0 {
+		return 0
+	}
+	return millis / b.TotalMillis
+}
+
+// Verdict tells whether the shape is slow because of its plan or because the node was
+// saturated, and which wait dominated in the latter case.
+func (b TimeBreakdown) Verdict() string {
+	return b.verdict(promptLocale)
+}
+
+// verdict is the Verdict of the breakdown, with its share formatted for locale.
+func (b TimeBreakdown) verdict(locale *ReportLocale) string {
+	waits := []struct {
+		name   string
+		millis float64
+	}{
+		{"disk reads", b.DiskReadMillis},
+		{"lock and storage engine waits", b.LockWaitMillis},
+		{"ticket and queue waits", b.QueueWaitMillis},
+	}
+	var waited float64
+	dominant := waits[0]
+	for _, w := range waits {
+		waited += w.millis
+		if w.millis > dominant.millis {
+			dominant = w
+		}
+	}
+	if b.TotalMillis == 0 || b.share(waited) < saturationShareThreshold {
+		return "plan-bound: most of the time is spent executing the plan"
+	}
+	return fmt.Sprintf("saturation-bound: %s of the time is spent waiting, mostly on %s", locale.Percent(b.share(waited)), dominant.name)
+}
+
+func (b TimeBreakdown) String() string {
+	s := fmt.Sprintf(
+		"execution %.0f ms (%.0f%%), disk read %.0f ms (%.0f%%), lock wait %.0f ms (%.0f%%), ticket/queue wait %.0f ms (%.0f%%)",
+		b.ExecutionMillis, b.share(b.ExecutionMillis)*100,
+		b.DiskReadMillis, b.share(b.DiskReadMillis)*100,
+		b.LockWaitMillis, b.share(b.LockWaitMillis)*100,
+		b.QueueWaitMillis, b.share(b.QueueWaitMillis)*100,
+	)
+	if b.CPUMillis > 0 {
+		s += fmt.Sprintf(", of which %.0f ms measured CPU", b.CPUMillis)
+	}
+	return s
+}
+
+// RenderTimeBreakdownSection renders a Markdown table of where the analyzed shapes spent
+// their time.
+func RenderTimeBreakdownSection(shapes []RankedShape) string {
+	var sb strings.Builder
+	sb.WriteString("## Time breakdown\n\n")
+	sb.WriteString("| Query hash | Namespace | Operation | Execution | Disk read | Lock wait | Ticket/queue wait | Verdict |\n")
+	sb.WriteString("|---|---|---|---|---|---|---|---|\n")
+	locale := GetReportLocale()
+	for _, shape := range shapes {
+		b := GetTimeBreakdown(shape.SlowQueryByDriver)
+		sb.WriteString(fmt.Sprintf(
+			"| %s | %s | %s | %s | %s | %s | %s | %s |\n",
+			shape.ID.Hash,
+			shape.ID.Namespace,
+			shape.ID.OpType,
+			locale.Percent(b.share(b.ExecutionMillis)),
+			locale.Percent(b.share(b.DiskReadMillis)),
+			locale.Percent(b.share(b.LockWaitMillis)),
+			locale.Percent(b.share(b.QueueWaitMillis)),
+			b.verdict(locale),
+		))
+	}
+	return sb.String()
+}
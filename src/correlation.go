@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	// A metric spikes in a window when its value is at or above this percentile of its series,
+	// and above its median so that flat series never spike.
+	spikePercentile = 0.9
+	// Number of top shapes kept per slow query bucket.
+	shapesPerBucket = 5
+	// Number of correlated windows reported.
+	maxCorrelatedWindows = 10
+)
+
+// correlatedMetrics are the Atlas metrics aligned with the slow query buckets, with the label
+// used to describe their peaks.
+var correlatedMetrics = []struct {
+	Name  string
+	Label string
+}{
+	{"SYSTEM_NORMALIZED_CPU_USER", "CPU"},
+	{memoryPercentUsedMetric, "memory"},
+	{diskIOPSTotalMetric, "disk IOPS"},
+	{"QUERY_TARGETING_SCANNED_OBJECTS_PER_RETURNED", "query targeting"},
+	{"QUERY_TARGETING_SCANNED_PER_RETURNED", "query targeting (keys)"},
+}
+
+type ShapeShare struct {
+	Hash                string  `bson:"hash" json:"hash"`
+	Namespace           string  `bson:"ns" json:"ns"`
+	Count               int32   `bson:"count" json:"count"`
+	TotalDurationMillis float64 `bson:"totalDurationMillis" json:"totalDurationMillis"`
+}
+
+// SlowQueryBucket holds the slow queries of a host within one metrics granularity window.
+type SlowQueryBucket struct {
+	Host                string       `bson:"host" json:"host"`
+	Start               time.Time    `bson:"start" json:"start"`
+	Count               int32        `bson:"count" json:"count"`
+	TotalDurationMillis float64      `bson:"totalDurationMillis" json:"totalDurationMillis"`
+	Shapes              []ShapeShare `bson:"shapes" json:"shapes"`
+}
+
+type MetricSpike struct {
+	Metric    string  `bson:"metric" json:"metric"`
+	Label     string  `bson:"label" json:"label"`
+	Value     float64 `bson:"value" json:"value"`
+	Threshold float64 `bson:"threshold" json:"threshold"`
+}
+
+// CorrelatedWindow is a window in which slow queries and metric spikes coincide on a host.
+type CorrelatedWindow struct {
+	Host            string        `bson:"host" json:"host"`
+	Start           time.Time     `bson:"start" json:"start"`
+	End             time.Time     `bson:"end" json:"end"`
+	SlowQueryCount  int32         `bson:"slowQueryCount" json:"slowQueryCount"`
+	SlowQueryMillis float64       `bson:"slowQueryMillis" json:"slowQueryMillis"`
+	SlowQuerySpike  bool          `bson:"slowQuerySpike" json:"slowQuerySpike"`
+	Spikes          []MetricSpike `bson:"spikes" json:"spikes"`
+	TopShapes       []ShapeShare  `bson:"topShapes" json:"topShapes"`
+	Score           float64       `bson:"score" json:"score"`
+	Statement       string        `bson:"statement" json:"statement"`
+}
+
+// GetSlowQueryBuckets buckets the slow queries of every host into windows of the given
+// granularity, keeping the shapes that accounted for the most slow time in each window.
+func GetSlowQueryBuckets(ctx context.Context, dbName string, granularity time.Duration) ([]SlowQueryBucket, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	binMinutes := int(granularity / time.Minute)
+	if binMinutes < 1 {
+		binMinutes = 1
+	}
+	collection := client.Database(dbName).Collection("slowQueries")
+	pipeline := mongo.Pipeline{
+		{{"$group", bson.D{
+			{"_id", bson.D{
+				{"host", "$host"},
+				{"start", bson.D{{"$dateTrunc", bson.D{
+					{"date", "$t.date"},
+					{"unit", "minute"},
+					{"binSize", binMinutes},
+				}}}},
+				{"hash", "$attr.queryHash"},
+				{"ns", "$attr.ns"},
+			}},
+			{"count", bson.D{{"$sum", 1}}},
+			{"totalDurationMillis", bson.D{{"$sum", "$attr.durationMillis"}}},
+		}}},
+		{{"$sort", bson.D{{"totalDurationMillis", -1}}}},
+		{{"$group", bson.D{
+			{"_id", bson.D{{"host", "$_id.host"}, {"start", "$_id.start"}}},
+			{"count", bson.D{{"$sum", "$count"}}},
+			{"totalDurationMillis", bson.D{{"$sum", "$totalDurationMillis"}}},
+			{"shapes", bson.D{{"$push", bson.D{
+				{"hash", "$_id.hash"},
+				{"ns", "$_id.ns"},
+				{"count", "$count"},
+				{"totalDurationMillis", "$totalDurationMillis"},
+			}}}},
+		}}},
+		{{"$project", bson.D{
+			{"_id", 0},
+			{"host", "$_id.host"},
+			{"start", "$_id.start"},
+			{"count", 1},
+			{"totalDurationMillis", 1},
+			{"shapes", bson.D{{"$slice", bson.A{"$shapes", shapesPerBucket}}}},
+		}}},
+		{{"$sort", bson.D{{"host", 1}, {"start", 1}}}},
+	}
+	res, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+
+	var docs []SlowQueryBucket
+	err = res.All(ctx, &docs)
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+	return docs, nil
+}
+
+// CorrelateSlowQueries aligns the slow query buckets with the metric series of the same host
+// and ranks the windows where slow queries and metric spikes coincide.
+func CorrelateSlowQueries(buckets []SlowQueryBucket, series []MetricSeries, granularity time.Duration) []CorrelatedWindow {
+	type aligned struct {
+		label     string
+		threshold float64
+		median    float64
+		values    map[time.Time]float64
+	}
+	alignedByHost := make(map[string]map[string]aligned)
+	for _, s := range series {
+		for _, m := range correlatedMetrics {
+			if s.Name != m.Name || len(s.Points) == 0 {
+				continue
+			}
+			values := s.Values()
+			a := aligned{
+				label:     m.Label,
+				threshold: Percentile(values, spikePercentile),
+				median:    Percentile(values, 0.5),
+				values:    make(map[time.Time]float64),
+			}
+			for _, p := range s.Points {
+				start := p.Timestamp.UTC().Truncate(granularity)
+				if p.Value > a.values[start] {
+					a.values[start] = p.Value
+				}
+			}
+			if alignedByHost[s.Host] == nil {
+				alignedByHost[s.Host] = make(map[string]aligned)
+			}
+			alignedByHost[s.Host][s.Name] = a
+		}
+	}
+
+	slowByHost := make(map[string][]float64)
+	maxSlowByHost := make(map[string]float64)
+	for _, b := range buckets {
+		slowByHost[b.Host] = append(slowByHost[b.Host], b.TotalDurationMillis)
+		if b.TotalDurationMillis > maxSlowByHost[b.Host] {
+			maxSlowByHost[b.Host] = b.TotalDurationMillis
+		}
+	}
+	slowThresholdByHost := make(map[string]float64)
+	slowMedianByHost := make(map[string]float64)
+	for host, values := range slowByHost {
+		sort.Float64s(values)
+		slowThresholdByHost[host] = Percentile(values, spikePercentile)
+		slowMedianByHost[host] = Percentile(values, 0.5)
+	}
+
+	var windows []CorrelatedWindow
+	for _, b := range buckets {
+		start := b.Start.UTC().Truncate(granularity)
+		w := CorrelatedWindow{
+			Host:            b.Host,
+			Start:           start,
+			End:             start.Add(granularity),
+			SlowQueryCount:  b.Count,
+			SlowQueryMillis: b.TotalDurationMillis,
+			SlowQuerySpike:  b.TotalDurationMillis >= slowThresholdByHost[b.Host] && b.TotalDurationMillis > slowMedianByHost[b.Host],
+			TopShapes:       b.Shapes,
+		}
+		for _, m := range correlatedMetrics {
+			a, ok := alignedByHost[b.Host][m.Name]
+			if !ok {
+				continue
+			}
+			if v, ok := a.values[start]; ok && v >= a.threshold && v > a.median {
+				w.Spikes = append(w.Spikes, MetricSpike{Metric: m.Name, Label: a.label, Value: v, Threshold: a.threshold})
+			}
+		}
+		if len(w.Spikes) == 0 || b.TotalDurationMillis == 0 {
+			continue
+		}
+		w.Score = float64(len(w.Spikes)) + b.TotalDurationMillis/maxSlowByHost[b.Host]
+		if w.SlowQuerySpike {
+			w.Score++
+		}
+		w.Statement = correlationStatement(w, promptLocale)
+		windows = append(windows, w)
+	}
+	sort.SliceStable(windows, func(i, j int) bool {
+		return windows[i].Score > windows[j].Score
+	})
+	if len(windows) > maxCorrelatedWindows {
+		windows = windows[:maxCorrelatedWindows]
+	}
+	return windows
+}
+
+// peakSpike returns the window's most pronounced metric spike, relative to its threshold.
+func peakSpike(w CorrelatedWindow) MetricSpike {
+	peak := w.Spikes[0]
+	for _, s := range w.Spikes {
+		if s.Value/s.Threshold > peak.Value/peak.Threshold {
+			peak = s
+		}
+	}
+	return peak
+}
+
+// correlationStatement describes a window in terms of the shape that accounted for most of
+// its slow time and its most pronounced metric peak, with its numbers formatted for locale.
+func correlationStatement(w CorrelatedWindow, locale *ReportLocale) string {
+	peak := peakSpike(w)
+	when := locale.DateTime(w.Start) + " UTC"
+	if len(w.TopShapes) == 0 || w.SlowQueryMillis == 0 {
+		return locale.Sprintf("%d slow queries took %s ms during the %s %s peak on host %s", w.SlowQueryCount, locale.Number(w.SlowQueryMillis, 0), when, peak.Label, w.Host)
+	}
+	top := w.TopShapes[0]
+	hash := top.Hash
+	if hash == "" {
+		hash = "without a query hash"
+	}
+	return fmt.Sprintf(
+		"shape %s on %s accounted for %s of slow time (%s of %s ms) during the %s %s peak on host %s",
+		hash, top.Namespace, locale.Percent(top.TotalDurationMillis/w.SlowQueryMillis),
+		locale.Number(top.TotalDurationMillis, 0), locale.Number(w.SlowQueryMillis, 0), when, peak.Label, w.Host,
+	)
+}
+
+// RenderCorrelationSection renders the correlated windows as a Markdown section.
+func RenderCorrelationSection(windows []CorrelatedWindow) string {
+	var sb strings.Builder
+	sb.WriteString("## Slow queries during metric spikes\n\n")
+	if len(windows) == 0 {
+		sb.WriteString("No window was found where slow queries coincided with a metric spike.\n")
+		return sb.String()
+	}
+	sb.WriteString("| Host | Window | Slow queries | Slow time (ms) | Spiking metrics | Top shape |\n")
+	sb.WriteString("|---|---|---|---|---|---|\n")
+	locale := GetReportLocale()
+	for _, w := range windows {
+		var spikes []string
+		for _, s := range w.Spikes {
+			spikes = append(spikes, fmt.Sprintf("%s %s (p90 %s)", s.Label, locale.Number(s.Value, 1), locale.Number(s.Threshold, 1)))
+		}
+		top := ""
+		if len(w.TopShapes) > 0 {
+			top = fmt.Sprintf("%s (%s)", w.TopShapes[0].Hash, locale.Percent(w.TopShapes[0].TotalDurationMillis/w.SlowQueryMillis))
+		}
+		sb.WriteString(fmt.Sprintf(
+			"| %s | %s – %s | %s | %s | %s | %s |\n",
+			w.Host, locale.DateTime(w.Start), locale.Time(w.End),
+			locale.Sprintf("%d", w.SlowQueryCount), locale.Number(w.SlowQueryMillis, 0), strings.Join(spikes, ", "), top,
+		))
+	}
+	sb.WriteString("\n")
+	for _, w := range windows {
+		sb.WriteString("- " + correlationStatement(w, locale) + ".\n")
+	}
+	return sb.String()
+}
+
+// CorrelationData is the data of the correlated windows context of the metrics prompt.
+type CorrelationData struct {
+	// Windows are the correlated windows, ranked by how strongly they coincide.
+	Windows []CorrelationPromptWindow
+}
+
+// CorrelationPromptWindow is a correlated window along with its most pronounced metric spike
+// and the shape that accounted for most of its slow time.
+type CorrelationPromptWindow struct {
+	CorrelatedWindow
+	Peak MetricSpike
+	// Top is the shape that accounted for most of the slow time, nil when the window has none.
+	Top *ShapeShare
+	// TopShare is Top's percentage of the window's slow time.
+	TopShare float64
+}
+
+// GetCorrelationContext renders the correlated windows as prompt context.
+func GetCorrelationContext(windows []CorrelatedWindow) (string, error) {
+	if len(windows) == 0 {
+		return "", nil
+	}
+	var data CorrelationData
+	for _, w := range windows {
+		pw := CorrelationPromptWindow{CorrelatedWindow: w, Peak: peakSpike(w)}
+		if len(w.TopShapes) > 0 && w.SlowQueryMillis > 0 {
+			pw.Top = &w.TopShapes[0]
+			pw.TopShare = w.TopShapes[0].TotalDurationMillis / w.SlowQueryMillis * 100
+		}
+		data.Windows = append(data.Windows, pw)
+	}
+	return renderPrompt(correlationTemplate, data)
+}
+
+// CorrelateWithMetrics buckets the slow queries by the metrics granularity, correlates them
+// with the hosts' metric series and, when persist is set, stores the ranked windows in the run
+// database.
+func CorrelateWithMetrics(ctx context.Context, dbName string, series []MetricSeries, metricsGranularity string, persist bool) ([]CorrelatedWindow, error) {
+	granularity, err := parseISODuration(metricsGranularity)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := GetSlowQueryBuckets(ctx, dbName, granularity)
+	if err != nil {
+		return nil, err
+	}
+	windows := CorrelateSlowQueries(buckets, DeriveSeries(series), granularity)
+	Logger.WithFields(logrus.Fields{"buckets": len(buckets), "windows": len(windows)}).Info("Correlated slow queries with metrics")
+	if len(windows) == 0 || !persist {
+		return windows, nil
+	}
+	var docs []interface{}
+	for _, w := range windows {
+		docs = append(docs, w)
+	}
+	if _, err := InsertCorrelatedWindows(ctx, docs, dbName); err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.mongodb.org/atlas-sdk/v20250312005/admin"
+)
+
+// ErrQueryHashNotFound is returned when no slow query log matches a query shape.
+var ErrQueryHashNotFound = errors.New("query hash not found")
+
+// ErrMissingNamespace is returned when a query shape is looked up without its namespace.
+var ErrMissingNamespace = errors.New("query shape has no namespace")
+
+// ErrShardNotLogged is recorded for a shard none of whose members' logs was ingested, whose
+// slow query load is unknown.
+var ErrShardNotLogged = errors.New("no log of the shard's members was ingested")
+
+// ErrOutputStoreTooOld is returned when the output store's server version can't run the
+// analysis pipelines.
+var ErrOutputStoreTooOld = errors.New("the output store's MongoDB version is too old")
+
+// AtlasAPIError is a failed call to the Atlas Administration API.
+type AtlasAPIError struct {
+	Operation  string
+	StatusCode int
+	ErrorCode  string
+	Detail     string
+	Err        error
+}
+
+func (e *AtlasAPIError) Error() string {
+	msg := fmt.Sprintf("atlas %s failed", e.Operation)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" with status %d", e.StatusCode)
+	}
+	if e.ErrorCode != "" {
+		msg += " (" + e.ErrorCode + ")"
+	}
+	if e.Detail != "" {
+		return msg + ": " + e.Detail
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+func (e *AtlasAPIError) Unwrap() error {
+	return e.Err
+}
+
+// newAtlasAPIError wraps the error of an Atlas API call with its status code and the error
+// code and detail Atlas returned.
+func newAtlasAPIError(operation string, response *http.Response, err error) *AtlasAPIError {
+	apiErr := &AtlasAPIError{Operation: operation, Err: err}
+	if response != nil {
+		apiErr.StatusCode = response.StatusCode
+	}
+	if model, ok := admin.AsError(err); ok {
+		apiErr.ErrorCode = model.GetErrorCode()
+		apiErr.Detail = model.GetDetail()
+		if apiErr.StatusCode == 0 {
+			apiErr.StatusCode = model.GetError()
+		}
+	}
+	return apiErr
+}
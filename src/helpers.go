@@ -1,25 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 func parseISODuration(durationStr string) (time.Duration, error) {
 	// A simple regex to extract components for common ISO8601 durations
-	re := regexp.MustCompile(`P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?`)
+	re := regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
 	matches := re.FindStringSubmatch(durationStr)
 
-	if len(matches) == 0 {
+	if len(matches) == 0 || durationStr == "P" {
 		return 0, fmt.Errorf("invalid ISO8601 duration format: %s", durationStr)
 	}
 
 	var d time.Duration
 
-	// Note: This example only handles H, M, S for simplicity.
-	// For Y, Mon, D, you'd need to consider calendar arithmetic.
+	// Note: This only handles D, H, M, S, with days taken as 24 hours.
+	// For Y and Mon, you'd need to consider calendar arithmetic.
+	if matches[3] != "" { // Days
+		days, _ := strconv.Atoi(matches[3])
+		d += time.Duration(days) * 24 * time.Hour
+	}
 	if matches[4] != "" { // Hours
 		hours, _ := strconv.Atoi(matches[4])
 		d += time.Duration(hours) * time.Hour
@@ -36,14 +46,160 @@ func parseISODuration(durationStr string) (time.Duration, error) {
 	return d, nil
 }
 
-func ConvertISO8601DurationToUnixTimestamp(d string) (int64, int64) {
+func ConvertISO8601DurationToUnixTimestamp(d string) (int64, int64, error) {
 	duration, err := parseISODuration(d)
 	if err != nil {
-		panic(err)
+		return 0, 0, err
 	}
 	now := time.Now()
 	nowUnix := now.Unix()
 	startTime := now.Add(-duration)
 	startTimeUnix := startTime.Unix()
-	return startTimeUnix, nowUnix
+	return startTimeUnix, nowUnix, nil
+}
+
+// docElems returns the elements of a decoded BSON/JSON document regardless of
+// whether it was decoded as a bson.D, a bson.M or a plain map.
+func docElems(v interface{}) ([]bson.E, bool) {
+	switch d := v.(type) {
+	case bson.D:
+		return d, true
+	case bson.M:
+		return mapElems(d), true
+	case map[string]interface{}:
+		return mapElems(d), true
+	}
+	return nil, false
+}
+
+// mapElems returns the entries of a map sorted by key, so that walking it is deterministic.
+func mapElems(m map[string]interface{}) []bson.E {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	elems := make([]bson.E, 0, len(m))
+	for _, k := range keys {
+		elems = append(elems, bson.E{Key: k, Value: m[k]})
+	}
+	return elems
+}
+
+// docValue looks up a (possibly dotted) path in a decoded document.
+func docValue(v interface{}, path string) (interface{}, bool) {
+	cur := v
+	for _, key := range strings.Split(path, ".") {
+		elems, ok := docElems(cur)
+		if !ok {
+			return nil, false
+		}
+		found := false
+		for _, e := range elems {
+			if e.Key == key {
+				cur = e.Value
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// arrayElems returns the items of a decoded BSON/JSON array.
+func arrayElems(v interface{}) ([]interface{}, bool) {
+	switch a := v.(type) {
+	case bson.A:
+		return a, true
+	case []interface{}:
+		return a, true
+	}
+	return nil, false
+}
+
+// toFloat64 converts any numeric value found in a decoded document to a float64.
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// marshalJSON encodes v as JSON without escaping <, > and &, which keeps the placeholders of
+// redacted literals, such as <string>, readable. Ordered documents keep the order of their keys.
+// A non-empty indent indents the output.
+func marshalJSON(v interface{}, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(orderedJSON(v)); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// orderedJSON converts the bson.D documents of a decoded value to jsonDoc, as encoding/json
+// would encode them as arrays of key-value pairs. Sort specs, index keys and hints depend on
+// the order of their keys.
+func orderedJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case bson.D:
+		return jsonDoc(t)
+	case bson.M:
+		return orderedJSON(map[string]interface{}(t))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			m[k] = orderedJSON(item)
+		}
+		return m
+	case bson.A:
+		return orderedJSON([]interface{}(t))
+	case []interface{}:
+		arr := make([]interface{}, len(t))
+		for i, item := range t {
+			arr[i] = orderedJSON(item)
+		}
+		return arr
+	}
+	return v
+}
+
+// jsonDoc is a document encoded as a JSON object with its keys in order.
+type jsonDoc bson.D
+
+func (d jsonDoc) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range d {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := marshalJSON(e.Key, "")
+		if err != nil {
+			return nil, err
+		}
+		value, err := marshalJSON(e.Value, "")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,718 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Modes of the index suggestion check.
+const (
+	// Flag the invalid suggestions inline.
+	indexCheckFlag = "flag"
+	// Send the invalid suggestions back to the model for correction, then flag those left.
+	indexCheckReprompt = "reprompt"
+	// Don't check the suggestions.
+	indexCheckOff = "off"
+)
+
+const defaultIndexCheckMaxReprompts = 1
+
+type IndexValidationConfig struct {
+	Mode         string `json:"mode"`
+	MaxReprompts int    `json:"maxReprompts"`
+}
+
+func (ic IndexValidationConfig) withDefaults() IndexValidationConfig {
+	if ic.Mode == "" {
+		ic.Mode = indexCheckFlag
+	}
+	if ic.MaxReprompts <= 0 {
+		ic.MaxReprompts = defaultIndexCheckMaxReprompts
+	}
+	return ic
+}
+
+func (ic IndexValidationConfig) Validate() error {
+	switch ic.withDefaults().Mode {
+	case indexCheckFlag, indexCheckReprompt, indexCheckOff:
+		return nil
+	}
+	return fmt.Errorf("unknown index validation mode %q, expected %s, %s or %s", ic.Mode, indexCheckFlag, indexCheckReprompt, indexCheckOff)
+}
+
+// indexKeyTypes are the string values an index key can have, besides 1 and -1.
+var indexKeyTypes = map[string]bool{"text": true, "2dsphere": true, "2d": true, "hashed": true}
+
+var (
+	// createIndexPattern matches the shell helpers, e.g. db.orders.createIndex( or
+	// db.getSiblingDB("shop").getCollection("orders").createIndexes(.
+	createIndexPattern = regexp.MustCompile(`\bdb(?:\.getSiblingDB\(\s*["']([^"']*)["']\s*\))?\.(?:getCollection\(\s*["']([^"']+)["']\s*\)|([A-Za-z_$][\w$]*))\.(createIndex|createIndexes)\(\s*`)
+	// createIndexesCommandPattern matches the createIndexes database command, e.g.
+	// { "createIndexes": "orders", "indexes": [ { "key": { ... } } ] }.
+	createIndexesCommandPattern = regexp.MustCompile(`["']?createIndexes["']?\s*:\s*["']([^"']+)["']`)
+	indexKeyFieldPattern        = regexp.MustCompile(`["']?\bkey["']?\s*:\s*\{`)
+	// shapeHeadingPattern matches the headings of the shape sections, e.g. "Slow query shape no. 3".
+	shapeHeadingPattern = regexp.MustCompile(`(?i)\bshape\s*(?:no\.?|number|#)?\s*(\d+)`)
+	writeHeadingPattern = regexp.MustCompile(`(?i)\bwrites?\b`)
+)
+
+// ShapeFields are the fields an analyzed shape filters, sorts and projects on, which are the
+// only fields an index suggested for it should have.
+type ShapeFields struct {
+	Number    int
+	Write     bool
+	Namespace string
+	Fields    []string
+}
+
+func (s ShapeFields) Label() string {
+	if s.Write {
+		return fmt.Sprintf("slow write shape no. %d", s.Number)
+	}
+	return fmt.Sprintf("slow query shape no. %d", s.Number)
+}
+
+// Collection returns the collection of the shape's namespace.
+func (s ShapeFields) Collection() string {
+	if _, coll, ok := strings.Cut(s.Namespace, "."); ok {
+		return coll
+	}
+	return s.Namespace
+}
+
+// Database returns the database of the shape's namespace.
+func (s ShapeFields) Database() string {
+	db, _, _ := strings.Cut(s.Namespace, ".")
+	return db
+}
+
+// NewShapeFields collects the fields of the slowest operation of a shape.
+func NewShapeFields(number int, write bool, shape RankedShape, sq SlowQueryEntry) ShapeFields {
+	fields := make(map[string]bool)
+	cmd := queryCommand(sq.Attr)
+	for _, filter := range commandFilters(cmd) {
+		filterFields(filter, "", fields)
+	}
+	for _, key := range []string{"sort", "projection", "fields"} {
+		if doc, ok := docValue(cmd, key); ok {
+			addKeys(doc, fields)
+		}
+	}
+	if key, ok := docValue(cmd, "key"); ok {
+		if field, ok := key.(string); ok {
+			fields[field] = true
+		}
+	}
+	for _, stage := range pipelineStages(cmd) {
+		if stage.Key == "$sort" || stage.Key == "$project" {
+			addKeys(stage.Value, fields)
+		}
+	}
+	return ShapeFields{Number: number, Write: write, Namespace: shape.ID.Namespace, Fields: sortedKeys(fields)}
+}
+
+// filterFields collects the field paths a query filter has conditions on.
+func filterFields(filter interface{}, prefix string, fields map[string]bool) {
+	elems, ok := docElems(filter)
+	if !ok {
+		return
+	}
+	for _, e := range elems {
+		switch {
+		case e.Key == "$and" || e.Key == "$or" || e.Key == "$nor":
+			items, _ := arrayElems(e.Value)
+			for _, item := range items {
+				filterFields(item, prefix, fields)
+			}
+		case e.Key == "$elemMatch" || e.Key == "$not":
+			filterFields(e.Value, prefix, fields)
+		case strings.HasPrefix(e.Key, "$"):
+		default:
+			path := e.Key
+			if prefix != "" {
+				path = prefix + "." + e.Key
+			}
+			fields[path] = true
+			filterFields(e.Value, path, fields)
+		}
+	}
+}
+
+func addKeys(doc interface{}, fields map[string]bool) {
+	elems, _ := docElems(doc)
+	for _, e := range elems {
+		if !strings.HasPrefix(e.Key, "$") {
+			fields[e.Key] = true
+		}
+	}
+}
+
+type IndexKey struct {
+	Field string
+	Type  string
+}
+
+// IndexSuggestion is an index key pattern suggested in a report, along with what's wrong
+// with it.
+type IndexSuggestion struct {
+	// Text is the index key pattern as written in the report.
+	Text string
+	// Database is the database named with getSiblingDB, empty when the suggestion doesn't name one.
+	Database   string
+	Collection string
+	Keys       []IndexKey
+	// Section is the shape the suggestion's report section is about, empty when unknown.
+	Section string
+	// End is the offset in the report right after the suggestion.
+	End      int
+	Problems []string
+}
+
+func (s IndexSuggestion) Valid() bool {
+	return len(s.Problems) == 0
+}
+
+// Target names the collection of the suggestion, with its database when it names one.
+func (s IndexSuggestion) Target() string {
+	if s.Database != "" {
+		return s.Database + "." + s.Collection
+	}
+	return s.Collection
+}
+
+// on tells whether the suggestion is on the collection of a shape, and on its database when
+// the suggestion names one.
+func (s IndexSuggestion) on(shape ShapeFields) bool {
+	return shape.Collection() == s.Collection && (s.Database == "" || shape.Database() == s.Database)
+}
+
+// IndexCheckResult is the outcome of the index suggestion check of a report.
+type IndexCheckResult struct {
+	Suggestions []IndexSuggestion
+	// Reprompts is the number of times the invalid suggestions were sent back to the model,
+	// and FirstDraft the suggestions of the report before that.
+	Reprompts  int
+	FirstDraft []IndexSuggestion
+}
+
+// countValid returns the number of valid suggestions.
+func countValid(suggestions []IndexSuggestion) int {
+	valid := 0
+	for _, s := range suggestions {
+		if s.Valid() {
+			valid++
+		}
+	}
+	return valid
+}
+
+// IndexCorrectionData is the data of the prompt sending the invalid index suggestions of a
+// report back to the model.
+type IndexCorrectionData struct {
+	// Language is the English name of the report language, empty for English.
+	Language string
+	Report   string
+	Shapes   []ShapeFields
+	Invalid  []IndexSuggestion
+}
+
+// ExtractIndexSuggestions finds the index key patterns of the createIndex and createIndexes
+// shell helpers and database commands of a report.
+func ExtractIndexSuggestions(report string) []IndexSuggestion {
+	var suggestions []IndexSuggestion
+	for _, m := range createIndexPattern.FindAllStringSubmatchIndex(report, -1) {
+		db := submatch(report, m, 1)
+		coll := submatch(report, m, 2)
+		if coll == "" {
+			coll = submatch(report, m, 3)
+		}
+		start := m[1]
+		if start >= len(report) {
+			continue
+		}
+		var docs [][2]int
+		switch {
+		case submatch(report, m, 4) == "createIndexes" && report[start] == '[':
+			end := balancedEnd(report, start)
+			if end < 0 {
+				continue
+			}
+			for i := start + 1; i < end-1; i++ {
+				if report[i] == '{' {
+					docEnd := balancedEnd(report, i)
+					if docEnd < 0 {
+						break
+					}
+					docs = append(docs, [2]int{i, docEnd})
+					i = docEnd - 1
+				}
+			}
+		case report[start] == '{':
+			if end := balancedEnd(report, start); end > 0 {
+				docs = append(docs, [2]int{start, end})
+			}
+		}
+		call := compactSpaces(report[m[0]:m[1]])
+		for _, doc := range docs {
+			text := call + report[doc[0]:doc[1]] + ")"
+			if report[start] == '[' {
+				text = call + "[" + report[doc[0]:doc[1]] + "])"
+			}
+			suggestion := newIndexSuggestion(report, text, doc[0], doc[1], coll)
+			suggestion.Database = db
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+	for _, m := range createIndexesCommandPattern.FindAllStringSubmatchIndex(report, -1) {
+		cmdStart := enclosingDocStart(report, m[0])
+		if cmdStart < 0 {
+			continue
+		}
+		cmdEnd := balancedEnd(report, cmdStart)
+		if cmdEnd < 0 {
+			continue
+		}
+		coll := submatch(report, m, 1)
+		for _, k := range indexKeyFieldPattern.FindAllStringIndex(report[cmdStart:cmdEnd], -1) {
+			docStart := cmdStart + k[1] - 1
+			if docEnd := balancedEnd(report, docStart); docEnd > 0 {
+				suggestions = append(suggestions, newIndexSuggestion(report, report[docStart:docEnd], docStart, docEnd, coll))
+			}
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].End < suggestions[j].End })
+	return suggestions
+}
+
+func newIndexSuggestion(report string, text string, docStart, docEnd int, coll string) IndexSuggestion {
+	keys, problems := parseIndexKeys(report[docStart:docEnd])
+	return IndexSuggestion{Text: compactSpaces(text), Collection: coll, Keys: keys, End: docEnd, Problems: problems}
+}
+
+func submatch(s string, m []int, group int) string {
+	if m[2*group] < 0 {
+		return ""
+	}
+	return s[m[2*group]:m[2*group+1]]
+}
+
+func compactSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// balancedEnd returns the offset right after the bracket closing the one at start, skipping
+// quoted strings, or -1 when it isn't closed.
+func balancedEnd(s string, start int) int {
+	depth := 0
+	var quote byte
+	for i := start; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// enclosingDocStart returns the offset of the brace opening the document around offset, or -1.
+func enclosingDocStart(s string, offset int) int {
+	depth := 0
+	for i := offset - 1; i >= 0; i-- {
+		switch s[i] {
+		case '}', ']':
+			depth++
+		case '{', '[':
+			if depth == 0 {
+				if s[i] == '{' {
+					return i
+				}
+				return -1
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits s on sep, outside of quotes and brackets.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	depth, last := 0, 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '{' || c == '[' || c == '(':
+			depth++
+		case c == '}' || c == ']' || c == ')':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[last:i])
+			last = i + 1
+		}
+	}
+	return append(parts, s[last:])
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseIndexKeys parses a relaxed JSON index key pattern, e.g. { status: 1, "created.at": -1 },
+// and returns what makes it an invalid key pattern.
+func parseIndexKeys(doc string) ([]IndexKey, []string) {
+	var keys []IndexKey
+	var problems []string
+	seen := make(map[string]bool)
+	hashed := 0
+	for _, pair := range splitTopLevel(doc[1:len(doc)-1], ',') {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := splitTopLevel(pair, ':')
+		if len(parts) != 2 {
+			problems = append(problems, fmt.Sprintf("%q isn't a field: value pair", strings.TrimSpace(pair)))
+			continue
+		}
+		field := unquote(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		if seen[field] {
+			problems = append(problems, fmt.Sprintf("%q is indexed twice", field))
+			continue
+		}
+		seen[field] = true
+		if strings.HasPrefix(field, "$") && field != "$**" {
+			problems = append(problems, fmt.Sprintf("%q isn't a field name", field))
+			continue
+		}
+		key := IndexKey{Field: field}
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			if n == 0 {
+				problems = append(problems, fmt.Sprintf("%q has a key value of 0, use 1 or -1", field))
+				continue
+			}
+			key.Type = "1"
+			if n < 0 {
+				key.Type = "-1"
+			}
+		} else {
+			key.Type = unquote(value)
+			if key.Type == value || !indexKeyTypes[key.Type] {
+				problems = append(problems, fmt.Sprintf("%q has an invalid key value %s", field, value))
+				continue
+			}
+			if key.Type == "hashed" {
+				hashed++
+			}
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 && len(problems) == 0 {
+		problems = append(problems, "the index has no keys")
+	}
+	if hashed > 1 {
+		problems = append(problems, "an index can only have one hashed field")
+	}
+	return keys, problems
+}
+
+// reportHeading is a Markdown heading of a report, outside code blocks.
+type reportHeading struct {
+	Offset int
+	Level  int
+	Text   string
+}
+
+func reportHeadings(report string) []reportHeading {
+	var headings []reportHeading
+	inCode := false
+	offset := 0
+	for _, line := range strings.SplitAfter(report, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			inCode = !inCode
+		case !inCode && strings.HasPrefix(trimmed, "#"):
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			headings = append(headings, reportHeading{Offset: offset, Level: level, Text: strings.TrimSpace(trimmed[level:])})
+		}
+		offset += len(line)
+	}
+	return headings
+}
+
+// sectionShape returns the shape whose section holds the given offset, if any: the last shape
+// heading before it, unless a heading of the same or a higher level closed its section.
+func sectionShape(headings []reportHeading, offset int, shapes []ShapeFields) *ShapeFields {
+	var current *reportHeading
+	for i := range headings {
+		h := &headings[i]
+		if h.Offset > offset {
+			break
+		}
+		if shapeHeadingPattern.MatchString(h.Text) {
+			current = h
+		} else if current != nil && h.Level <= current.Level {
+			current = nil
+		}
+	}
+	if current == nil {
+		return nil
+	}
+	number, _ := strconv.Atoi(shapeHeadingPattern.FindStringSubmatch(current.Text)[1])
+	write := writeHeadingPattern.MatchString(current.Text)
+	for i := range shapes {
+		if shapes[i].Number == number && shapes[i].Write == write {
+			return &shapes[i]
+		}
+	}
+	return nil
+}
+
+// ValidateIndexSuggestions checks that every index suggested in a report is a valid key
+// pattern, on the collection of an analyzed shape, and only indexes fields the shape filters,
+// sorts or projects on. Suggestions in a shape's section are checked against that shape, and
+// the others against every shape on their collection.
+func ValidateIndexSuggestions(report string, shapes []ShapeFields) []IndexSuggestion {
+	suggestions := ExtractIndexSuggestions(report)
+	headings := reportHeadings(report)
+	for i := range suggestions {
+		s := &suggestions[i]
+		var candidates []ShapeFields
+		if shape := sectionShape(headings, s.End, shapes); shape != nil {
+			s.Section = shape.Label()
+			if !s.on(*shape) {
+				s.Problems = append(s.Problems, fmt.Sprintf("%s runs on %s, not on collection %q", shape.Label(), shape.Namespace, s.Target()))
+				continue
+			}
+			candidates = []ShapeFields{*shape}
+		} else {
+			for _, shape := range shapes {
+				if s.on(shape) {
+					candidates = append(candidates, shape)
+				}
+			}
+			if len(candidates) == 0 {
+				s.Problems = append(s.Problems, fmt.Sprintf("no analyzed shape runs on collection %q", s.Target()))
+				continue
+			}
+		}
+		fields := make(map[string]bool)
+		for _, shape := range candidates {
+			for _, field := range shape.Fields {
+				fields[field] = true
+			}
+		}
+		subject := fmt.Sprintf("any analyzed shape on %q", s.Target())
+		if s.Section != "" {
+			subject = s.Section
+		}
+		for _, key := range s.Keys {
+			if key.Type == "text" || indexKeyCovered(key.Field, fields) {
+				continue
+			}
+			s.Problems = append(s.Problems, fmt.Sprintf("%q isn't filtered, sorted or projected on by %s", key.Field, subject))
+		}
+	}
+	return suggestions
+}
+
+// indexKeyCovered tells whether an index field is one of the fields, or a wildcard over some
+// of them.
+func indexKeyCovered(field string, fields map[string]bool) bool {
+	if field == "$**" {
+		return len(fields) > 0
+	}
+	if prefix, ok := strings.CutSuffix(field, ".$**"); ok {
+		for f := range fields {
+			if f == prefix || strings.HasPrefix(f, prefix+".") {
+				return true
+			}
+		}
+		return false
+	}
+	return fields[field]
+}
+
+// FlagIndexSuggestions adds a note under every invalid suggestion of a report: after the code
+// block holding it, or after its line.
+func FlagIndexSuggestions(report string, suggestions []IndexSuggestion) string {
+	notes := make(map[int][]string)
+	var offsets []int
+	for _, s := range suggestions {
+		if s.Valid() {
+			continue
+		}
+		at := noteOffset(report, s.End)
+		if _, ok := notes[at]; !ok {
+			offsets = append(offsets, at)
+		}
+		notes[at] = append(notes[at], fmt.Sprintf("> **Index check:** `%s`: %s.", s.Text, strings.Join(s.Problems, "; ")))
+	}
+	sort.Ints(offsets)
+	var sb strings.Builder
+	last := 0
+	for _, at := range offsets {
+		sb.WriteString(report[last:at])
+		if !strings.HasSuffix(report[:at], "\n") {
+			sb.WriteString("\n")
+		}
+		sb.WriteString("\n" + strings.Join(notes[at], "\n>\n") + "\n")
+		if !strings.HasPrefix(report[at:], "\n") {
+			sb.WriteString("\n")
+		}
+		last = at
+	}
+	sb.WriteString(report[last:])
+	return sb.String()
+}
+
+// noteOffset returns where to add a note about the text ending at offset: after the closing
+// fence of the code block it's in, or after its line.
+func noteOffset(report string, offset int) int {
+	inCode := false
+	lineStart := 0
+	for lineStart < len(report) {
+		lineEnd := strings.IndexByte(report[lineStart:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(report)
+		} else {
+			lineEnd += lineStart + 1
+		}
+		if strings.HasPrefix(strings.TrimSpace(report[lineStart:lineEnd]), "```") {
+			inCode = !inCode
+			if !inCode && lineStart >= offset {
+				return lineEnd
+			}
+		}
+		if !inCode && lineEnd >= offset {
+			return lineEnd
+		}
+		lineStart = lineEnd
+	}
+	return len(report)
+}
+
+// checkIndexSuggestions validates the index suggestions of an analysis. In reprompt mode, the
+// invalid ones are sent back to the model until they're fixed or maxReprompts is reached. The
+// suggestions left invalid are flagged inline.
+func (c *LLMClient) checkIndexSuggestions(ctx context.Context, modelName string, analysis string, shapes []ShapeFields, ic IndexValidationConfig, budget int) (string, IndexCheckResult) {
+	ic = ic.withDefaults()
+	var result IndexCheckResult
+	if ic.Mode == indexCheckOff || analysis == "" {
+		return analysis, result
+	}
+	result.Suggestions = ValidateIndexSuggestions(analysis, shapes)
+	result.FirstDraft = result.Suggestions
+	for ic.Mode == indexCheckReprompt && result.Reprompts < ic.MaxReprompts {
+		var invalid []IndexSuggestion
+		for _, s := range result.Suggestions {
+			if !s.Valid() {
+				invalid = append(invalid, s)
+			}
+		}
+		if len(invalid) == 0 {
+			break
+		}
+		prompt, err := renderPrompt(indexCorrectionTemplate, IndexCorrectionData{
+			Language: GetReportLocale().LanguageName(),
+			Report:   analysis,
+			Shapes:   shapes,
+			Invalid:  invalid,
+		})
+		if err != nil {
+			Logger.Warn("Failed to render the index correction prompt: ", err)
+			break
+		}
+		if EstimateTokens(prompt) > budget {
+			Logger.Warn("The index correction prompt doesn't fit the prompt token budget, flagging the invalid suggestions instead")
+			break
+		}
+		corrected, err := c.generateText(ctx, modelName, prompt)
+		if err != nil {
+			Logger.Warn("Failed to correct the index suggestions: ", err)
+			break
+		}
+		result.Reprompts++
+		analysis = corrected
+		result.Suggestions = ValidateIndexSuggestions(analysis, shapes)
+	}
+	Logger.WithFields(logrus.Fields{
+		"suggestions": len(result.Suggestions),
+		"valid":       countValid(result.Suggestions),
+		"reprompts":   result.Reprompts,
+	}).Info("Checked the index suggestions")
+	return FlagIndexSuggestions(analysis, result.Suggestions), result
+}
+
+// RenderIndexCheckSection scores the index suggestions of a report.
+func RenderIndexCheckSection(result IndexCheckResult) string {
+	if len(result.Suggestions) == 0 && len(result.FirstDraft) == 0 {
+		return ""
+	}
+	locale := GetReportLocale()
+	var sb strings.Builder
+	sb.WriteString("## Index suggestion check\n\n")
+	sb.WriteString("Every index suggested above was checked against the collection and the filter, sort and projection fields of the shapes it was suggested for.\n\n")
+	writeScore := func(label string, suggestions []IndexSuggestion) {
+		valid := countValid(suggestions)
+		score := "n/a"
+		if len(suggestions) > 0 {
+			score = locale.Percent(float64(valid) / float64(len(suggestions)))
+		}
+		fmt.Fprintf(&sb, "%s: %s of %s suggestions valid (%s).\n", label, locale.Sprintf("%d", valid), locale.Sprintf("%d", len(suggestions)), score)
+	}
+	if result.Reprompts > 0 {
+		writeScore("First draft", result.FirstDraft)
+		fmt.Fprintf(&sb, "The invalid suggestions were sent back to the model %s time(s).\n", locale.Sprintf("%d", result.Reprompts))
+	}
+	writeScore("Accuracy", result.Suggestions)
+	if len(result.Suggestions) == 0 {
+		return sb.String()
+	}
+	sb.WriteString("\n| Index | Collection | Section | Result |\n")
+	sb.WriteString("|---|---|---|---|\n")
+	for _, s := range result.Suggestions {
+		section := s.Section
+		if section == "" {
+			section = "-"
+		}
+		verdict := "valid"
+		if !s.Valid() {
+			verdict = strings.ReplaceAll(strings.Join(s.Problems, "; "), "|", "\\|")
+		}
+		fmt.Fprintf(&sb, "| `%s` | %s | %s | %s |\n", strings.ReplaceAll(s.Text, "|", "\\|"), s.Target(), section, verdict)
+	}
+	return sb.String()
+}
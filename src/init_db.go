@@ -1,31 +1,121 @@
 package main
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
 
-func InitDb(ctx context.Context, ac *AtlasClient, dbName string) error {
-	cfg, err := GetConfig()
-	start, end := ConvertISO8601DurationToUnixTimestamp(cfg.Period)
-	hostLogMapping, err := ac.DownloadClusterLogs(ctx, cfg.ProjectId, cfg.ClusterName, start, end)
-	if err != nil {
+	"github.com/sirupsen/logrus"
+)
+
+// analysisStages derive the analysis collections from the ingested logs, in order. The
+// collections a stage appends to are dropped before it runs, so that it can be rerun when a
+// run is resumed.
+var analysisStages = []struct {
+	Name    string
+	Failure string
+	Reset   []string
+	Run     func(ctx context.Context, dbName string) error
+}{
+	{stageSlowQueriesByDriver, "Error grouping slow queries by driver", nil, CreateSlowQueriesByDriver},
+	{stageHistograms, "Error building hourly slow query histograms", nil, CreateSlowQueryHistograms},
+	{stageTargeting, "Error computing query targeting by namespace", nil, CreateSlowQueryTargetingByNamespace},
+	{stageAntiPatterns, "Error scanning slow queries for anti-patterns", []string{"queryAntiPatterns"}, CreateQueryAntiPatterns},
+	{stageRouting, "Error grouping mongos slow queries by shape", nil, CreateMongosQueryShapes},
+	{stageSharding, "Error storing the shard distribution", nil, CollectShardDistribution},
+	{stageIndexes, "Error creating indexes", nil, CreateIndexes},
+}
+
+// InitDb downloads and ingests the cluster logs of a run and derives the analysis collections
+// from them, skipping the stages its manifest records as completed.
+func InitDb(ctx context.Context, ac *AtlasClient, m *RunManifest) error {
+	if err := CheckOutputStoreVersion(ctx); err != nil {
 		return err
 	}
-	fileReader := &DefaultFileReader{}
-	for host, logFile := range hostLogMapping {
-		err = ProcessLogStream(ctx, fileReader, logFile, host, dbName)
+	if !m.StageDone(stageDownload) {
+		hostLogMapping, err := ac.DownloadClusterLogs(ctx, m.ProjectID, m.ClusterName, m.WindowStart, m.WindowEnd)
 		if err != nil {
-			Logger.Error("Error creating indexes", err)
+			return err
+		}
+		if m.Shards, err = ac.GetShardCount(ctx, m.ProjectID, m.ClusterName); err != nil {
+			return err
+		}
+		if err := m.RecordDownloads(hostLogMapping); err != nil {
+			return err
+		}
+		if err := m.CompleteStage(ctx, stageDownload); err != nil {
 			return err
 		}
 	}
-	err = CreateSlowQueriesByDriver(ctx, dbName)
-	if err != nil {
-		Logger.Error("Error grouping slow queries by driver", err)
-		return err
+	if !m.StageDone(stageIngest) {
+		if err := ingestLogFiles(ctx, ac, m); err != nil {
+			Logger.Error("Error ingesting log files", err)
+			return err
+		}
+		if err := m.CompleteStage(ctx, stageIngest); err != nil {
+			return err
+		}
 	}
-	err = CreateIndexes(ctx, dbName)
-	if err != nil {
-		Logger.Error("Error creating indexes", err)
-		return err
+	for _, stage := range analysisStages {
+		if m.StageDone(stage.Name) {
+			continue
+		}
+		if err := DropCollections(ctx, m.RunID, stage.Reset...); err != nil {
+			return err
+		}
+		if err := stage.Run(ctx, m.RunID); err != nil {
+			Logger.Error(stage.Failure, err)
+			return err
+		}
+		if err := m.CompleteStage(ctx, stage.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ingestLogFiles ingests the log files that weren't ingested yet. A file whose ingestion was
+// interrupted has its documents removed first, and a file that's gone or changed since it was
+// downloaded is downloaded again.
+func ingestLogFiles(ctx context.Context, ac *AtlasClient, m *RunManifest) error {
+	fileReader := &DefaultFileReader{}
+	for i := range m.Files {
+		f := &m.Files[i]
+		if f.Status == fileIngested {
+			continue
+		}
+		if f.Status == fileIngesting {
+			if err := DeleteHostDocuments(ctx, m.RunID, f.Host, ingestedCollections...); err != nil {
+				return err
+			}
+		}
+		if !f.Verify() {
+			Logger.WithFields(logrus.Fields{"host": f.Host, "path": f.Path}).Warn("Log file missing or changed, downloading it again")
+			hostname, _, err := net.SplitHostPort(f.Host)
+			if err != nil {
+				hostname = f.Host
+			}
+			path, err := ac.GetClusterLogsForHost(ctx, m.ProjectID, hostname, f.Log(), &m.WindowStart, &m.WindowEnd)
+			if err != nil {
+				return fmt.Errorf("failed to download logs for host %s: %w", f.Host, err)
+			}
+			if err := m.RecordDownloads(map[string]HostLog{f.Host: {Path: path, LogName: f.Log()}}); err != nil {
+				return err
+			}
+		}
+		f.Status = fileIngesting
+		if err := m.Save(ctx); err != nil {
+			return err
+		}
+		if err := ProcessLogStream(ctx, fileReader, f.Path, f.Host, f.Log(), m.RunID); err != nil {
+			return err
+		}
+		f.Status = fileIngested
+		f.IngestedAt = time.Now()
+		if err := m.Save(ctx); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Modes of the LLM response cache.
+const (
+	// Serve cached responses, and cache new ones.
+	cacheReadWrite = "readWrite"
+	// Bypass the cached responses, and cache the new ones in their place.
+	cacheRefresh = "refresh"
+	// Neither read nor write the cache.
+	cacheOff = "off"
+	// Only serve cached responses, to replay past runs without calling the LLM.
+	cacheOffline = "offline"
+)
+
+const (
+	defaultLLMCacheDatabase = "llmCache"
+	defaultLLMCacheTTLHours = 24 * 7
+)
+
+// ErrCacheMiss is returned in offline mode when a prompt has no cached response.
+var ErrCacheMiss = errors.New("no cached LLM response")
+
+type LLMCacheConfig struct {
+	Mode     string `json:"mode"`
+	Database string `json:"database"`
+	TTLHours int    `json:"ttlHours"`
+}
+
+// CachedResponse is an LLM response, keyed by everything that went into the request.
+type CachedResponse struct {
+	Key        string    `bson:"_id" json:"key"`
+	Provider   string    `bson:"provider" json:"provider"`
+	Model      string    `bson:"model" json:"model"`
+	PromptHash string    `bson:"promptHash" json:"promptHash"`
+	FileHashes []string  `bson:"fileHashes" json:"fileHashes"`
+	Text       string    `bson:"text" json:"text"`
+	Created    time.Time `bson:"created" json:"created"`
+	ExpiresAt  time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// LLMCache is a content-addressed cache of LLM responses, stored in the output MongoDB
+// instance, where a TTL index expires them.
+type LLMCache struct {
+	Mode     string
+	Database string
+	TTL      time.Duration
+}
+
+func NewLLMCache(cc LLMCacheConfig) (*LLMCache, error) {
+	cache := &LLMCache{Mode: cc.Mode, Database: cc.Database, TTL: time.Duration(cc.TTLHours) * time.Hour}
+	if cache.Mode == "" {
+		cache.Mode = cacheReadWrite
+	}
+	if cache.Database == "" {
+		cache.Database = defaultLLMCacheDatabase
+	}
+	if cache.TTL <= 0 {
+		cache.TTL = defaultLLMCacheTTLHours * time.Hour
+	}
+	switch cache.Mode {
+	case cacheReadWrite, cacheRefresh, cacheOff, cacheOffline:
+		return cache, nil
+	}
+	return nil, fmt.Errorf("unknown LLM cache mode %q; use %s, %s, %s or %s", cache.Mode, cacheReadWrite, cacheRefresh, cacheOff, cacheOffline)
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheKey hashes the provider, the model, the prompt and the attached files' contents. The
+// files are sorted, as the order they're attached in doesn't change the request.
+func cacheKey(provider, model, prompt string, fileHashes []string) (string, string) {
+	promptHash := hashString(prompt)
+	sorted := append([]string{}, fileHashes...)
+	sort.Strings(sorted)
+	return hashString(strings.Join(append([]string{provider, model, promptHash}, sorted...), "\n")), promptHash
+}
+
+// Generate returns the cached response to a request, or calls generate and caches its
+// response, depending on the cache mode.
+func (c *LLMCache) Generate(ctx context.Context, provider, model, prompt string, files []string, generate func() (string, error)) (string, error) {
+	if c == nil || c.Mode == cacheOff {
+		return generate()
+	}
+	var fileHashes []string
+	for _, f := range files {
+		checksum, _, err := fileChecksum(f)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", f, err)
+		}
+		fileHashes = append(fileHashes, checksum)
+	}
+	key, promptHash := cacheKey(provider, model, prompt, fileHashes)
+	fields := logrus.Fields{"provider": provider, "model": model, "key": key}
+
+	if c.Mode == cacheReadWrite || c.Mode == cacheOffline {
+		cached, err := GetCachedResponse(ctx, c.Database, key)
+		if err != nil {
+			Logger.WithFields(fields).Warn("Failed to read the LLM cache: ", err)
+		} else if cached != nil {
+			Logger.WithFields(fields).Info("Serving LLM response from the cache")
+			GetRunSummary().RecordCacheHit(provider)
+			return cached.Text, nil
+		}
+		if c.Mode == cacheOffline {
+			return "", fmt.Errorf("%w for %s prompt %s", ErrCacheMiss, model, promptHash)
+		}
+	}
+
+	text, err := generate()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	entry := CachedResponse{
+		Key:        key,
+		Provider:   provider,
+		Model:      model,
+		PromptHash: promptHash,
+		FileHashes: fileHashes,
+		Text:       text,
+		Created:    now,
+		ExpiresAt:  now.Add(c.TTL),
+	}
+	if err := UpsertCachedResponse(ctx, c.Database, entry); err != nil {
+		// A response that can't be cached is still a response.
+		Logger.WithFields(fields).Warn("Failed to write the LLM cache: ", err)
+	}
+	return text, nil
+}
@@ -3,62 +3,99 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.mongodb.org/atlas-sdk/v20250312005/admin"
 	"google.golang.org/genai"
 )
 
 type LLMClient struct {
 	GeminiClient *genai.Client
+	Resilience   *Resilience
+	Cache        *LLMCache
 }
 
-func NewLLMClient(geminiClient *genai.Client) *LLMClient {
+const llmProvider = "gemini"
+
+func NewLLMClient(geminiClient *genai.Client) (*LLMClient, error) {
+	retry := defaultLLMRetry
+	var cacheConfig LLMCacheConfig
+	if cfg, err := GetConfig(); err == nil {
+		retry = cfg.LLMRetry.withDefaults(defaultLLMRetry)
+		cacheConfig = cfg.LLMCache
+	}
+	cache, err := NewLLMCache(cacheConfig)
+	if err != nil {
+		return nil, err
+	}
 	return &LLMClient{
 		GeminiClient: geminiClient,
-	}
+		Resilience:   NewResilience(llmProvider, retry),
+		Cache:        cache,
+	}, nil
+}
+
+// generateContent calls the model through the client's resilience layer.
+func (c *LLMClient) generateContent(ctx context.Context, modelName string, contents []*genai.Content, config *genai.GenerateContentConfig) (*genai.GenerateContentResponse, error) {
+	var response *genai.GenerateContentResponse
+	err := c.Resilience.Do(ctx, "generateContent", func(ctx context.Context) (*http.Response, error) {
+		var err error
+		response, err = c.GeminiClient.Models.GenerateContent(ctx, modelName, contents, config)
+		return nil, err
+	})
+	return response, err
 }
 
 const defaultModel = "gemini-2.5-pro"
 
-func (c *LLMClient) GetMetricInsights(ctx context.Context, files []string, prompt string, modelName string) (*genai.GenerateContentResponse, error) {
+func (c *LLMClient) GetMetricInsights(ctx context.Context, files []string, prompt string, modelName string) (string, error) {
 	if modelName == "" {
 		modelName = defaultModel
 	}
-	uris, err := c.uploadContextFiles(ctx, files)
-	if err != nil {
-		return nil, err
-	}
-	var parts []*genai.Part
-	for _, file := range uris {
-		parts = append(parts, genai.NewPartFromURI(file.URI, file.MIMEType))
-	}
+	return c.Cache.Generate(ctx, llmProvider, modelName, prompt, files, func() (string, error) {
+		uris, err := c.uploadContextFiles(ctx, files)
+		if err != nil {
+			return "", err
+		}
+		var parts []*genai.Part
+		for _, file := range uris {
+			parts = append(parts, genai.NewPartFromURI(file.URI, file.MIMEType))
+		}
 
-	parts = append(parts, genai.NewPartFromText("\n\n"))
-	parts = append(parts, genai.NewPartFromText(prompt))
-	contents := []*genai.Content{
-		genai.NewContentFromParts(parts, "user"),
-	}
-	response, err := c.GeminiClient.Models.GenerateContent(ctx, modelName, contents, nil)
-	if err != nil {
-		return nil, err
-	}
-	return response, nil
+		parts = append(parts, genai.NewPartFromText("\n\n"))
+		parts = append(parts, genai.NewPartFromText(prompt))
+		contents := []*genai.Content{
+			genai.NewContentFromParts(parts, "user"),
+		}
+		response, err := c.generateContent(ctx, modelName, contents, nil)
+		if err != nil {
+			return "", err
+		}
+		return response.Text(), nil
+	})
 }
 
 func (c *LLMClient) uploadContextFiles(ctx context.Context, files []string) ([]genai.File, error) {
 	var uris []genai.File
 
 	for _, f := range files {
-		file, err := c.GeminiClient.Files.UploadFromPath(
-			ctx,
-			f,
-			&genai.UploadFileConfig{
-				MIMEType: "text/plain",
-			},
-		)
+		var file *genai.File
+		err := c.Resilience.Do(ctx, "uploadFile", func(ctx context.Context) (*http.Response, error) {
+			var err error
+			file, err = c.GeminiClient.Files.UploadFromPath(
+				ctx,
+				f,
+				&genai.UploadFileConfig{
+					MIMEType: "text/plain",
+				},
+			)
+			return nil, err
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -68,163 +105,498 @@ func (c *LLMClient) uploadContextFiles(ctx context.Context, files []string) ([]g
 	return uris, nil
 }
 
-func (c *LLMClient) GenerateSlowQueryReport(ctx context.Context, dbName string) error {
-	cfg, _ := GetConfig()
-	modelName := cfg.GeminiModel
-	if modelName == "" {
-		modelName = defaultModel
+// GetQueryTargeting loads the per-namespace and worst per-shape query targeting ratios and
+// renders them as prompt context.
+func GetQueryTargeting(ctx context.Context, dbName string, topN int) (string, error) {
+	namespaces, err := ListSlowQueryTargetingByNamespace(ctx, dbName)
+	if err != nil {
+		return "", err
 	}
-	slowestQueryHashes, err := GetTopQueryShapesByExecutionTime(ctx, dbName, cfg.NumAnalyzedQueries)
+	worst, err := GetWorstTargetingShapes(ctx, dbName, topN)
 	if err != nil {
-		Logger.Error(err)
-		return err
+		return "", err
 	}
-	var slowestQueries []SlowQueryEntry
-	for _, qHash := range slowestQueryHashes {
-		//var id bson.M
-		id := qHash.ID
-		driver := id.Driver
-		queryHash := id.Hash
-		if queryHash == "" {
+	return GetQueryTargetingContext(namespaces, worst)
+}
+
+// getShapeExamples fetches the slowest logged operation of every shape. Read shapes without a
+// query hash can't be traced back to a log entry, so they're dropped; shapes whose example
+// can't be fetched are dropped and recorded as data gaps.
+func getShapeExamples(ctx context.Context, dbName string, shapes []RankedShape) ([]RankedShape, []SlowQueryEntry) {
+	var kept []RankedShape
+	var examples []SlowQueryEntry
+	for _, shape := range shapes {
+		if shape.ID.Hash == "" && !IsWriteOpType(shape.ID.OpType) {
 			continue
 		}
-		sq, err := GetSlowestQueryByShape(ctx, dbName, queryHash, driver)
+		sq, err := GetSlowestQueryByShape(ctx, dbName, shape.ID)
 		if err != nil {
-			Logger.Error(err)
-			return err
+			GetRunSummary().RecordGap(slowQueryReport, gapShape, shapeLabel(shape.ID), err)
+			continue
 		}
-		slowestQueries = append(slowestQueries, sq)
+		kept = append(kept, shape)
+		examples = append(examples, sq)
+	}
+	return kept, examples
+}
+
+func shapeLabel(id SlowQueryByID) string {
+	if id.Hash == "" {
+		return fmt.Sprintf("%s on %s", id.OpType, id.Namespace)
 	}
-	prompt, err := GetSlowQueriesPrompt(slowestQueries, slowestQueryHashes)
+	return fmt.Sprintf("%s on %s", id.Hash, id.Namespace)
+}
+
+func (c *LLMClient) generateText(ctx context.Context, modelName string, prompt string) (string, error) {
+	return c.Cache.Generate(ctx, llmProvider, modelName, prompt, nil, func() (string, error) {
+		var parts []*genai.Part
+		parts = append(parts, genai.NewPartFromText("\n\n"))
+		parts = append(parts, genai.NewPartFromText(prompt))
+		contents := []*genai.Content{
+			genai.NewContentFromParts(parts, "user"),
+		}
+		response, err := c.generateContent(ctx, modelName, contents, nil)
+		if err != nil {
+			return "", err
+		}
+		return response.Text(), nil
+	})
+}
+
+// generateChunkedReport runs every prompt of a split analysis with generate and merges the
+// partial reports into one, through the LLM when the merge prompt fits the budget.
+func (c *LLMClient) generateChunkedReport(ctx context.Context, modelName string, prompts []string, budget int, generate func(ctx context.Context, modelName string, prompt string) (string, error)) (string, error) {
+	var partials []string
+	for i, prompt := range prompts {
+		Logger.WithFields(logrus.Fields{"part": i + 1, "parts": len(prompts), "tokens": EstimateTokens(prompt)}).Info("Generating slow query analysis")
+		text, err := generate(ctx, modelName, prompt)
+		if err != nil {
+			return "", err
+		}
+		partials = append(partials, text)
+	}
+	if len(partials) == 1 {
+		return partials[0], nil
+	}
+	mergePrompt, err := GetMergeReportsPrompt(partials)
 	if err != nil {
-		Logger.Error(err)
+		return "", err
+	}
+	if EstimateTokens(mergePrompt) > budget {
+		Logger.WithFields(logrus.Fields{"tokens": EstimateTokens(mergePrompt), "budget": budget}).Warn("Partial reports exceed the token budget, concatenating them")
+		return concatenateReports(partials), nil
+	}
+	return c.generateText(ctx, modelName, mergePrompt)
+}
+
+// StoredReport is a generated report, stored in the run database for follow-up chats.
+type StoredReport struct {
+	Name    string    `bson:"_id" json:"name"`
+	Text    string    `bson:"text" json:"text"`
+	Created time.Time `bson:"created" json:"created"`
+}
+
+// saveReport writes a generated report to its output file, and stores it in the run database.
+// A report that can't be stored is still written.
+func saveReport(ctx context.Context, dbName string, name string, path string, report string) error {
+	if err := writeReport(path, report); err != nil {
 		return err
 	}
-	var parts []*genai.Part
-	parts = append(parts, genai.NewPartFromText("\n\n"))
-	parts = append(parts, genai.NewPartFromText(prompt))
-	contents := []*genai.Content{
-		genai.NewContentFromParts(parts, "user"),
+	if err := UpsertReport(ctx, dbName, StoredReport{Name: name, Text: report, Created: time.Now()}); err != nil {
+		Logger.WithFields(logrus.Fields{"report": name}).Warn("Failed to store the report in the run database: ", err)
+	}
+	return nil
+}
+
+// writeReport writes a generated report to its output file.
+func writeReport(path string, report string) error {
+	resFile, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create result file: %w", err)
+	}
+	defer resFile.Close()
+	if _, err := resFile.Write([]byte(report)); err != nil {
+		return fmt.Errorf("failed to write results: %w", err)
+	}
+	return nil
+}
+
+// slowQueryAnalysis is what the slow query report is generated from.
+type slowQueryAnalysis struct {
+	Prompts      []string
+	Budget       int
+	Shapes       []RankedShape
+	AntiPatterns []AntiPatternHit
+	// IndexFields are the fields of each analyzed shape, to check the index suggestions against.
+	IndexFields []ShapeFields
+	// RoutedShapes are the query shapes logged by mongos, on a cluster of Shards shards (0 when
+	// unknown).
+	RoutedShapes []RoutedShape
+	Shards       int
+	// Sharding is the shard distribution of the cluster, when it was read.
+	Sharding *shardingAnalysis
+}
+
+// collectSlowQueryAnalysis ranks the slow read and write shapes of the run and renders the
+// slow query prompts. Data that can't be fetched is reported as a data gap.
+func collectSlowQueryAnalysis(ctx context.Context, dbName string) (*slowQueryAnalysis, error) {
+	cfg, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	summary := GetRunSummary()
+	slowestQueryHashes, err := GetTopQueryShapesByExecutionTime(ctx, dbName, cfg.NumAnalyzedQueries, cfg.RankQueryShapesBy)
+	if err != nil {
+		summary.RecordGap(slowQueryReport, gapSection, "slow read shapes", err)
+	}
+	slowestQueryHashes, slowestQueries := getShapeExamples(ctx, dbName, slowestQueryHashes)
+	writeShapes, err := GetTopWriteShapes(ctx, dbName, cfg.NumAnalyzedQueries, cfg.RankQueryShapesBy)
+	if err != nil {
+		summary.RecordGap(slowQueryReport, gapSection, "slow write shapes", err)
+	}
+	writeShapes, slowestWrites := getShapeExamples(ctx, dbName, writeShapes)
+	antiPatterns, err := ListQueryAntiPatterns(ctx, dbName)
+	if err != nil {
+		summary.RecordGap(slowQueryReport, gapSection, "query anti-patterns", err)
+	}
+	targeting, err := GetQueryTargeting(ctx, dbName, cfg.NumAnalyzedQueries)
+	if err != nil {
+		summary.RecordGap(slowQueryReport, gapSection, "query targeting", err)
 	}
-	//_, err = c.GeminiClient.Models.GenerateContent(ctx, modelName, contents, nil)
-	response, err := c.GeminiClient.Models.GenerateContent(ctx, modelName, contents, nil)
+	routedShapes, err := ListMongosQueryShapes(ctx, dbName)
+	if err != nil {
+		summary.RecordGap(slowQueryReport, gapSection, "mongos query routing", err)
+	}
+	shards := 0
+	if len(routedShapes) > 0 {
+		if manifest, err := GetRunManifest(ctx, dbName); err == nil {
+			shards = manifest.Shards
+		}
+	}
+	var indexFields []ShapeFields
+	for i, sq := range slowestQueries {
+		indexFields = append(indexFields, NewShapeFields(i+1, false, slowestQueryHashes[i], sq))
+	}
+	for i, sq := range slowestWrites {
+		indexFields = append(indexFields, NewShapeFields(i+1, true, writeShapes[i], sq))
+	}
+	dist, err := GetShardDistribution(ctx, dbName)
+	if err != nil {
+		summary.RecordGap(slowQueryReport, gapSection, "shard distribution", err)
+	}
+	if dist != nil && dist.Error != "" {
+		summary.RecordGap(slowQueryReport, gapSection, "shard distribution", errors.New(dist.Error))
+		dist = nil
+	}
+	var sharding *shardingAnalysis
+	if dist != nil {
+		hosts, err := GetSlowQueryLoadByHost(ctx, dbName)
+		if err != nil {
+			summary.RecordGap(slowQueryReport, gapSection, "slow query load per shard", err)
+		}
+		var ingested []string
+		if manifest, err := GetRunManifest(ctx, dbName); err != nil {
+			summary.RecordGap(slowQueryReport, gapSection, "slow query load per shard", err)
+		} else {
+			ingested = manifest.IngestedHosts(logMongod)
+		}
+		sharding = analyzeSharding(dist, hosts, ingested, indexFields, append(slowestQueries, slowestWrites...), cfg.Sharding.withDefaults().ImbalanceRatio)
+		for _, s := range sharding.Data.Shards {
+			if !s.Logged {
+				summary.RecordGap(slowQueryReport, gapShard, s.Shard, ErrShardNotLogged)
+			}
+		}
+	}
+	routing, err := GetQueryRoutingContext(routedShapes, shards, dist, cfg.NumAnalyzedQueries)
+	if err != nil {
+		summary.RecordGap(slowQueryReport, gapSection, "mongos query routing", err)
+	}
+	shardingContext, err := GetShardingContext(sharding)
+	if err != nil {
+		summary.RecordGap(slowQueryReport, gapSection, "shard distribution", err)
+	}
+	budget := PromptTokenBudget(cfg)
+	prompts, err := BuildSlowQueryPrompts(slowestQueries, slowestQueryHashes, slowestWrites, writeShapes, GroupAntiPatternsByHash(antiPatterns), targeting, routing, shardingContext, budget)
 	if err != nil {
 		Logger.Error(err)
+		return nil, err
+	}
+	return &slowQueryAnalysis{
+		Prompts:      prompts,
+		Budget:       budget,
+		Shapes:       append(slowestQueryHashes, writeShapes...),
+		AntiPatterns: antiPatterns,
+		IndexFields:  indexFields,
+		RoutedShapes: routedShapes,
+		Shards:       shards,
+		Sharding:     sharding,
+	}, nil
+}
+
+// newAgent returns the agent investigating the run in agent mode, and nil otherwise. Offline
+// replays can't run the agent, as its answers aren't cached.
+func (c *LLMClient) newAgent(cfg *Config, ac *AtlasClient, dbName string) *Agent {
+	if !cfg.Agent.Enabled {
+		return nil
+	}
+	if c.Cache != nil && c.Cache.Mode == cacheOffline {
+		Logger.Warn("Agent mode isn't available offline, replaying the cached analysis instead")
+		return nil
+	}
+	return NewAgent(c, NewAgentTools(ac, dbName), cfg.Agent)
+}
+
+// GenerateSlowQueryReport analyzes the top slow query and write shapes. Data that can't be
+// fetched, and the LLM analysis itself, are reported as data gaps rather than failing the
+// report, which is only lost when it can't be written.
+func (c *LLMClient) GenerateSlowQueryReport(ctx context.Context, ac *AtlasClient, dbName string) error {
+	cfg, err := GetConfig()
+	if err != nil {
 		return err
 	}
-	resFile, err := os.Create(cfg.SlowQueriesReportOutputFile)
+	modelName := cfg.GeminiModel
+	if modelName == "" {
+		modelName = defaultModel
+	}
+	summary := GetRunSummary()
+	slowQueries, err := collectSlowQueryAnalysis(ctx, dbName)
 	if err != nil {
-		Logger.Fatalf("Failed to create result file: %v", err)
+		return err
 	}
-	defer resFile.Close()
-	if _, err := resFile.Write([]byte(response.Text())); err != nil {
-		//if _, err := resFile.Write([]byte(prompt)); err != nil {
-		Logger.Fatalf("Failed to write results: %v", err)
+	generate := c.generateText
+	agent := c.newAgent(cfg, ac, dbName)
+	if agent != nil {
+		generate = func(ctx context.Context, modelName string, prompt string) (string, error) {
+			return agent.Run(ctx, modelName, prompt, nil)
+		}
+	}
+	analysis, err := c.generateChunkedReport(ctx, modelName, slowQueries.Prompts, slowQueries.Budget, generate)
+	if err != nil {
+		summary.RecordGap(slowQueryReport, gapAnalysis, modelName, err)
+	}
+	analysis, indexCheck := c.checkIndexSuggestions(ctx, modelName, analysis, slowQueries.IndexFields, cfg.IndexValidation, slowQueries.Budget)
+	report := RenderRedactionHeader() + analysis + "\n\n" +
+		RenderShapeSelectionSection(slowQueries.Shapes) + "\n" +
+		RenderTimeBreakdownSection(slowQueries.Shapes) + "\n" +
+		RenderAntiPatternsSection(slowQueries.AntiPatterns) + "\n" +
+		RenderQueryRoutingSection(slowQueries.RoutedShapes, slowQueries.Shards, cfg.NumAnalyzedQueries) + "\n" +
+		RenderShardDistributionSection(slowQueries.Sharding) + "\n" +
+		RenderIndexCheckSection(indexCheck) + "\n" +
+		RenderDataGapsSection(summary.Gaps(slowQueryReport)) + "\n" +
+		RenderToolCallsSection(agent.ToolCalls())
+	if err := saveReport(ctx, dbName, slowQueryReport, cfg.SlowQueriesReportOutputFile, report); err != nil {
+		Logger.Error(err)
+		return err
 	}
-	Logger.WithFields(logrus.Fields{"outputFile": resFile.Name()}).Info("Slow query report written to the filesystem")
+	Logger.WithFields(logrus.Fields{"outputFile": cfg.SlowQueriesReportOutputFile}).Info("Slow query report written to the filesystem")
 	return nil
 }
 
-func (c *LLMClient) GenerateMetricsAnalysisReport(ctx context.Context, ac *AtlasClient, dbName string) error {
+// writeMeasurementsFile writes a raw Atlas measurements response to a temporary JSON file, to
+// be attached to the metrics prompt.
+func writeMeasurementsFile(pattern string, res *admin.ApiMeasurementsGeneralViewAtlas) (string, error) {
+	jsonData, err := json.Marshal(res)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal measurements to JSON: %w", err)
+	}
+	tmpFile, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer tmpFile.Close()
+	if _, err := tmpFile.Write(jsonData); err != nil {
+		return "", fmt.Errorf("failed to write JSON to temporary file: %w", err)
+	}
+	Logger.WithFields(logrus.Fields{"contextFilePath": tmpFile.Name()}).Info("Metrics JSON file written")
+	return tmpFile.Name(), nil
+}
+
+// missingMetrics returns the requested host metrics Atlas returned no series for.
+func missingMetrics(requested []string, series []MetricSeries) []string {
+	returned := make(map[string]bool)
+	for _, s := range series {
+		returned[s.Name] = true
+	}
+	var missing []string
+	for _, name := range requested {
+		if !returned[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// metricsAnalysis is what the metrics report is generated from.
+type metricsAnalysis struct {
+	Prompt   string
+	Files    []string
+	Findings []MetricFinding
+	Windows  []CorrelatedWindow
+}
+
+// collectMetricsAnalysis fetches the metrics of every host of the run, analyzes them and
+// renders the metrics prompt. The hosts, partitions and metrics that can't be fetched are
+// reported as data gaps. The findings and correlated windows are stored in the run database
+// when persist is set.
+func collectMetricsAnalysis(ctx context.Context, ac *AtlasClient, dbName string, persist bool) (*metricsAnalysis, error) {
 	cfg, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
 	hostnames, err := GetHostNames(ctx, dbName)
 	if err != nil {
-		panic(err)
+		Logger.Error(err)
+		return nil, fmt.Errorf("failed to list the hosts of the run: %w", err)
 	}
-	var metricFiles []string
+	manifest, err := GetRunManifest(ctx, dbName)
+	if err != nil {
+		Logger.Error(err)
+		return nil, fmt.Errorf("failed to load the window of the run: %w", err)
+	}
+	start, end := manifest.Window()
+	selection, err := ResolveMetricSelection(cfg.Metrics)
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+	summary := GetRunSummary()
+	analysis := &metricsAnalysis{}
+	var series []MetricSeries
+	data := MetricsPromptData{Language: GetReportLocale().LanguageName(), RawAttached: cfg.AttachRawMetrics}
 
-	var eventStrings []string
+	events, err := GetPrimaryElectionEvents(ctx, dbName)
+	if err != nil {
+		summary.RecordGap(metricsReport, gapSection, "primary elections", err)
+	}
 	// Iterate hostLogMapping keys and values, and use GetPrimaryElectionEvents
 	for _, host := range hostnames {
-		events, err := GetPrimaryElectionEvents(ctx, dbName)
-		if err != nil {
-			panic(err)
-		}
 		for _, eventTime := range events {
-			eventStrings = append(eventStrings, fmt.Sprintf("%s became primary on %s", host, eventTime))
+			data.Elections = append(data.Elections, fmt.Sprintf("%s became primary on %s", host, eventTime))
 		}
 
-		res, err := ac.GetMeasurementsForProcess(ctx, cfg.ProjectId, host, nil, nil, &cfg.Period, &cfg.MetricsGranularity)
+		res, err := ac.GetMeasurementsForProcess(ctx, cfg.ProjectId, host, selection.Host, &start, &end, nil, &cfg.MetricsGranularity)
 		if err != nil {
-			panic(err)
+			summary.RecordGap(metricsReport, gapHost, host, err)
+		} else {
+			hostSeries := MeasurementSeries(host, "", res)
+			for _, name := range missingMetrics(selection.Host, hostSeries) {
+				summary.RecordGap(metricsReport, gapMetric, fmt.Sprintf("%s on %s", name, host), fmt.Errorf("not returned by Atlas"))
+			}
+			series = append(series, hostSeries...)
+			if cfg.AttachRawMetrics {
+				metricFile, err := writeMeasurementsFile("measurements-*.json", res)
+				if err != nil {
+					summary.RecordGap(metricsReport, gapSection, "raw measurements of "+host, err)
+				} else {
+					analysis.Files = append(analysis.Files, metricFile)
+				}
+			}
 		}
+
 		partitions, err := ac.GetDisksOnHost(ctx, cfg.ProjectId, host)
 		if err != nil {
-			panic(err)
+			summary.RecordGap(metricsReport, gapPartition, "all partitions of "+host, err)
+			continue
 		}
-
 		for _, p := range *partitions {
 			partition := p.PartitionName
-			res, err := ac.GetDiskMetrics(ctx, &cfg.ProjectId, &host, partition, nil, nil, &cfg.Period, &cfg.MetricsGranularity)
+			res, err := ac.GetDiskMetrics(ctx, &cfg.ProjectId, &host, partition, selection.Disk, &start, &end, nil, &cfg.MetricsGranularity)
 			if err != nil {
-				Logger.Fatalf("Failed to get measurements: %v", err)
+				summary.RecordGap(metricsReport, gapPartition, fmt.Sprintf("%s on %s", *partition, host), err)
+				continue
 			}
-			jsonData, err := json.Marshal(res)
-			if err != nil {
-				Logger.Fatalf("Failed to marshal result to JSON: %v", err)
-			}
-			tmpFile, err := os.CreateTemp("", "disk-measurements-*.json")
-			if err != nil {
-				Logger.Fatalf("Failed to create temporary file: %v", err)
+			series = append(series, MeasurementSeries(host, *partition, res)...)
+			if cfg.AttachRawMetrics {
+				metricFile, err := writeMeasurementsFile("disk-measurements-*.json", res)
+				if err != nil {
+					summary.RecordGap(metricsReport, gapSection, fmt.Sprintf("raw measurements of %s on %s", *partition, host), err)
+				} else {
+					analysis.Files = append(analysis.Files, metricFile)
+				}
 			}
-			defer tmpFile.Close()
-			if _, err := tmpFile.Write(jsonData); err != nil {
-				Logger.Fatalf("Failed to write JSON to temporary file: %v", err)
-			}
-			Logger.WithFields(logrus.Fields{"contextFilePath": tmpFile.Name()}).Info("Disk metrics JSON file written")
-			metricFiles = append(metricFiles, tmpFile.Name())
 		}
+	}
 
-		if err != nil {
-			Logger.Fatalf("Failed to get measurements: %v", err)
-		}
-		jsonData, err := json.Marshal(res)
-		if err != nil {
-			Logger.Fatalf("Failed to marshal result to JSON: %v", err)
-		}
-		tmpFile, err := os.CreateTemp("", "measurements-*.json")
-		if err != nil {
-			Logger.Fatalf("Failed to create temporary file: %v", err)
-		}
-		defer tmpFile.Close()
-		// Write the JSON data to the temporary file.
-		if _, err := tmpFile.Write(jsonData); err != nil {
-			Logger.Fatalf("Failed to write JSON to temporary file: %v", err)
+	data.ClusterInfo, err = ac.GetAtlasClusterInfoString(ctx, cfg.ProjectId, cfg.ClusterName)
+	if err != nil {
+		summary.RecordGap(metricsReport, gapSection, "cluster tier and disk IOPS", err)
+	}
+	data.Targeting, err = GetQueryTargeting(ctx, dbName, cfg.NumAnalyzedQueries)
+	if err != nil {
+		summary.RecordGap(metricsReport, gapSection, "query targeting", err)
+	}
+	analysis.Windows, err = CorrelateWithMetrics(ctx, dbName, series, cfg.MetricsGranularity, persist)
+	if err != nil {
+		summary.RecordGap(metricsReport, gapSection, "slow query correlation", err)
+	}
+	data.Correlation, err = GetCorrelationContext(analysis.Windows)
+	if err != nil {
+		return nil, err
+	}
+	thresholds, err := NewThresholdResolver(ctx, ac, cfg, hostnames)
+	if err != nil {
+		summary.RecordGap(metricsReport, gapSection, "threshold overrides", err)
+		if thresholds.Profile.Metrics == nil {
+			thresholds.Profile = DefaultThresholdProfile
 		}
-		Logger.WithFields(logrus.Fields{"contextFilePath": tmpFile.Name()}).Info("Host metrics JSON file written")
-		metricFiles = append(metricFiles, tmpFile.Name())
 	}
-
-	prompt, _ := GetMetricsAnalysisPrompt()
-	diskInfo, err := ac.GetAtlasClusterInfoString(ctx, cfg.ProjectId, cfg.ClusterName)
+	series = DeriveSeries(series)
+	data.Summary = GetMetricSummaryContext(SummarizeSeries(series, thresholds))
+	analysis.Findings, err = AnalyzeMetrics(ctx, dbName, series, thresholds, persist)
 	if err != nil {
-		panic(err)
+		summary.RecordGap(metricsReport, gapSection, "metric findings", err)
 	}
-	finalPrompt := fmt.Sprintf(
-		"%s. Important additional context on when nodes became primary in the cluster: %s. %s. Take into account this information when analyzing the data.",
-		prompt,
-		strings.Join(eventStrings, ". "),
-		diskInfo,
-	)
-	insights, err := c.GetMetricInsights(
-		context.Background(),
-		metricFiles,
-		finalPrompt,
-		cfg.GeminiModel,
-	)
+	data.Thresholds = thresholds.GetThresholdDefinitions()
+	data.Findings, err = GetMetricFindingsContext(analysis.Findings)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if gaps := summary.Gaps(metricsReport); len(gaps) > 0 {
+		data.DataGaps = RenderDataGapsSection(gaps)
+	}
+	analysis.Prompt, err = GetMetricsAnalysisPrompt(data)
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
 	}
+	return analysis, nil
+}
 
-	resFile, err := os.Create(cfg.MetricsReportOutputFile)
+// GenerateMetricsAnalysisReport analyzes the metrics of every host of the run. The data that
+// can't be collected, and the LLM analysis itself, are reported as data gaps rather than
+// failing the report.
+func (c *LLMClient) GenerateMetricsAnalysisReport(ctx context.Context, ac *AtlasClient, dbName string) error {
+	cfg, err := GetConfig()
 	if err != nil {
-		Logger.Fatalf("Failed to create result file: %v", err)
+		return err
 	}
-	defer resFile.Close()
-	if _, err := resFile.Write([]byte(insights.Text())); err != nil {
-		Logger.Fatalf("Failed to write results: %v", err)
+	summary := GetRunSummary()
+	metrics, err := collectMetricsAnalysis(ctx, ac, dbName, true)
+	if err != nil {
+		return err
+	}
+	modelName := cfg.GeminiModel
+	if modelName == "" {
+		modelName = defaultModel
+	}
+	var analysis string
+	agent := c.newAgent(cfg, ac, dbName)
+	if agent != nil {
+		analysis, err = agent.Run(ctx, modelName, metrics.Prompt, metrics.Files)
+	} else {
+		analysis, err = c.GetMetricInsights(ctx, metrics.Files, metrics.Prompt, modelName)
+	}
+	if err != nil {
+		summary.RecordGap(metricsReport, gapAnalysis, modelName, err)
+	}
+
+	report := RenderRedactionHeader() + analysis + "\n\n" + RenderMetricFindingsSection(metrics.Findings) + "\n" + RenderCorrelationSection(metrics.Windows) + "\n" +
+		RenderDataGapsSection(summary.Gaps(metricsReport)) + "\n" + RenderToolCallsSection(agent.ToolCalls())
+	if err := saveReport(ctx, dbName, metricsReport, cfg.MetricsReportOutputFile, report); err != nil {
+		Logger.Error(err)
+		return err
 	}
 
-	Logger.WithFields(logrus.Fields{"outputFile": resFile.Name()}).Info("Results written to the filesystem")
+	Logger.WithFields(logrus.Fields{"outputFile": cfg.MetricsReportOutputFile}).Info("Results written to the filesystem")
 	return nil
 }
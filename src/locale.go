@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+	"golang.org/x/text/message"
+)
+
+// dateLayouts are the date and time layouts of the report languages, by base language. Other
+// languages use ISO 8601 dates.
+var dateLayouts = map[string]string{
+	"de": "02.01.2006 15:04",
+	"es": "02/01/2006 15:04",
+	"fr": "02/01/2006 15:04",
+	"it": "02/01/2006 15:04",
+	"ja": "2006/01/02 15:04",
+	"ko": "2006. 01. 02. 15:04",
+	"nl": "02-01-2006 15:04",
+	"pl": "02.01.2006 15:04",
+	"pt": "02/01/2006 15:04",
+	"ru": "02.01.2006 15:04",
+	"tr": "02.01.2006 15:04",
+	"zh": "2006/01/02 15:04",
+}
+
+const defaultDateLayout = "2006-01-02 15:04"
+
+// byteUnits are the byte size units of the report languages, by base language.
+var byteUnits = map[string][]string{
+	"fr": {"o", "Kio", "Mio", "Gio", "Tio"},
+}
+
+var defaultByteUnits = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+// ReportLocale formats the numbers, byte sizes and dates of the report sections rendered by
+// the tool, and names the report language in the prompts. Its printer is nil for the invariant
+// locale of the prompts.
+type ReportLocale struct {
+	Tag        language.Tag
+	printer    *message.Printer
+	dateLayout string
+	byteUnits  []string
+}
+
+// NewReportLocale returns the locale of a BCP 47 language tag such as "fr" or "pt-BR". The
+// empty tag is English.
+func NewReportLocale(tag string) (*ReportLocale, error) {
+	t := language.English
+	if tag != "" {
+		var err error
+		if t, err = language.Parse(tag); err != nil {
+			return nil, fmt.Errorf("invalid report language %q: %w", tag, err)
+		}
+	}
+	base, _ := t.Base()
+	locale := &ReportLocale{
+		Tag:        t,
+		printer:    message.NewPrinter(t),
+		dateLayout: defaultDateLayout,
+		byteUnits:  defaultByteUnits,
+	}
+	if layout, ok := dateLayouts[base.String()]; ok {
+		locale.dateLayout = layout
+	}
+	if units, ok := byteUnits[base.String()]; ok {
+		locale.byteUnits = units
+	}
+	return locale, nil
+}
+
+// promptLocale formats the numbers and dates of the prompts the same way whatever the report
+// language, without grouping separators, so that the model reads them unambiguously.
+var promptLocale = &ReportLocale{Tag: language.English, dateLayout: defaultDateLayout, byteUnits: defaultByteUnits}
+
+var (
+	reportLocale     *ReportLocale
+	reportLocaleOnce sync.Once
+)
+
+// GetReportLocale returns the locale of the configured report language, or English when it
+// isn't set or valid.
+func GetReportLocale() *ReportLocale {
+	reportLocaleOnce.Do(func() {
+		if cfg, err := GetConfig(); err == nil {
+			locale, err := NewReportLocale(cfg.ReportLanguage)
+			if err == nil {
+				reportLocale = locale
+				return
+			}
+			Logger.Warn(err)
+		}
+		reportLocale, _ = NewReportLocale("")
+	})
+	return reportLocale
+}
+
+// LanguageName is the English name of the report language, as written in the prompts. It's
+// empty for English, which the prompts default to.
+func (l *ReportLocale) LanguageName() string {
+	if base, _ := l.Tag.Base(); base.String() == "en" {
+		return ""
+	}
+	return display.English.Tags().Name(l.Tag)
+}
+
+// Sprintf formats numbers with the locale's decimal and grouping separators.
+func (l *ReportLocale) Sprintf(format string, args ...any) string {
+	if l.printer == nil {
+		return fmt.Sprintf(format, args...)
+	}
+	return l.printer.Sprintf(format, args...)
+}
+
+// Number formats a number with the given number of decimals.
+func (l *ReportLocale) Number(v float64, decimals int) string {
+	return l.Sprintf("%.*f", decimals, v)
+}
+
+// Significant formats a number rounded to the given number of significant digits, with its
+// sign when signed is set.
+func (l *ReportLocale) Significant(v float64, digits int, signed bool) string {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', digits, 64), 64)
+	if signed {
+		return l.Sprintf("%+g", rounded)
+	}
+	return l.Sprintf("%g", rounded)
+}
+
+// Percent formats a share between 0 and 1 as a rounded percentage.
+func (l *ReportLocale) Percent(share float64) string {
+	return l.Sprintf("%.0f%%", share*100)
+}
+
+// Bytes formats a byte size with binary units.
+func (l *ReportLocale) Bytes(v float64) string {
+	unit := 0
+	for math.Abs(v) >= 1024 && unit < len(l.byteUnits)-1 {
+		v /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return l.Sprintf("%.0f %s", v, l.byteUnits[unit])
+	}
+	return l.Sprintf("%.1f %s", v, l.byteUnits[unit])
+}
+
+// DateTime formats a timestamp in UTC.
+func (l *ReportLocale) DateTime(t time.Time) string {
+	return t.UTC().Format(l.dateLayout)
+}
+
+// Time formats the time of day of a timestamp in UTC, with its zone.
+func (l *ReportLocale) Time(t time.Time) string {
+	return t.UTC().Format("15:04 MST")
+}
@@ -33,6 +33,52 @@ type LogEntry struct {
 	Attr    map[string]interface{} `json:"attr"`
 	Host    string                 `json:"host"`
 	CtxHost string                 `json:"ctxHost"`
+	OpType  string                 `json:"opType" bson:"opType,omitempty"`
+	// ShapeKey identifies the query shape of a slow query logged by mongos, which doesn't
+	// log query hashes.
+	ShapeKey string `json:"shapeKey,omitempty" bson:"shapeKey,omitempty"`
+}
+
+const (
+	opRead          = "read"
+	opInsert        = "insert"
+	opUpdate        = "update"
+	opDelete        = "delete"
+	opFindAndModify = "findAndModify"
+)
+
+// writeOpTypes are the operation types analyzed as writes.
+var writeOpTypes = []string{opInsert, opUpdate, opDelete, opFindAndModify}
+
+// ClassifyOperation tells slow writes apart from reads. Slow writes logged by the WRITE
+// component carry an attr.type, while the ones logged by the COMMAND component are
+// identified by their command name. findAndModify is checked first, as its command also has an
+// update field.
+func ClassifyOperation(attr map[string]interface{}) string {
+	switch attr["type"] {
+	case "update":
+		return opUpdate
+	case "remove", "delete":
+		return opDelete
+	case "insert":
+		return opInsert
+	}
+	cmd := attr["command"]
+	for _, c := range []struct {
+		name   string
+		opType string
+	}{
+		{"findAndModify", opFindAndModify},
+		{"findandmodify", opFindAndModify},
+		{"insert", opInsert},
+		{"update", opUpdate},
+		{"delete", opDelete},
+	} {
+		if _, ok := docValue(cmd, c.name); ok {
+			return c.opType
+		}
+	}
+	return opRead
 }
 
 func (t *LogEntry) UnmarshalJSON(data []byte) error {
@@ -84,7 +130,10 @@ func GetPrimaryElectionEvents(ctx context.Context, dbName string) ([]string, err
 	return primaryTransitionTimes, nil
 }
 
-func ProcessLogStream(ctx context.Context, fr FileReader, logPath string, host string, dbName string) error {
+// ProcessLogStream ingests a log file of a host. The slow queries of a mongos log are stored
+// apart from the shards' ones, as they describe how operations were routed rather than how
+// they ran.
+func ProcessLogStream(ctx context.Context, fr FileReader, logPath string, host string, logName string, dbName string) error {
 	Logger.Info("Analyzing log stream")
 	file, err := fr.Open(logPath)
 	var r io.Reader
@@ -106,6 +155,7 @@ func ProcessLogStream(ctx context.Context, fr FileReader, logPath string, host s
 
 	var primaryTransitionEntries []interface{}
 	var slowQueryEntries []interface{}
+	var mongosSlowQueryEntries []interface{}
 	var clientMetadataEntries []interface{}
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
@@ -125,7 +175,13 @@ func ProcessLogStream(ctx context.Context, fr FileReader, logPath string, host s
 			}
 			entry.Host = host
 			entry.CtxHost = fmt.Sprintf("%s_%s", entry.Ctx, entry.Host)
-			slowQueryEntries = append(slowQueryEntries, entry)
+			entry.OpType = ClassifyOperation(entry.Attr)
+			if IsMongosSlowQuery(logName) {
+				entry.ShapeKey = RouterShapeKey(entry.Attr)
+				mongosSlowQueryEntries = append(mongosSlowQueryEntries, entry)
+			} else {
+				slowQueryEntries = append(slowQueryEntries, entry)
+			}
 		} else if strings.Contains(line, clientMetadata) {
 			var entry LogEntry
 			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
@@ -154,6 +210,15 @@ func ProcessLogStream(ctx context.Context, fr FileReader, logPath string, host s
 			slowQueryEntries = nil
 		}
 
+		if len(mongosSlowQueryEntries) >= batchSize {
+			Logger.WithFields(logrus.Fields{"batchSize": len(mongosSlowQueryEntries)}).Info("Writing mongos slow queries batch")
+			_, err := InsertMongosSlowQueriesBatch(ctx, mongosSlowQueryEntries, dbName)
+			if err != nil {
+				Logger.Error(err)
+			}
+			mongosSlowQueryEntries = nil
+		}
+
 		if len(clientMetadataEntries) >= batchSize {
 			Logger.WithFields(logrus.Fields{"batchSize": len(clientMetadataEntries)}).Info("Writing client metadata batch")
 			_, err := InsertClientMetadataBatch(ctx, clientMetadataEntries, dbName)
@@ -183,6 +248,15 @@ func ProcessLogStream(ctx context.Context, fr FileReader, logPath string, host s
 		slowQueryEntries = nil
 	}
 
+	if len(mongosSlowQueryEntries) > 0 {
+		Logger.WithFields(logrus.Fields{"batchSize": len(mongosSlowQueryEntries)}).Info("Writing mongos slow queries batch")
+		_, err := InsertMongosSlowQueriesBatch(ctx, mongosSlowQueryEntries, dbName)
+		if err != nil {
+			Logger.Error(err)
+		}
+		mongosSlowQueryEntries = nil
+	}
+
 	if len(clientMetadataEntries) > 0 {
 		Logger.WithFields(logrus.Fields{"batchSize": len(clientMetadataEntries)}).Info("Writing client metadata batch")
 		_, err := InsertClientMetadataBatch(ctx, clientMetadataEntries, dbName)
@@ -19,9 +19,11 @@ var Logger = func() *logrus.Logger {
 		TimestampFormat: time.RFC3339,
 	})
 
-	cfg, _ := GetConfig()
-
-	levelStr := cfg.LogLevel
+	// The configuration may fail to load, in which case main reports it; log at info until then.
+	levelStr := ""
+	if cfg, err := GetConfig(); err == nil {
+		levelStr = cfg.LogLevel
+	}
 	if levelStr == "" {
 		levelStr = "info"
 	}
@@ -2,29 +2,131 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"google.golang.org/genai"
 )
 
+// completedReport reports whether a report was generated with its LLM analysis, in which case
+// a resumed run doesn't need to generate it again.
+func completedReport(summary *RunSummary, report string) bool {
+	for _, gap := range summary.Gaps(report) {
+		if gap.Kind == gapAnalysis {
+			return false
+		}
+	}
+	return true
+}
+
+// runReportStage generates a report unless the run's manifest records it as completed. Replays
+// generate it again regardless. A report written without its LLM analysis counts as failed.
+func runReportStage(ctx context.Context, m *RunManifest, stage string, report string, replay bool, reset []string, generate func() error) {
+	summary := GetRunSummary()
+	if m.StageDone(stage) && !replay {
+		Logger.WithFields(logrus.Fields{"stage": stage}).Info("Report already generated, skipping")
+		return
+	}
+	if err := DropCollections(ctx, m.RunID, reset...); err != nil {
+		Logger.Error(err)
+		summary.RecordReportFailure(report)
+		return
+	}
+	if err := generate(); err != nil {
+		Logger.Error("Failed to generate report: ", err)
+		summary.RecordReportFailure(report)
+		return
+	}
+	if !completedReport(summary, report) {
+		summary.RecordReportFailure(report)
+		return
+	}
+	_ = m.CompleteStage(ctx, stage)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "prompt" {
+		if err := runPromptCommand(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "chat" {
+		if err := runChatCommand(context.Background(), os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	resume := flag.String("resume", "", "resume the given run (its database name) from its first incomplete stage")
+	agentMode := flag.Bool("agent", false, "let the LLM call tools to investigate the run before writing the reports")
+	cacheMode := flag.String("llm-cache", "", "LLM response cache mode: readWrite, refresh (bypass cached responses), off, or offline (cached responses only)")
+	flag.Parse()
+
 	cfg, err := GetConfig()
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, "Failed to load configuration:", err)
+		os.Exit(1)
+	}
+	if _, err := ResolveMetricSelection(cfg.Metrics); err != nil {
+		Logger.Error(err)
+		os.Exit(1)
+	}
+	if _, err := NewReportLocale(cfg.ReportLanguage); err != nil {
+		Logger.Error(err)
+		os.Exit(1)
+	}
+	if _, err := NewRedactor(cfg.Redaction); err != nil {
+		Logger.Error(err)
+		os.Exit(1)
+	}
+	if err := cfg.IndexValidation.Validate(); err != nil {
+		Logger.Error(err)
+		os.Exit(1)
+	}
+	if err := cfg.Sharding.Validate(); err != nil {
+		Logger.Error(err)
+		os.Exit(1)
 	}
 	ctx := context.Background()
-	ac := NewAtlasClient(nil)
-	dbName := fmt.Sprintf("%s_%s_logs", cfg.ClusterName, time.Now().Format(time.RFC3339))
-	dbName = strings.ReplaceAll(dbName, "-", "")
-	dbName = strings.ReplaceAll(dbName, ":", "")
-	dbName = strings.ReplaceAll(dbName, "+", "")
-	err = InitDb(ctx, ac, dbName)
+	ac, err := NewAtlasClient(nil)
+	if err != nil {
+		Logger.Error(err)
+		os.Exit(1)
+	}
+	var manifest *RunManifest
+	if *resume != "" {
+		manifest, err = LoadRunManifest(ctx, cfg, *resume)
+	} else {
+		dbName := fmt.Sprintf("%s_%s_logs", cfg.ClusterName, time.Now().Format(time.RFC3339))
+		dbName = strings.ReplaceAll(dbName, "-", "")
+		dbName = strings.ReplaceAll(dbName, ":", "")
+		dbName = strings.ReplaceAll(dbName, "+", "")
+		manifest, err = NewRunManifest(cfg, dbName)
+		if err == nil {
+			err = manifest.Save(ctx)
+		}
+	}
 	if err != nil {
 		Logger.Error(err)
-		panic(err)
+		os.Exit(runExitCodes[RunFailed])
+	}
+	dbName := manifest.RunID
+	Logger.WithFields(logrus.Fields{"run": dbName}).Info("Starting run")
+	summary := GetRunSummary()
+	err = InitDb(ctx, ac, manifest)
+	if err != nil {
+		Logger.Error(err)
+		summary.RecordReportFailure(slowQueryReport)
+		summary.RecordReportFailure(metricsReport)
+		summary.Finish(2)
+		_ = summary.Save(ctx, dbName)
+		os.Exit(summary.ExitCode())
 	}
 	geminiClient, err := genai.NewClient(ctx, &genai.ClientConfig{
 		APIKey:  cfg.GeminiAPIKey,
@@ -32,17 +134,30 @@ func main() {
 	})
 	if err != nil {
 		Logger.Error(err)
-		os.Exit(1)
+		os.Exit(runExitCodes[RunFailed])
 	}
-	lc := NewLLMClient(geminiClient)
-	err = lc.GenerateSlowQueryReport(ctx, dbName)
-	if err != nil {
-		Logger.Error("Failed to generate slow query report", err)
-		os.Exit(1)
+	if *cacheMode != "" {
+		cfg.LLMCache.Mode = *cacheMode
 	}
-	err = lc.GenerateMetricsAnalysisReport(ctx, ac, dbName)
+	if *agentMode {
+		cfg.Agent.Enabled = true
+	}
+	lc, err := NewLLMClient(geminiClient)
 	if err != nil {
-		Logger.Error("Failed to generate metrics analysis report", err)
-		os.Exit(1)
+		Logger.Error(err)
+		os.Exit(runExitCodes[RunFailed])
 	}
+	// An offline resume replays the run's reports from the cached LLM responses.
+	replay := lc.Cache.Mode == cacheOffline
+	// Each report is generated even if the other one fails.
+	runReportStage(ctx, manifest, stageSlowQueryReport, slowQueryReport, replay, nil, func() error {
+		return lc.GenerateSlowQueryReport(ctx, ac, dbName)
+	})
+	runReportStage(ctx, manifest, stageMetricsReport, metricsReport, replay, []string{"metricFindings", "slowQueryMetricCorrelations"}, func() error {
+		return lc.GenerateMetricsAnalysisReport(ctx, ac, dbName)
+	})
+	summary.Finish(2)
+	_ = summary.Save(ctx, dbName)
+	_ = DisconnectMongoClient()
+	os.Exit(summary.ExitCode())
 }
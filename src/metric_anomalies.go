@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	severityWarn     = "warn"
+	severityHigh     = "high"
+	severityCritical = "critical"
+
+	findingThreshold = "threshold"
+	findingAnomaly   = "anomaly"
+
+	// Number of preceding data points the rolling baseline is computed from.
+	baselineWindow = 24
+	// Minimum number of preceding data points before a point can be flagged as anomalous.
+	minBaselinePoints = 6
+	// Robust z-scores (Iglewicz and Hoaglin) from which a point is anomalous, and highly so.
+	anomalyZScore     = 3.5
+	highAnomalyZScore = 6
+	// Maximum number of findings passed to the LLM.
+	maxPromptFindings = 50
+)
+
+var severityRank = map[string]int{
+	severityWarn:     1,
+	severityHigh:     2,
+	severityCritical: 3,
+}
+
+// MetricFinding is a window in which a metric of a host breached a threshold band or deviated
+// from its rolling baseline.
+type MetricFinding struct {
+	Metric    string    `bson:"metric" json:"metric"`
+	Host      string    `bson:"host" json:"host"`
+	Partition string    `bson:"partition,omitempty" json:"partition,omitempty"`
+	Kind      string    `bson:"kind" json:"kind"`
+	Severity  string    `bson:"severity" json:"severity"`
+	Start     time.Time `bson:"start" json:"start"`
+	End       time.Time `bson:"end" json:"end"`
+	Peak      float64   `bson:"peak" json:"peak"`
+	Baseline  float64   `bson:"baseline" json:"baseline"`
+	Points    int       `bson:"points" json:"points"`
+}
+
+func thresholdSeverity(bands ThresholdBands, v float64) string {
+	switch {
+	case bands.Critical > 0 && v > bands.Critical:
+		return severityCritical
+	case bands.High > 0 && v > bands.High:
+		return severityHigh
+	case bands.Warn > 0 && v > bands.Warn:
+		return severityWarn
+	}
+	return ""
+}
+
+// robustZScore compares a value with the median and median absolute deviation of its
+// baseline, falling back to the mean and standard deviation when the MAD is zero.
+func robustZScore(baseline []float64, v float64) (float64, float64) {
+	sorted := make([]float64, len(baseline))
+	copy(sorted, baseline)
+	sort.Float64s(sorted)
+	median := Percentile(sorted, 0.5)
+	deviations := make([]float64, len(sorted))
+	for i, b := range sorted {
+		deviations[i] = math.Abs(b - median)
+	}
+	sort.Float64s(deviations)
+	mad := Percentile(deviations, 0.5)
+	if mad > 0 {
+		return 0.6745 * (v - median) / mad, median
+	}
+	var mean, variance float64
+	for _, b := range baseline {
+		mean += b
+	}
+	mean /= float64(len(baseline))
+	for _, b := range baseline {
+		variance += (b - mean) * (b - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(baseline)))
+	if stddev == 0 {
+		return 0, median
+	}
+	return (v - mean) / stddev, median
+}
+
+// findingBuilder merges consecutive flagged data points of a series into findings.
+type findingBuilder struct {
+	series   MetricSeries
+	kind     string
+	current  *MetricFinding
+	findings []MetricFinding
+}
+
+func (b *findingBuilder) add(p MetricPoint, severity string, baseline float64) {
+	if severity == "" {
+		b.flush()
+		return
+	}
+	if b.current == nil {
+		b.current = &MetricFinding{
+			Metric:    b.series.Name,
+			Host:      b.series.Host,
+			Partition: b.series.Partition,
+			Kind:      b.kind,
+			Severity:  severity,
+			Start:     p.Timestamp,
+			Baseline:  baseline,
+		}
+	}
+	b.current.End = p.Timestamp
+	b.current.Points++
+	if p.Value > b.current.Peak {
+		b.current.Peak = p.Value
+	}
+	if severityRank[severity] > severityRank[b.current.Severity] {
+		b.current.Severity = severity
+	}
+}
+
+func (b *findingBuilder) flush() {
+	if b.current != nil {
+		b.findings = append(b.findings, *b.current)
+		b.current = nil
+	}
+}
+
+// DetectMetricFindings applies the threshold bands of each host to the series they're defined
+// for and flags the data points of every series that deviate upwards from their rolling
+// baseline.
+func DetectMetricFindings(series []MetricSeries, thresholds ThresholdResolver) []MetricFinding {
+	var findings []MetricFinding
+	for _, s := range series {
+		if bands, ok := thresholds.ForHost(s.Host)[s.Name]; ok {
+			b := &findingBuilder{series: s, kind: findingThreshold}
+			for _, p := range s.Points {
+				b.add(p, thresholdSeverity(bands, p.Value), 0)
+			}
+			b.flush()
+			findings = append(findings, b.findings...)
+		}
+
+		b := &findingBuilder{series: s, kind: findingAnomaly}
+		for i, p := range s.Points {
+			start := i - baselineWindow
+			if start < 0 {
+				start = 0
+			}
+			if i-start < minBaselinePoints {
+				continue
+			}
+			var baseline []float64
+			for _, bp := range s.Points[start:i] {
+				baseline = append(baseline, bp.Value)
+			}
+			z, median := robustZScore(baseline, p.Value)
+			severity := ""
+			switch {
+			case z >= highAnomalyZScore:
+				severity = severityHigh
+			case z >= anomalyZScore:
+				severity = severityWarn
+			}
+			b.add(p, severity, median)
+		}
+		b.flush()
+		findings = append(findings, b.findings...)
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if severityRank[findings[i].Severity] != severityRank[findings[j].Severity] {
+			return severityRank[findings[i].Severity] > severityRank[findings[j].Severity]
+		}
+		return findings[i].Start.Before(findings[j].Start)
+	})
+	return findings
+}
+
+// AnalyzeMetrics detects the metric findings of all series and, when persist is set, stores
+// them in the run database.
+func AnalyzeMetrics(ctx context.Context, dbName string, series []MetricSeries, thresholds ThresholdResolver, persist bool) ([]MetricFinding, error) {
+	findings := DetectMetricFindings(series, thresholds)
+	Logger.WithField("findings", len(findings)).Info("Metric analysis complete")
+	if len(findings) == 0 || !persist {
+		return findings, nil
+	}
+	var docs []interface{}
+	for _, f := range findings {
+		docs = append(docs, f)
+	}
+	if _, err := InsertMetricFindings(ctx, docs, dbName); err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+// MetricFindingsData is the data of the metric findings context of the metrics prompt.
+type MetricFindingsData struct {
+	// BaselineWindow is the number of preceding data points an anomaly is measured against, and
+	// ZScore the robust z-score from which a data point is anomalous.
+	BaselineWindow int
+	ZScore         float64
+	// Findings are the most severe findings; the Kind of each is threshold or anomaly.
+	Findings []MetricFinding
+	// Omitted is the number of less severe findings left out of the prompt.
+	Omitted int
+}
+
+// GetMetricFindingsContext renders the most severe findings as prompt context.
+func GetMetricFindingsContext(findings []MetricFinding) (string, error) {
+	data := MetricFindingsData{BaselineWindow: baselineWindow, ZScore: anomalyZScore, Findings: findings}
+	if len(findings) > maxPromptFindings {
+		data.Findings = findings[:maxPromptFindings]
+		data.Omitted = len(findings) - maxPromptFindings
+	}
+	return renderPrompt(metricFindingsTemplate, data)
+}
+
+// RenderMetricFindingsSection renders the findings as a Markdown table.
+func RenderMetricFindingsSection(findings []MetricFinding) string {
+	var sb strings.Builder
+	sb.WriteString("## Metric findings\n\n")
+	if len(findings) == 0 {
+		sb.WriteString("No threshold breaches or anomalies were found.\n")
+		return sb.String()
+	}
+	sb.WriteString("| Severity | Kind | Metric | Host | Window | Peak | Baseline |\n")
+	sb.WriteString("|---|---|---|---|---|---|---|\n")
+	locale := GetReportLocale()
+	for _, f := range findings {
+		host := f.Host
+		if f.Partition != "" {
+			host += " (" + f.Partition + ")"
+		}
+		baseline := ""
+		if f.Kind == findingAnomaly {
+			baseline = locale.Number(f.Baseline, 1)
+		}
+		sb.WriteString(fmt.Sprintf(
+			"| %s | %s | %s | %s | %s – %s | %s | %s |\n",
+			f.Severity, f.Kind, f.Metric, host,
+			locale.DateTime(f.Start), locale.Time(f.End),
+			locale.Number(f.Peak, 1), baseline,
+		))
+	}
+	return sb.String()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// atlasHostMetrics is the catalogue of process measurements the Atlas Administration API
+// returns for the m parameter of the host measurements endpoint.
+var atlasHostMetrics = []string{
+	"ASSERT_MSG", "ASSERT_REGULAR", "ASSERT_USER", "ASSERT_WARNING",
+	"BACKGROUND_FLUSH_AVG",
+	"CACHE_BYTES_READ_INTO", "CACHE_BYTES_WRITTEN_FROM", "CACHE_DIRTY_BYTES", "CACHE_USED_BYTES",
+	"CACHE_FILL_RATIO", "DIRTY_FILL_RATIO",
+	"CONNECTIONS",
+	"CURSORS_TOTAL_OPEN", "CURSORS_TOTAL_TIMED_OUT",
+	"DB_DATA_SIZE_TOTAL", "DB_DATA_SIZE_TOTAL_WO_SYSTEM", "DB_INDEX_SIZE_TOTAL", "DB_STORAGE_TOTAL",
+	"DOCUMENT_METRICS_DELETED", "DOCUMENT_METRICS_INSERTED", "DOCUMENT_METRICS_RETURNED", "DOCUMENT_METRICS_UPDATED",
+	"EXTRA_INFO_PAGE_FAULTS",
+	"GLOBAL_LOCK_CURRENT_QUEUE_READERS", "GLOBAL_LOCK_CURRENT_QUEUE_TOTAL", "GLOBAL_LOCK_CURRENT_QUEUE_WRITERS",
+	"MEMORY_MAPPED", "MEMORY_RESIDENT", "MEMORY_VIRTUAL",
+	"NETWORK_BYTES_IN", "NETWORK_BYTES_OUT", "NETWORK_NUM_REQUESTS",
+	"OPCOUNTER_CMD", "OPCOUNTER_DELETE", "OPCOUNTER_GETMORE", "OPCOUNTER_INSERT", "OPCOUNTER_QUERY",
+	"OPCOUNTER_TTL_DELETED", "OPCOUNTER_UPDATE",
+	"OPCOUNTER_REPL_CMD", "OPCOUNTER_REPL_DELETE", "OPCOUNTER_REPL_INSERT", "OPCOUNTER_REPL_UPDATE",
+	"OPERATIONS_SCAN_AND_ORDER", "OPERATION_THROTTLING_REJECTED_OPERATIONS",
+	"OPERATIONS_QUERIES_KILLED",
+	"OP_EXECUTION_TIME_COMMANDS", "OP_EXECUTION_TIME_READS", "OP_EXECUTION_TIME_WRITES",
+	"OPLOG_MASTER_LAG_TIME_DIFF", "OPLOG_MASTER_TIME", "OPLOG_RATE_GB_PER_HOUR", "OPLOG_SLAVE_LAG_MASTER_TIME",
+	"PROCESS_CPU_CHILDREN_KERNEL", "PROCESS_CPU_CHILDREN_USER", "PROCESS_CPU_KERNEL", "PROCESS_CPU_USER",
+	"PROCESS_NORMALIZED_CPU_CHILDREN_KERNEL", "PROCESS_NORMALIZED_CPU_CHILDREN_USER",
+	"PROCESS_NORMALIZED_CPU_KERNEL", "PROCESS_NORMALIZED_CPU_USER",
+	"QUERY_EXECUTOR_SCANNED", "QUERY_EXECUTOR_SCANNED_OBJECTS",
+	"QUERY_SPILL_TO_DISK_DURING_SORT",
+	"QUERY_TARGETING_SCANNED_OBJECTS_PER_RETURNED", "QUERY_TARGETING_SCANNED_PER_RETURNED",
+	"SWAP_IO_IN", "SWAP_IO_OUT", "SWAP_USAGE_FREE", "SWAP_USAGE_USED",
+	"SYSTEM_CPU_GUEST", "SYSTEM_CPU_IOWAIT", "SYSTEM_CPU_IRQ", "SYSTEM_CPU_KERNEL", "SYSTEM_CPU_NICE",
+	"SYSTEM_CPU_SOFTIRQ", "SYSTEM_CPU_STEAL", "SYSTEM_CPU_USER",
+	"SYSTEM_NORMALIZED_CPU_GUEST", "SYSTEM_NORMALIZED_CPU_IOWAIT", "SYSTEM_NORMALIZED_CPU_IRQ",
+	"SYSTEM_NORMALIZED_CPU_KERNEL", "SYSTEM_NORMALIZED_CPU_NICE", "SYSTEM_NORMALIZED_CPU_SOFTIRQ",
+	"SYSTEM_NORMALIZED_CPU_STEAL", "SYSTEM_NORMALIZED_CPU_USER",
+	"SYSTEM_MEMORY_AVAILABLE", "SYSTEM_MEMORY_FREE", "SYSTEM_MEMORY_USED",
+	"SYSTEM_NETWORK_IN", "SYSTEM_NETWORK_OUT",
+	"TICKETS_AVAILABLE_READS", "TICKETS_AVAILABLE_WRITE",
+}
+
+// atlasDiskMetrics is the catalogue of disk partition measurements, which Atlas serves from
+// the disk measurements endpoint.
+var atlasDiskMetrics = []string{
+	"DISK_PARTITION_IOPS_READ", "DISK_PARTITION_IOPS_WRITE", "DISK_PARTITION_IOPS_TOTAL",
+	"DISK_PARTITION_LATENCY_READ", "DISK_PARTITION_LATENCY_WRITE",
+	"DISK_PARTITION_SPACE_FREE", "DISK_PARTITION_SPACE_USED",
+	"DISK_PARTITION_SPACE_PERCENT_FREE", "DISK_PARTITION_SPACE_PERCENT_USED",
+	"DISK_PARTITION_THROUGHPUT_READ", "DISK_PARTITION_THROUGHPUT_WRITE",
+	"DISK_PARTITION_UTILIZATION", "DISK_QUEUE_DEPTH",
+}
+
+// maxMetricPrefix selects the per-interval maximum of a metric instead of its average.
+const maxMetricPrefix = "MAX_"
+
+// metricGroups expand to the Atlas metrics listed in Config.Metrics under the group's name.
+var metricGroups = map[string][]string{
+	"cpu": {
+		"SYSTEM_NORMALIZED_CPU_USER", "SYSTEM_NORMALIZED_CPU_KERNEL", "SYSTEM_NORMALIZED_CPU_IOWAIT",
+		"SYSTEM_NORMALIZED_CPU_STEAL", "PROCESS_NORMALIZED_CPU_USER", "PROCESS_NORMALIZED_CPU_KERNEL",
+	},
+	"memory": {
+		"SYSTEM_MEMORY_USED", "SYSTEM_MEMORY_AVAILABLE", "MEMORY_RESIDENT", "MEMORY_VIRTUAL",
+		"SWAP_USAGE_USED", "EXTRA_INFO_PAGE_FAULTS",
+	},
+	"cache": {
+		"CACHE_BYTES_READ_INTO", "CACHE_BYTES_WRITTEN_FROM", "CACHE_DIRTY_BYTES", "CACHE_USED_BYTES",
+		"CACHE_FILL_RATIO", "DIRTY_FILL_RATIO",
+	},
+	"opcounters": {
+		"OPCOUNTER_CMD", "OPCOUNTER_QUERY", "OPCOUNTER_INSERT", "OPCOUNTER_UPDATE", "OPCOUNTER_DELETE",
+		"OPCOUNTER_GETMORE",
+	},
+	"tickets": {
+		"TICKETS_AVAILABLE_READS", "TICKETS_AVAILABLE_WRITE",
+		"GLOBAL_LOCK_CURRENT_QUEUE_READERS", "GLOBAL_LOCK_CURRENT_QUEUE_WRITERS",
+	},
+	"connections": {
+		"CONNECTIONS", "CURSORS_TOTAL_OPEN", "CURSORS_TOTAL_TIMED_OUT",
+	},
+	"targeting": {
+		"QUERY_TARGETING_SCANNED_PER_RETURNED", "QUERY_TARGETING_SCANNED_OBJECTS_PER_RETURNED",
+		"QUERY_EXECUTOR_SCANNED", "QUERY_EXECUTOR_SCANNED_OBJECTS", "OPERATIONS_SCAN_AND_ORDER",
+	},
+	"latency": {
+		"OP_EXECUTION_TIME_READS", "OP_EXECUTION_TIME_WRITES", "OP_EXECUTION_TIME_COMMANDS",
+	},
+	"replication": {
+		"OPLOG_SLAVE_LAG_MASTER_TIME", "OPLOG_MASTER_LAG_TIME_DIFF", "OPLOG_RATE_GB_PER_HOUR",
+	},
+	"network": {
+		"NETWORK_BYTES_IN", "NETWORK_BYTES_OUT", "NETWORK_NUM_REQUESTS",
+	},
+	"disk": {
+		"DISK_PARTITION_IOPS_READ", "DISK_PARTITION_IOPS_WRITE",
+		"DISK_PARTITION_LATENCY_READ", "DISK_PARTITION_LATENCY_WRITE",
+		"DISK_PARTITION_SPACE_PERCENT_USED", "DISK_PARTITION_UTILIZATION", "DISK_QUEUE_DEPTH",
+	},
+}
+
+// analysisMetrics are always requested when metrics are selected, because the threshold,
+// anomaly and correlation analyses are computed from them.
+var analysisMetrics = []string{
+	"SYSTEM_NORMALIZED_CPU_USER",
+	"SYSTEM_MEMORY_USED",
+	"SYSTEM_MEMORY_AVAILABLE",
+	"QUERY_TARGETING_SCANNED_PER_RETURNED",
+	"QUERY_TARGETING_SCANNED_OBJECTS_PER_RETURNED",
+	"DISK_PARTITION_IOPS_READ",
+	"DISK_PARTITION_IOPS_WRITE",
+}
+
+// MetricSelection holds the metric names requested from the host and disk measurements
+// endpoints. A nil list requests every metric.
+type MetricSelection struct {
+	Host []string
+	Disk []string
+}
+
+func inCatalogue(catalogue []string, name string) bool {
+	name = strings.TrimPrefix(name, maxMetricPrefix)
+	for _, m := range catalogue {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveMetricSelection expands the metric groups in names and checks every metric against
+// the Atlas catalogue. Without names, every metric is selected, as before.
+func ResolveMetricSelection(names []string) (MetricSelection, error) {
+	var selection MetricSelection
+	if len(names) == 0 {
+		return selection, nil
+	}
+	var expanded []string
+	var unknown []string
+	requested := append(append([]string{}, names...), analysisMetrics...)
+	for _, name := range requested {
+		if group, ok := metricGroups[strings.ToLower(name)]; ok {
+			expanded = append(expanded, group...)
+			continue
+		}
+		expanded = append(expanded, strings.ToUpper(name))
+	}
+	seen := make(map[string]bool)
+	for _, name := range expanded {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		switch {
+		case inCatalogue(atlasHostMetrics, name):
+			selection.Host = append(selection.Host, name)
+		case inCatalogue(atlasDiskMetrics, name):
+			selection.Disk = append(selection.Disk, name)
+		default:
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		var groups []string
+		for g := range metricGroups {
+			groups = append(groups, g)
+		}
+		sort.Strings(groups)
+		return selection, fmt.Errorf("unknown Atlas metrics %s; use Atlas metric names or one of the groups %s",
+			strings.Join(unknown, ", "), strings.Join(groups, ", "))
+	}
+	return selection, nil
+}
+
+func optionalMetrics(names []string) *[]string {
+	if len(names) == 0 {
+		return nil
+	}
+	return &names
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"go.mongodb.org/atlas-sdk/v20250312005/admin"
+)
+
+// Metrics derived from the raw Atlas measurements.
+const (
+	memoryPercentUsedMetric = "SYSTEM_MEMORY_PERCENT_USED"
+	diskIOPSTotalMetric     = "DISK_PARTITION_IOPS_TOTAL"
+)
+
+type MetricPoint struct {
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	Value     float64   `bson:"value" json:"value"`
+}
+
+// MetricSeries is a single Atlas measurement series of a host, or of one of its disk
+// partitions.
+type MetricSeries struct {
+	Host      string        `bson:"host" json:"host"`
+	Partition string        `bson:"partition,omitempty" json:"partition,omitempty"`
+	Name      string        `bson:"name" json:"name"`
+	Units     string        `bson:"units" json:"units"`
+	Points    []MetricPoint `bson:"points" json:"points"`
+}
+
+// MeasurementSeries flattens an Atlas measurements response into one series per metric,
+// skipping the data points Atlas reports without a value.
+func MeasurementSeries(host string, partition string, m *admin.ApiMeasurementsGeneralViewAtlas) []MetricSeries {
+	var series []MetricSeries
+	if m == nil || m.Measurements == nil {
+		return series
+	}
+	for _, measurement := range *m.Measurements {
+		s := MetricSeries{
+			Host:      host,
+			Partition: partition,
+			Name:      measurement.GetName(),
+			Units:     measurement.GetUnits(),
+		}
+		for _, dp := range measurement.GetDataPoints() {
+			if dp.Timestamp == nil || dp.Value == nil {
+				continue
+			}
+			s.Points = append(s.Points, MetricPoint{Timestamp: *dp.Timestamp, Value: float64(*dp.Value)})
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// Values returns the values of a series in ascending order.
+func (s MetricSeries) Values() []float64 {
+	values := make([]float64, 0, len(s.Points))
+	for _, p := range s.Points {
+		values = append(values, p.Value)
+	}
+	sort.Float64s(values)
+	return values
+}
+
+func findSeries(series []MetricSeries, host string, name string) []MetricSeries {
+	var found []MetricSeries
+	for _, s := range series {
+		if s.Host == host && s.Name == name {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// DeriveSeries adds the per-host memory utilization percentage and total disk IOPS across
+// all partitions to a list of series. The hosts are derived in the order they first appear in, so
+// that the same measurements always give the same prompt and an offline replay hits the cache.
+func DeriveSeries(series []MetricSeries) []MetricSeries {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, s := range series {
+		if !seen[s.Host] {
+			seen[s.Host] = true
+			hosts = append(hosts, s.Host)
+		}
+	}
+	derived := series
+	for _, host := range hosts {
+		used := findSeries(series, host, "SYSTEM_MEMORY_USED")
+		available := findSeries(series, host, "SYSTEM_MEMORY_AVAILABLE")
+		if len(used) == 1 && len(available) == 1 {
+			availableAt := make(map[time.Time]float64)
+			for _, p := range available[0].Points {
+				availableAt[p.Timestamp] = p.Value
+			}
+			mem := MetricSeries{Host: host, Name: memoryPercentUsedMetric, Units: "PERCENT"}
+			for _, p := range used[0].Points {
+				if a, ok := availableAt[p.Timestamp]; ok && p.Value+a > 0 {
+					mem.Points = append(mem.Points, MetricPoint{Timestamp: p.Timestamp, Value: p.Value / (p.Value + a) * 100})
+				}
+			}
+			derived = append(derived, mem)
+		}
+
+		iops := make(map[time.Time]float64)
+		for _, name := range []string{"DISK_PARTITION_IOPS_READ", "DISK_PARTITION_IOPS_WRITE"} {
+			for _, s := range findSeries(series, host, name) {
+				for _, p := range s.Points {
+					iops[p.Timestamp] += p.Value
+				}
+			}
+		}
+		if len(iops) > 0 {
+			total := MetricSeries{Host: host, Name: diskIOPSTotalMetric, Units: "SCALAR_PER_SECOND"}
+			for ts, v := range iops {
+				total.Points = append(total.Points, MetricPoint{Timestamp: ts, Value: v})
+			}
+			sort.Slice(total.Points, func(i, j int) bool { return total.Points[i].Timestamp.Before(total.Points[j].Timestamp) })
+			derived = append(derived, total)
+		}
+	}
+	return derived
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Number of spikes kept per summarized series.
+const spikesPerSeries = 3
+
+// SeriesSummary reduces a metric series to the statistics the LLM needs, in place of its raw
+// data points.
+type SeriesSummary struct {
+	Host      string        `bson:"host" json:"host"`
+	Partition string        `bson:"partition,omitempty" json:"partition,omitempty"`
+	Name      string        `bson:"name" json:"name"`
+	Units     string        `bson:"units" json:"units"`
+	Points    int           `bson:"points" json:"points"`
+	Min       float64       `bson:"min" json:"min"`
+	Max       float64       `bson:"max" json:"max"`
+	Mean      float64       `bson:"mean" json:"mean"`
+	P95       float64       `bson:"p95" json:"p95"`
+	SlopePerH float64       `bson:"slopePerHour" json:"slopePerHour"`
+	Breaches  int           `bson:"breaches" json:"breaches"`
+	Severity  string        `bson:"severity,omitempty" json:"severity,omitempty"`
+	Spikes    []MetricPoint `bson:"spikes" json:"spikes"`
+}
+
+// trendSlope fits a least-squares line through the points and returns its slope per hour.
+func trendSlope(points []MetricPoint) float64 {
+	if len(points) < 2 {
+		return 0
+	}
+	origin := points[0].Timestamp
+	var sumX, sumY, sumXY, sumXX float64
+	for _, p := range points {
+		x := p.Timestamp.Sub(origin).Hours()
+		sumX += x
+		sumY += p.Value
+		sumXY += x * p.Value
+		sumXX += x * x
+	}
+	n := float64(len(points))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// SummarizeSeries summarizes every series that has data points, counting the points above the
+// warn band of the host's thresholds as breaches.
+func SummarizeSeries(series []MetricSeries, thresholds ThresholdResolver) []SeriesSummary {
+	var summaries []SeriesSummary
+	for _, s := range series {
+		if len(s.Points) == 0 {
+			continue
+		}
+		values := s.Values()
+		summary := SeriesSummary{
+			Host:      s.Host,
+			Partition: s.Partition,
+			Name:      s.Name,
+			Units:     s.Units,
+			Points:    len(values),
+			Min:       values[0],
+			Max:       values[len(values)-1],
+			P95:       Percentile(values, 0.95),
+			SlopePerH: trendSlope(s.Points),
+		}
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		summary.Mean = sum / float64(len(values))
+
+		bands, hasBands := thresholds.ForHost(s.Host)[s.Name]
+		for _, p := range s.Points {
+			if !hasBands {
+				break
+			}
+			if severity := thresholdSeverity(bands, p.Value); severity != "" {
+				summary.Breaches++
+				if severityRank[severity] > severityRank[summary.Severity] {
+					summary.Severity = severity
+				}
+			}
+		}
+
+		spikes := make([]MetricPoint, len(s.Points))
+		copy(spikes, s.Points)
+		sort.SliceStable(spikes, func(i, j int) bool { return spikes[i].Value > spikes[j].Value })
+		if len(spikes) > spikesPerSeries {
+			spikes = spikes[:spikesPerSeries]
+		}
+		summary.Spikes = spikes
+		summaries = append(summaries, summary)
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if summaries[i].Host != summaries[j].Host {
+			return summaries[i].Host < summaries[j].Host
+		}
+		if summaries[i].Partition != summaries[j].Partition {
+			return summaries[i].Partition < summaries[j].Partition
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries
+}
+
+// byteUnitSizes are the sizes in bytes of the Atlas byte units, which the binary units of
+// formatted values are scaled from.
+var byteUnitSizes = map[string]float64{
+	"BYTES":     1,
+	"KILOBYTES": 1 << 10,
+	"MEGABYTES": 1 << 20,
+	"GIGABYTES": 1 << 30,
+}
+
+// formatMetricValue formats a metric value compactly, with byte sizes and rates in binary units.
+func formatMetricValue(locale *ReportLocale, v float64, units string) string {
+	size, rate := units, ""
+	if s, ok := strings.CutSuffix(units, "_PER_SECOND"); ok {
+		size, rate = s, "/s"
+	} else if s, ok := strings.CutSuffix(units, "_PER_HOUR"); ok {
+		size, rate = s, "/h"
+	}
+	scale, isBytes := byteUnitSizes[size]
+	switch {
+	case v == 0:
+		return "0"
+	case isBytes:
+		return locale.Bytes(v*scale) + rate
+	case math.Abs(v) >= 1e9:
+		return locale.Sprintf("%.2fG", v/1e9)
+	case math.Abs(v) >= 1e6:
+		return locale.Sprintf("%.2fM", v/1e6)
+	case math.Abs(v) >= 1e4:
+		return locale.Sprintf("%.1fk", v/1e3)
+	case math.Abs(v) < 0.01:
+		return locale.Significant(v, 2, false)
+	}
+	return locale.Sprintf("%.2f", v)
+}
+
+// RenderMetricSummaryTable renders the series summaries as a compact Markdown table, formatting
+// its values with the given locale.
+func RenderMetricSummaryTable(summaries []SeriesSummary, locale *ReportLocale) string {
+	if len(summaries) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("| Host | Metric | Units | Min | Mean | p95 | Max | Trend/h | Breaches | Top spikes |\n")
+	sb.WriteString("|---|---|---|---|---|---|---|---|---|---|\n")
+	for _, s := range summaries {
+		metric := s.Name
+		if s.Partition != "" {
+			metric += " (" + s.Partition + ")"
+		}
+		breaches := "-"
+		if s.Breaches > 0 {
+			breaches = fmt.Sprintf("%s (%s)", locale.Sprintf("%d", s.Breaches), s.Severity)
+		}
+		var spikes []string
+		for _, p := range s.Spikes {
+			spikes = append(spikes, fmt.Sprintf("%s @ %s", formatMetricValue(locale, p.Value, s.Units), locale.DateTime(p.Timestamp)))
+		}
+		fmt.Fprintf(&sb, "| %s | %s | %s | %s | %s | %s | %s | %s | %s | %s |\n",
+			s.Host, metric, s.Units,
+			formatMetricValue(locale, s.Min, s.Units), formatMetricValue(locale, s.Mean, s.Units),
+			formatMetricValue(locale, s.P95, s.Units), formatMetricValue(locale, s.Max, s.Units),
+			locale.Significant(s.SlopePerH, 3, true), breaches, strings.Join(spikes, ", "))
+	}
+	return sb.String()
+}
+
+// GetMetricSummaryContext introduces the summary table in the metrics prompt. Its values are
+// formatted with the invariant prompt locale rather than the report language's.
+func GetMetricSummaryContext(summaries []SeriesSummary) string {
+	if len(summaries) == 0 {
+		return ""
+	}
+	return "Summary of every metric series over the analyzed period (UTC timestamps). Trend/h is the least-squares slope " +
+		"per hour, and breaches count the data points above the warn band:\n\n" + RenderMetricSummaryTable(summaries, promptLocale)
+}
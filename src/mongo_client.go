@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -21,7 +23,8 @@ func GetMongoClient(ctx context.Context) (*mongo.Client, error) {
 	mongoOnce.Do(func() {
 		cfg, err := GetConfig()
 		if err != nil {
-			panic(err)
+			clientInstanceErr = fmt.Errorf("failed to load configuration: %w", err)
+			return
 		}
 		uri := cfg.OutputMongoURI
 		if uri == "" {
@@ -114,6 +117,210 @@ func InsertSlowQueriesBatch(ctx context.Context, docs []interface{}, dbName stri
 	return collection.InsertMany(ctx, docs)
 }
 
+func InsertMongosSlowQueriesBatch(ctx context.Context, docs []interface{}, dbName string) (*mongo.InsertManyResult, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("mongosSlowQueries")
+	return collection.InsertMany(ctx, docs)
+}
+
+// ListMongosQueryShapes returns the query shapes logged by mongos, empty for a replica set.
+func ListMongosQueryShapes(ctx context.Context, dbName string) ([]RoutedShape, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("mongosQueryShapes")
+	res, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+	var docs []RoutedShape
+	if err := res.All(ctx, &docs); err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+	return docs, nil
+}
+
+func UpsertShardDistribution(ctx context.Context, dbName string, dist *ShardDistribution) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(dbName).Collection("shardDistribution")
+	_, err = collection.ReplaceOne(ctx, bson.D{{"_id", dist.ID}}, dist, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetShardDistribution returns the shard distribution of a run, or nil when it wasn't read.
+func GetShardDistribution(ctx context.Context, dbName string) (*ShardDistribution, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("shardDistribution")
+	var dist ShardDistribution
+	err = collection.FindOne(ctx, bson.D{{"_id", shardDistributionID}}).Decode(&dist)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dist, nil
+}
+
+// GetSlowQueryLoadByHost sums the slow queries each host logged, and their duration.
+func GetSlowQueryLoadByHost(ctx context.Context, dbName string) ([]HostLoad, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("slowQueries")
+	pipeline := mongo.Pipeline{
+		{{"$group", bson.D{
+			{"_id", "$host"},
+			{"slowQueries", bson.D{{"$sum", 1}}},
+			{"durationMillis", bson.D{{"$sum", "$attr.durationMillis"}}},
+		}}},
+	}
+	res, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+	var docs []HostLoad
+	if err := res.All(ctx, &docs); err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+	return docs, nil
+}
+
+func UpsertRunManifest(ctx context.Context, m *RunManifest) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(m.RunID).Collection("runManifest")
+	_, err = collection.ReplaceOne(ctx, bson.D{{"_id", m.RunID}}, m, options.Replace().SetUpsert(true))
+	return err
+}
+
+func GetRunManifest(ctx context.Context, runID string) (*RunManifest, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(runID).Collection("runManifest")
+	var m RunManifest
+	if err := collection.FindOne(ctx, bson.D{{"_id", runID}}).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// DeleteHostDocuments removes the documents of a host from the given collections.
+func DeleteHostDocuments(ctx context.Context, dbName string, host string, collections ...string) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range collections {
+		if _, err := client.Database(dbName).Collection(name).DeleteMany(ctx, bson.D{{"host", host}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DropCollections(ctx context.Context, dbName string, collections ...string) error {
+	if len(collections) == 0 {
+		return nil
+	}
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range collections {
+		if err := client.Database(dbName).Collection(name).Drop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	llmCacheIndexMu      sync.Mutex
+	llmCacheIndexCreated bool
+)
+
+// llmCacheCollection returns the LLM cache collection, creating its TTL index on first use.
+// A failed index creation is retried on the next use.
+func llmCacheCollection(ctx context.Context, dbName string) (*mongo.Collection, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("responses")
+	llmCacheIndexMu.Lock()
+	defer llmCacheIndexMu.Unlock()
+	if llmCacheIndexCreated {
+		return collection, nil
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"expiresAt", 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return collection, fmt.Errorf("failed to create the TTL index of the LLM cache: %w", err)
+	}
+	llmCacheIndexCreated = true
+	return collection, nil
+}
+
+// GetCachedResponse returns the unexpired cached response with the given key, if any.
+func GetCachedResponse(ctx context.Context, dbName string, key string) (*CachedResponse, error) {
+	collection, err := llmCacheCollection(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+	var cached CachedResponse
+	err = collection.FindOne(ctx, bson.D{
+		{"_id", key},
+		{"expiresAt", bson.D{{"$gt", time.Now()}}},
+	}).Decode(&cached)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
+
+func UpsertCachedResponse(ctx context.Context, dbName string, entry CachedResponse) error {
+	collection, err := llmCacheCollection(ctx, dbName)
+	if err != nil {
+		return err
+	}
+	_, err = collection.ReplaceOne(ctx, bson.D{{"_id", entry.Key}}, entry, options.Replace().SetUpsert(true))
+	return err
+}
+
+func InsertRunSummary(ctx context.Context, doc interface{}, dbName string) (*mongo.InsertOneResult, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("runSummary")
+	return collection.InsertOne(ctx, doc)
+}
+
 func InsertPrimaryChangeEventBatch(ctx context.Context, docs []interface{}, dbName string) (*mongo.InsertManyResult, error) {
 	client, err := GetMongoClient(ctx)
 	if err != nil {
@@ -132,12 +339,144 @@ func InsertClientMetadataBatch(ctx context.Context, docs []interface{}, dbName s
 	return collection.InsertMany(ctx, docs)
 }
 
-func CreateSlowQueriesByDriver(ctx context.Context, dbName string) error {
+func InsertQueryAntiPatterns(ctx context.Context, docs []interface{}, dbName string) (*mongo.InsertManyResult, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("queryAntiPatterns")
+	return collection.InsertMany(ctx, docs)
+}
+
+func ListQueryAntiPatterns(ctx context.Context, dbName string) ([]AntiPatternHit, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("queryAntiPatterns")
+	res, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+
+	var docs []AntiPatternHit
+	err = res.All(ctx, &docs)
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+	return docs, nil
+}
+
+func InsertCorrelatedWindows(ctx context.Context, docs []interface{}, dbName string) (*mongo.InsertManyResult, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("slowQueryMetricCorrelations")
+	return collection.InsertMany(ctx, docs)
+}
+
+func InsertMetricFindings(ctx context.Context, docs []interface{}, dbName string) (*mongo.InsertManyResult, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("metricFindings")
+	return collection.InsertMany(ctx, docs)
+}
+
+func ListMetricFindings(ctx context.Context, dbName string) ([]MetricFinding, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("metricFindings")
+	res, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the metric findings: %w", err)
+	}
+	var docs []MetricFinding
+	if err := res.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode the metric findings: %w", err)
+	}
+	return docs, nil
+}
+
+func ListCorrelatedWindows(ctx context.Context, dbName string) ([]CorrelatedWindow, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("slowQueryMetricCorrelations")
+	res, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{"score", -1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the correlated windows: %w", err)
+	}
+	var docs []CorrelatedWindow
+	if err := res.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode the correlated windows: %w", err)
+	}
+	return docs, nil
+}
+
+// UpsertReport stores a generated report in the run database, replacing the previous one.
+func UpsertReport(ctx context.Context, dbName string, report StoredReport) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(dbName).Collection("reports")
+	_, err = collection.ReplaceOne(ctx, bson.D{{"_id", report.Name}}, report, options.Replace().SetUpsert(true))
+	return err
+}
+
+func ListReports(ctx context.Context, dbName string) ([]StoredReport, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("reports")
+	res, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the reports: %w", err)
+	}
+	var docs []StoredReport
+	if err := res.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode the reports: %w", err)
+	}
+	return docs, nil
+}
+
+// ForEachSlowQuery streams every stored slow query entry to fn.
+func ForEachSlowQuery(ctx context.Context, dbName string, fn func(SlowQueryEntry) error) error {
 	client, err := GetMongoClient(ctx)
 	if err != nil {
 		return err
 	}
 	collection := client.Database(dbName).Collection("slowQueries")
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		Logger.Error(err)
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var entry SlowQueryEntry
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// slowQueryShapeStages resolves the driver of every slow query and adds the fields shared by
+// the per-shape aggregations.
+func slowQueryShapeStages() mongo.Pipeline {
 	lookupStage := bson.D{
 		{"$lookup", bson.D{
 			{"from", "clientMetadata"},
@@ -162,69 +501,207 @@ func CreateSlowQueriesByDriver(ctx context.Context, dbName string) error {
 	unwind := bson.D{
 		{"$unwind", "$driver"},
 	}
-	addFields := bson.D{
-		{"$addFields", bson.D{
-			{"queryCommand", bson.D{
-				{"$ifNull", bson.A{
-					"$attr.originatingCommand",
-					"$attr.command",
-				}},
+	addFieldsSpec := bson.D{
+		{"queryCommand", bson.D{
+			{"$ifNull", bson.A{
+				"$attr.originatingCommand",
+				"$attr.command",
 			}},
-			{"isCollscan", bson.D{
-				{"$cond", bson.D{
-					{"if", bson.D{
-						{"$eq", bson.A{
-							"$attr.planSummary", "COLLSCAN",
-						}},
+		}},
+		{"isCollscan", bson.D{
+			{"$cond", bson.D{
+				{"if", bson.D{
+					{"$eq", bson.A{
+						"$attr.planSummary", "COLLSCAN",
 					}},
-					{"then", true},
-					{"else", false},
 				}},
+				{"then", true},
+				{"else", false},
 			}},
 		}},
 	}
-	group := bson.D{
-		{"$group", bson.D{
-			{"_id", bson.D{
-				{"driver", "$driver.driver"},
-				{"hash", "$attr.queryHash"},
-				{"isCollscan", "$isCollscan"},
-			}},
-			{"count", bson.D{{"$sum", 1}}},
-			{"totalBytesRead", bson.D{{"$sum", "$attr.storage.data.bytesRead"}}},
-			{"totalBytesWritten", bson.D{{"$sum", "$attr.storage.data.bytesWritten"}}},
-			{"totalDurationMillis", bson.D{{"$sum", "$attr.durationMillis"}}},
-			{"totalNumYields", bson.D{{"$sum", "$attr.numYields"}}},
-			{"maxBytesRead", bson.D{{"$max", "$attr.storage.data.bytesRead"}}},
-			{"maxWritten", bson.D{{"$max", "$attr.storage.data.bytesWritten"}}},
-			{"maxDurationMillis", bson.D{{"$max", "$attr.durationMillis"}}},
-			{"maxNumYields", bson.D{{"$max", "$attr.numYields"}}},
-			{"avgBytesRead", bson.D{{"$avg", "$attr.storage.data.bytesRead"}}},
-			{"avgWritten", bson.D{{"$avg", "$attr.storage.data.bytesWritten"}}},
-			{"avgDurationMillis", bson.D{{"$avg", "$attr.durationMillis"}}},
-			{"avgNumYields", bson.D{{"$avg", "$attr.numYields"}}},
-			{"queryExample", bson.D{{"$first", "$$ROOT"}}},
-		}},
+	addFieldsSpec = append(addFieldsSpec, targetingFields()...)
+	addFieldsSpec = append(addFieldsSpec, writeFields()...)
+	addFieldsSpec = append(addFieldsSpec, contentionFields()...)
+	addFields := bson.D{{"$addFields", addFieldsSpec}}
+	return mongo.Pipeline{
+		lookupStage,
+		unwind,
+		addFields,
+	}
+}
+
+func shapeID() bson.D {
+	return bson.D{
+		{"driver", "$driver.driver"},
+		{"hash", "$attr.queryHash"},
+		{"isCollscan", "$isCollscan"},
+		{"ns", "$attr.ns"},
+		{"opType", bson.D{{"$ifNull", bson.A{"$opType", opRead}}}},
 	}
+}
+
+func CreateSlowQueriesByDriver(ctx context.Context, dbName string) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(dbName).Collection("slowQueries")
+	native, err := SupportsPercentile(ctx)
+	if err != nil {
+		return err
+	}
+	groupFields := bson.D{
+		{"_id", shapeID()},
+		{"count", bson.D{{"$sum", 1}}},
+		{"totalBytesRead", bson.D{{"$sum", "$attr.storage.data.bytesRead"}}},
+		{"totalBytesWritten", bson.D{{"$sum", "$attr.storage.data.bytesWritten"}}},
+		{"totalDurationMillis", bson.D{{"$sum", "$attr.durationMillis"}}},
+		{"totalNumYields", bson.D{{"$sum", "$attr.numYields"}}},
+		{"maxBytesRead", bson.D{{"$max", "$attr.storage.data.bytesRead"}}},
+		{"maxWritten", bson.D{{"$max", "$attr.storage.data.bytesWritten"}}},
+		{"maxDurationMillis", bson.D{{"$max", "$attr.durationMillis"}}},
+		{"maxNumYields", bson.D{{"$max", "$attr.numYields"}}},
+		{"avgBytesRead", bson.D{{"$avg", "$attr.storage.data.bytesRead"}}},
+		{"avgWritten", bson.D{{"$avg", "$attr.storage.data.bytesWritten"}}},
+		{"avgDurationMillis", bson.D{{"$avg", "$attr.durationMillis"}}},
+		{"avgNumYields", bson.D{{"$avg", "$attr.numYields"}}},
+		{"queryExample", bson.D{{"$first", "$$ROOT"}}},
+	}
+	groupFields = append(groupFields, targetingAccumulators(native)...)
+	groupFields = append(groupFields, percentileAccumulators(durationPercentileSpecs(), native)...)
+	groupFields = append(groupFields, writeAccumulators()...)
+	groupFields = append(groupFields, contentionAccumulators()...)
+	group := bson.D{{"$group", groupFields}}
 	out := bson.D{
 		{"$out", bson.D{
 			{"db", dbName},
 			{"coll", "slowQueriesByDriver"},
 		}},
 	}
+	pipeline := slowQueryShapeStages()
+	pipeline = append(pipeline, percentileSampleStages(native)...)
+	pipeline = append(pipeline, group, targetingRatioStage())
+	pipeline = append(pipeline, percentileStages(shapePercentileSpecs(), native)...)
+	pipeline = append(pipeline, out)
+
+	_, err = collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		Logger.Error(err)
+		return err
+	}
+	if !native {
+		return finalizePercentiles(ctx, client.Database(dbName).Collection("slowQueriesByDriver"), shapePercentileSpecs())
+	}
+	return nil
+}
+
+// minOutputStoreMajor and minOutputStoreMinor are the oldest server version the output store
+// can run the analysis on: the percentile fallback samples with $topN (5.2+) and the histograms
+// bucket with $dateTrunc (5.0+).
+const (
+	minOutputStoreMajor = 5
+	minOutputStoreMinor = 2
+)
+
+// GetOutputStoreVersion returns the major and minor server version of the output MongoDB instance.
+func GetOutputStoreVersion(ctx context.Context) (int, int, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	var buildInfo struct {
+		VersionArray []int32 `bson:"versionArray"`
+	}
+	err = client.Database("admin").RunCommand(ctx, bson.D{{"buildInfo", 1}}).Decode(&buildInfo)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(buildInfo.VersionArray) < 2 {
+		return 0, 0, nil
+	}
+	return int(buildInfo.VersionArray[0]), int(buildInfo.VersionArray[1]), nil
+}
+
+// CheckOutputStoreVersion returns ErrOutputStoreTooOld when the output store is older than
+// the analysis pipelines need.
+func CheckOutputStoreVersion(ctx context.Context) error {
+	major, minor, err := GetOutputStoreVersion(ctx)
+	if err != nil {
+		Logger.Error("Error getting the output store version", err)
+		return err
+	}
+	if major < minOutputStoreMajor || major == minOutputStoreMajor && minor < minOutputStoreMinor {
+		return fmt.Errorf("%w: found %d.%d, need %d.%d or later",
+			ErrOutputStoreTooOld, major, minor, minOutputStoreMajor, minOutputStoreMinor)
+	}
+	return nil
+}
+
+// SupportsPercentile reports whether the output store can compute $percentile (7.0+).
+func SupportsPercentile(ctx context.Context) (bool, error) {
+	major, _, err := GetOutputStoreVersion(ctx)
+	if err != nil {
+		Logger.Error("Error getting the output store version", err)
+		return false, err
+	}
+	return major >= 7, nil
+}
+
+func ListSlowQueryTargetingByNamespace(ctx context.Context, dbName string) ([]NamespaceTargeting, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("slowQueryTargetingByNamespace")
+	res, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{"scannedObjectsPerReturned", -1}}))
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+
+	var docs []NamespaceTargeting
+	err = res.All(ctx, &docs)
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
+	}
+	return docs, nil
+}
+
+// withoutQueryExample projects out the example operation of a query shape, whose literals
+// aren't redacted, so that it reaches neither the prompts nor the agent's tools.
+var withoutQueryExample = bson.D{{"queryExample", 0}}
+
+// GetWorstTargetingShapes returns the query shapes with the highest p95 of documents or keys
+// examined per returned document.
+func GetWorstTargetingShapes(ctx context.Context, dbName string, topN int) ([]SlowQueryByDriver, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(dbName).Collection("slowQueriesByDriver")
 	pipeline := mongo.Pipeline{
-		lookupStage,
-		unwind,
-		addFields,
-		group,
-		out,
+		{{"$addFields", bson.D{
+			{"_worstTargeting", bson.D{{"$max", bson.A{"$p95ScannedPerReturned", "$p95ScannedObjectsPerReturned"}}}},
+		}}},
+		{{"$sort", bson.D{{"_worstTargeting", -1}}}},
+		{{"$limit", topN}},
+		{{"$project", withoutQueryExample}},
+	}
+	res, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		Logger.Error(err)
+		return nil, err
 	}
 
-	_, err = collection.Aggregate(ctx, pipeline)
+	var docs []SlowQueryByDriver
+	err = res.All(ctx, &docs)
 	if err != nil {
 		Logger.Error(err)
+		return nil, err
 	}
-	return err
+	return docs, nil
 }
 
 func ListPrimaryElectionEvents(ctx context.Context, dbName string) ([]LogEntry, error) {
@@ -247,29 +724,17 @@ func ListPrimaryElectionEvents(ctx context.Context, dbName string) ([]LogEntry,
 	return docs, nil
 }
 
-func GetTopQueryShapesByExecutionTime(ctx context.Context, dbName string, topN int) ([]SlowQueryByDriver, error) {
+// ListQueryShapes returns the query shapes aggregated in slowQueriesByDriver that match filter.
+func ListQueryShapes(ctx context.Context, dbName string, filter bson.D) ([]SlowQueryByDriver, error) {
 	client, err := GetMongoClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 	collection := client.Database(dbName).Collection("slowQueriesByDriver")
-	sort := bson.D{
-		{"$sort", bson.D{
-			{"totalDurationMillis", -1},
-		}},
-	}
-
-	limit := bson.D{
-		{"$limit", topN},
-	}
-	pipeline := mongo.Pipeline{
-		sort,
-		limit,
-	}
-
-	res, err := collection.Aggregate(ctx, pipeline)
+	res, err := collection.Find(ctx, filter, options.Find().SetProjection(withoutQueryExample))
 	if err != nil {
 		Logger.Error(err)
+		return nil, err
 	}
 
 	var docs []SlowQueryByDriver
@@ -281,18 +746,31 @@ func GetTopQueryShapesByExecutionTime(ctx context.Context, dbName string, topN i
 	return docs, nil
 }
 
-func GetSlowestQueryByShape(ctx context.Context, dbName string, queryHash string, driver string) (SlowQueryEntry, error) {
-	Logger.WithFields(logrus.Fields{"queryHash": queryHash}).Info("Fetching the slowest query for query hash")
+func GetSlowestQueryByShape(ctx context.Context, dbName string, id SlowQueryByID) (SlowQueryEntry, error) {
+	Logger.WithFields(logrus.Fields{"queryHash": id.Hash, "ns": id.Namespace}).Info("Fetching the slowest query for query hash")
+	if id.Namespace == "" {
+		return SlowQueryEntry{}, fmt.Errorf("%w: %s", ErrMissingNamespace, id.Hash)
+	}
 	client, err := GetMongoClient(ctx)
 	if err != nil {
 		Logger.Error(err)
-		panic(err)
+		return SlowQueryEntry{}, err
 	}
 	collection := client.Database(dbName).Collection("slowQueries")
+	// Inserts have no query hash, so they're matched on the namespace and operation type alone.
+	var queryHash interface{} = id.Hash
+	if id.Hash == "" {
+		queryHash = nil
+	}
+	filter := bson.D{
+		{"attr.queryHash", queryHash},
+		{"attr.ns", id.Namespace},
+	}
+	if id.OpType != "" && id.OpType != opRead {
+		filter = append(filter, bson.E{Key: "opType", Value: id.OpType})
+	}
 	match := bson.D{
-		{"$match", bson.D{
-			{"attr.queryHash", queryHash},
-		}},
+		{"$match", filter},
 	}
 	sort := bson.D{
 		{"$sort", bson.D{
@@ -311,20 +789,44 @@ func GetSlowestQueryByShape(ctx context.Context, dbName string, queryHash string
 	res, err := collection.Aggregate(ctx, pipeline)
 	if err != nil {
 		Logger.Error(err)
+		return SlowQueryEntry{}, fmt.Errorf("failed to fetch the slowest query of %s: %w", id.Hash, err)
 	}
 
 	var docs []SlowQueryEntry
 	err = res.All(ctx, &docs)
 	if err != nil {
 		Logger.Error(err)
-		panic(err)
+		return SlowQueryEntry{}, fmt.Errorf("failed to decode the slowest query of %s: %w", id.Hash, err)
 	}
 	if len(docs) == 1 {
 		doc := docs[0]
-		doc.Driver = driver
+		doc.Driver = id.Driver
 		return doc, nil
 	}
-	panic("Query hash not found")
+	return SlowQueryEntry{}, fmt.Errorf("%w: %s on %s", ErrQueryHashNotFound, id.Hash, id.Namespace)
+}
+
+// AggregateRunCollection runs an aggregation pipeline on a collection of the run database and
+// returns at most limit documents. The server stops the aggregation after timeout.
+func AggregateRunCollection(ctx context.Context, dbName string, collectionName string, pipeline bson.A, limit int, timeout time.Duration) ([]bson.M, error) {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	collection := client.Database(dbName).Collection(collectionName)
+	pipeline = append(pipeline, bson.D{{"$limit", limit}})
+	opts := options.Aggregate().SetCustom(bson.M{"maxTimeMS": timeout.Milliseconds()})
+	cursor, err := collection.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate %s: %w", collectionName, err)
+	}
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode the aggregation of %s: %w", collectionName, err)
+	}
+	return docs, nil
 }
 
 func GetHostNames(ctx context.Context, dbName string) ([]string, error) {
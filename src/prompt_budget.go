@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	// Rough number of characters per token of the English and JSON text in the prompts.
+	charsPerToken = 4
+	// Token budget of a single prompt when the configuration doesn't set one.
+	defaultPromptTokenBudget = 100000
+	// Longest string literal, and largest array, kept whole in the embedded query logs.
+	maxPromptLiteralLength = 512
+	maxPromptArrayElements = 20
+)
+
+// EstimateTokens approximates the number of tokens the model will count for a text.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + charsPerToken - 1) / charsPerToken
+}
+
+// PromptTokenBudget returns the configured token budget of a single prompt.
+func PromptTokenBudget(cfg *Config) int {
+	if cfg.PromptTokenBudget > 0 {
+		return cfg.PromptTokenBudget
+	}
+	return defaultPromptTokenBudget
+}
+
+// TruncateLiterals copies a decoded document, cutting long strings and large arrays (e.g. huge
+// $in lists or inline pipeline documents) down to a size that still shows their shape. Documents
+// are copied as bson.D in the order of their keys, which matters for sorts and index keys.
+func TruncateLiterals(v interface{}) interface{} {
+	if elems, ok := docElems(v); ok {
+		doc := make(bson.D, 0, len(elems))
+		for _, e := range elems {
+			doc = append(doc, bson.E{Key: e.Key, Value: TruncateLiterals(e.Value)})
+		}
+		return doc
+	}
+	if arr, ok := arrayElems(v); ok {
+		kept := arr
+		if len(arr) > maxPromptArrayElements {
+			kept = arr[:maxPromptArrayElements]
+		}
+		truncated := make([]interface{}, 0, len(kept)+1)
+		for _, elem := range kept {
+			truncated = append(truncated, TruncateLiterals(elem))
+		}
+		if len(arr) > len(kept) {
+			truncated = append(truncated, fmt.Sprintf("[... %d more elements]", len(arr)-len(kept)))
+		}
+		return truncated
+	}
+	if s, ok := v.(string); ok && utf8.RuneCountInString(s) > maxPromptLiteralLength {
+		runes := []rune(s)
+		return fmt.Sprintf("%s[... %d more characters]", string(runes[:maxPromptLiteralLength]), len(runes)-maxPromptLiteralLength)
+	}
+	return v
+}
+
+// Kinds of prompt sections.
+const (
+	sectionRead    = "read"
+	sectionWrite   = "write"
+	sectionContext = "context"
+)
+
+// promptSection is a part of a prompt that can't be split across LLM calls.
+type promptSection struct {
+	Name   string
+	Kind   string
+	Text   string
+	Tokens int
+}
+
+func newPromptSection(name, kind, text string) promptSection {
+	section := promptSection{Name: name, Kind: kind, Text: text, Tokens: EstimateTokens(text)}
+	Logger.WithFields(logrus.Fields{"section": name, "tokens": section.Tokens}).Debug("Prompt section size")
+	return section
+}
+
+// BuildSlowQueryPrompts renders the read and write shapes as one prompt, or, when that prompt
+// would exceed the token budget, as several prompts covering consecutive groups of shapes.
+// Shapes keep their report numbering across prompts.
+func BuildSlowQueryPrompts(reads []SlowQueryEntry, readShapes []RankedShape, writes []SlowQueryEntry, writeShapes []RankedShape, antiPatterns map[string][]AntiPatternHit, targeting string, routing string, sharding string, budget int) ([]string, error) {
+	var sections []promptSection
+	for i, sq := range reads {
+		text, err := slowQueryShapeSection(i+1, sq, readShapes[i], antiPatterns)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, newPromptSection(fmt.Sprintf("read shape %d", i+1), sectionRead, text))
+	}
+	if targeting != "" {
+		sections = append(sections, newPromptSection("targeting", sectionContext, "\n"+targeting))
+	}
+	if routing != "" {
+		sections = append(sections, newPromptSection("routing", sectionContext, "\n\n"+routing))
+	}
+	if sharding != "" {
+		sections = append(sections, newPromptSection("sharding", sectionContext, "\n\n"+sharding))
+	}
+	for i, sq := range writes {
+		text, err := slowWriteShapeSection(i+1, sq, writeShapes[i])
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, newPromptSection(fmt.Sprintf("write shape %d", i+1), sectionWrite, text))
+	}
+
+	instructions, err := slowQueryInstructions(len(reads))
+	if err != nil {
+		return nil, err
+	}
+	note, err := chunkNote(1, 1)
+	if err != nil {
+		return nil, err
+	}
+	writesInstructions, err := slowWritesInstructions()
+	if err != nil {
+		return nil, err
+	}
+	headerTokens := EstimateTokens(instructions + note)
+	writesTokens := EstimateTokens(writesInstructions)
+	var groups [][]promptSection
+	var current []promptSection
+	used := headerTokens
+	for _, section := range sections {
+		cost := section.Tokens
+		if section.Kind == sectionWrite && !hasWrites(current) {
+			cost += writesTokens
+		}
+		if len(current) > 0 && used+cost > budget {
+			groups = append(groups, current)
+			current = nil
+			used = headerTokens
+			if section.Kind == sectionWrite {
+				cost = section.Tokens + writesTokens
+			}
+		}
+		if headerTokens+cost > budget {
+			Logger.WithFields(logrus.Fields{"section": section.Name, "tokens": headerTokens + cost, "budget": budget}).Warn("Prompt section exceeds the token budget on its own")
+		}
+		current = append(current, section)
+		used += cost
+	}
+	if len(current) > 0 || len(groups) == 0 {
+		groups = append(groups, current)
+	}
+
+	prompts := make([]string, 0, len(groups))
+	for i, group := range groups {
+		var readCount int
+		for _, section := range group {
+			if section.Kind == sectionRead {
+				readCount++
+			}
+		}
+		prompt, err := slowQueryInstructions(readCount)
+		if err != nil {
+			return nil, err
+		}
+		if len(groups) > 1 {
+			note, err := chunkNote(i+1, len(groups))
+			if err != nil {
+				return nil, err
+			}
+			prompt += note
+		}
+		writesIntroduced := false
+		for _, section := range group {
+			if section.Kind == sectionWrite && !writesIntroduced {
+				prompt += writesInstructions
+				writesIntroduced = true
+			}
+			prompt += section.Text
+		}
+		prompts = append(prompts, prompt)
+	}
+	Logger.WithFields(logrus.Fields{"sections": len(sections), "prompts": len(prompts), "budget": budget}).Info("Slow query prompt built")
+	return prompts, nil
+}
+
+func hasWrites(sections []promptSection) bool {
+	for _, section := range sections {
+		if section.Kind == sectionWrite {
+			return true
+		}
+	}
+	return false
+}
+
+func chunkNote(part, parts int) (string, error) {
+	return renderPrompt(chunkNoteTemplate, ChunkNoteData{Part: part, Parts: parts})
+}
+
+// GetMergeReportsPrompt asks the LLM to merge the partial reports of a split analysis.
+func GetMergeReportsPrompt(partials []string) (string, error) {
+	return renderPrompt(mergeReportsTemplate, MergeReportsData{Partials: partials, Language: GetReportLocale().LanguageName()})
+}
+
+// concatenateReports is the fallback when the partial reports are too large to be merged by
+// the LLM.
+func concatenateReports(partials []string) string {
+	return strings.Join(partials, "\n\n---\n\n")
+}
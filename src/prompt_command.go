@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// runPromptCommand runs the "prompt" subcommand. "prompt render" prints the final prompts of a
+// run's reports, rendered with the configured templates, without calling the LLM or storing
+// anything in the run database.
+func runPromptCommand(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "render" {
+		return fmt.Errorf("usage: prompt render --run <database> [--report %s|%s]", slowQueryReport, metricsReport)
+	}
+	fs := flag.NewFlagSet("prompt render", flag.ContinueOnError)
+	run := fs.String("run", "", "run (its database name) to render the prompts of")
+	report := fs.String("report", slowQueryReport, fmt.Sprintf("report to render the prompts of: %s or %s", slowQueryReport, metricsReport))
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *run == "" {
+		return fmt.Errorf("--run is required")
+	}
+	ctx := context.Background()
+	defer DisconnectMongoClient()
+
+	var prompts []string
+	switch *report {
+	case slowQueryReport:
+		slowQueries, err := collectSlowQueryAnalysis(ctx, *run)
+		if err != nil {
+			return err
+		}
+		prompts = slowQueries.Prompts
+	case metricsReport:
+		ac, err := NewAtlasClient(nil)
+		if err != nil {
+			return err
+		}
+		metrics, err := collectMetricsAnalysis(ctx, ac, *run, false)
+		if err != nil {
+			return err
+		}
+		prompts = []string{metrics.Prompt}
+		for _, file := range metrics.Files {
+			fmt.Fprintf(out, "Attached file: %s\n", file)
+		}
+	default:
+		return fmt.Errorf("unknown report %q; use %s or %s", *report, slowQueryReport, metricsReport)
+	}
+	for i, prompt := range prompts {
+		if len(prompts) > 1 {
+			fmt.Fprintf(out, "===== Prompt %d of %d (%d tokens) =====\n", i+1, len(prompts), EstimateTokens(prompt))
+		}
+		fmt.Fprintln(out, prompt)
+	}
+	for _, gap := range GetRunSummary().Gaps(*report) {
+		fmt.Fprintf(os.Stderr, "Data gap: %s %s: %s\n", gap.Kind, gap.Subject, gap.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The prompts are text/template files. The defaults are embedded in the binary, and a file with
+// the same name in the configured promptTemplatesDir overrides its default.
+//
+//go:embed templates/*.tmpl
+var defaultPromptTemplates embed.FS
+
+// Prompt templates, and the data each of them is rendered with.
+const (
+	slowQueryInstructionsTemplate  = "slow_query_instructions.tmpl"  // SlowQueryInstructionsData
+	slowQueryShapeTemplate         = "slow_query_shape.tmpl"         // ShapePromptData
+	slowWritesInstructionsTemplate = "slow_writes_instructions.tmpl" // none
+	slowWriteShapeTemplate         = "slow_write_shape.tmpl"         // ShapePromptData
+	chunkNoteTemplate              = "chunk_note.tmpl"               // ChunkNoteData
+	mergeReportsTemplate           = "merge_reports.tmpl"            // MergeReportsData
+	metricsAnalysisTemplate        = "metrics_analysis.tmpl"         // MetricsPromptData
+	agentInstructionsTemplate      = "agent_instructions.tmpl"       // AgentInstructionsData
+	chatInstructionsTemplate       = "chat_instructions.tmpl"        // ChatPromptData
+	indexCorrectionTemplate        = "index_correction.tmpl"         // IndexCorrectionData
+	queryRoutingTemplate           = "query_routing.tmpl"            // QueryRoutingData
+	shardDistributionTemplate      = "shard_distribution.tmpl"       // ShardingData
+	queryTargetingTemplate         = "query_targeting.tmpl"          // QueryTargetingData
+	correlationTemplate            = "correlation.tmpl"              // CorrelationData
+	metricFindingsTemplate         = "metric_findings.tmpl"          // MetricFindingsData
+)
+
+// promptTemplateFuncs are the functions available to the templates, on top of the text/template
+// builtins.
+var promptTemplateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"inc":  func(i int) int { return i + 1 },
+}
+
+// SlowQueryInstructionsData is the data of the slow query instructions.
+type SlowQueryInstructionsData struct {
+	// Shapes is the number of read shapes covered by the prompt.
+	Shapes int
+	// Language is the English name of the report language, empty for English.
+	Language string
+}
+
+// ShapePromptData is the data of a read or write shape section.
+type ShapePromptData struct {
+	// Number is the shape's number in the report, starting at 1.
+	Number int
+	// Driver is the driver of the shape's slowest logged operation.
+	Driver string
+	// Shape holds the shape's stats, percentiles, hourly histogram and ranking reason, without
+	// its example operation.
+	Shape RankedShape
+	// Breakdown attributes the shape's duration to disk, lock and queue waits; its Verdict
+	// method tells whether the shape is plan-bound or saturation-bound.
+	Breakdown TimeBreakdown
+	// AntiPatterns are the rule engine hits of the shape.
+	AntiPatterns []AntiPatternPromptHit
+	// Hints are the deterministic write-path findings of a write shape.
+	Hints []string
+	// Log is the slowest operation's attributes as indented JSON, with long literals truncated.
+	Log string
+}
+
+// AntiPatternPromptHit is an anti-pattern hit along with its rule's title.
+type AntiPatternPromptHit struct {
+	AntiPatternHit
+	Title string
+}
+
+// ChunkNoteData is the data of the note added to each part of a split analysis.
+type ChunkNoteData struct {
+	Part  int
+	Parts int
+}
+
+// MergeReportsData is the data of the prompt merging the partial reports of a split analysis.
+type MergeReportsData struct {
+	Partials []string
+	// Language is the English name of the report language, empty for English.
+	Language string
+}
+
+// MetricsPromptData is the data of the metrics analysis prompt. The context sections are
+// rendered by the analyses that compute them, and are empty when they have nothing to report.
+type MetricsPromptData struct {
+	// Language is the English name of the report language, empty for English.
+	Language string
+	// RawAttached tells whether the raw measurements are attached to the prompt.
+	RawAttached bool
+	// ClusterInfo describes the cluster's tier and disk.
+	ClusterInfo string
+	// Elections lists when each node became primary.
+	Elections []string
+	// Targeting is the query targeting computed from the slow query logs.
+	Targeting string
+	// Correlation lists the windows where slow queries coincided with metric spikes.
+	Correlation string
+	// Summary is the summary table of every metric series.
+	Summary string
+	// Thresholds defines the threshold bands the findings are classified by.
+	Thresholds string
+	// Findings lists the threshold breaches and anomalies.
+	Findings string
+	// DataGaps lists the data that couldn't be collected.
+	DataGaps string
+}
+
+// AgentInstructionsData is the data of the instructions added to the prompts in agent mode.
+type AgentInstructionsData struct {
+	// MaxSteps is the number of rounds of tool calls the model can make.
+	MaxSteps int
+}
+
+// ChatPromptData is the data of the prompt seeding a chat over a completed run.
+type ChatPromptData struct {
+	// Language is the English name of the report language, empty for English.
+	Language    string
+	RunID       string
+	ClusterName string
+	WindowStart time.Time
+	WindowEnd   time.Time
+	Hosts       []string
+	// MaxSteps is the number of rounds of tool calls the model can make per question.
+	MaxSteps int
+	// Shapes holds the shape selection and time breakdown tables of the analyzed shapes.
+	Shapes string
+	// AntiPatterns, Findings and Correlations are the run's rendered report sections.
+	AntiPatterns string
+	Findings     string
+	Correlations string
+	// Reports are the reports generated for the run, truncated to fit the prompt.
+	Reports []StoredReport
+}
+
+var (
+	promptTemplates     *template.Template
+	promptTemplatesOnce sync.Once
+	promptTemplatesErr  error
+)
+
+// LoadPromptTemplates parses the embedded templates, then the overrides found in dir.
+func LoadPromptTemplates(dir string) (*template.Template, error) {
+	templates, err := template.New("prompts").Funcs(promptTemplateFuncs).Option("missingkey=error").ParseFS(defaultPromptTemplates, "templates/*.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the default prompt templates: %w", err)
+	}
+	if dir == "" {
+		return templates, nil
+	}
+	overrides, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range overrides {
+		name := filepath.Base(path)
+		if templates.Lookup(name) == nil {
+			return nil, fmt.Errorf("prompt template override %s doesn't match any prompt template", path)
+		}
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prompt template %s: %w", path, err)
+		}
+		if _, err := templates.New(name).Parse(string(text)); err != nil {
+			return nil, fmt.Errorf("failed to parse prompt template %s: %w", path, err)
+		}
+		Logger.WithField("template", path).Info("Prompt template overridden")
+	}
+	return templates, nil
+}
+
+// GetPromptTemplates returns the prompt templates, with the configured overrides.
+func GetPromptTemplates() (*template.Template, error) {
+	promptTemplatesOnce.Do(func() {
+		var dir string
+		if cfg, err := GetConfig(); err == nil {
+			dir = cfg.PromptTemplatesDir
+		}
+		promptTemplates, promptTemplatesErr = LoadPromptTemplates(dir)
+	})
+	return promptTemplates, promptTemplatesErr
+}
+
+func renderPrompt(name string, data any) (string, error) {
+	templates, err := GetPromptTemplates()
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := templates.ExecuteTemplate(&sb, name, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt template %s: %w", name, err)
+	}
+	return sb.String(), nil
+}
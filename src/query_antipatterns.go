@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	largeInArrayThreshold = 200
+	highSkipThreshold     = 1000
+	maxFragmentLength     = 240
+)
+
+type AntiPatternRule struct {
+	ID          string
+	Title       string
+	Description string
+	DocsURL     string
+}
+
+// AntiPatternRules are the rules the slow queries are checked against. AP007 is left unassigned:
+// whether the foreignField of a $lookup is indexed can't be told from the logs.
+var AntiPatternRules = []AntiPatternRule{
+	{
+		ID:          "AP001",
+		Title:       "Unanchored `$regex`",
+		Description: "Regular expressions that don't start with `^` can't use index bounds and scan every key or document.",
+		DocsURL:     "https://www.mongodb.com/docs/manual/reference/operator/query/regex/#index-use",
+	},
+	{
+		ID:          "AP002",
+		Title:       "Case-insensitive `$regex`",
+		Description: "The `i` option prevents efficient index use. Prefer a case-insensitive collation index or a normalized field.",
+		DocsURL:     "https://www.mongodb.com/docs/manual/core/index-case-insensitive/",
+	},
+	{
+		ID:          "AP003",
+		Title:       "`$where` / `$function`",
+		Description: "Server-side JavaScript is evaluated per document, can't use indexes and is deprecated.",
+		DocsURL:     "https://www.mongodb.com/docs/manual/reference/operator/query/where/",
+	},
+	{
+		ID:          "AP004",
+		Title:       "`$ne` / `$nin` on an indexed field",
+		Description: "Negation operators are rarely selective and typically scan most of the index.",
+		DocsURL:     "https://www.mongodb.com/docs/manual/core/query-optimization/#query-selectivity",
+	},
+	{
+		ID:          "AP005",
+		Title:       "Large `$in` array",
+		Description: fmt.Sprintf("`$in` arrays with more than %d values explode the number of index bounds and plan cache entries.", largeInArrayThreshold),
+		DocsURL:     "https://www.mongodb.com/docs/manual/reference/operator/query/in/",
+	},
+	{
+		ID:          "AP006",
+		Title:       "High `skip` value",
+		Description: fmt.Sprintf("Skipping more than %d documents still reads them. Prefer range-based pagination.", highSkipThreshold),
+		DocsURL:     "https://www.mongodb.com/docs/manual/reference/method/cursor.skip/#pagination-example",
+	},
+	{
+		ID:          "AP008",
+		Title:       "In-memory `SORT` stage",
+		Description: "The sort isn't provided by an index, so results are buffered and sorted in memory.",
+		DocsURL:     "https://www.mongodb.com/docs/manual/tutorial/sort-results-with-indexes/",
+	},
+	{
+		ID:          "AP009",
+		Title:       "`$group` before `$match`",
+		Description: "Filtering after grouping forces the pipeline to group every input document first.",
+		DocsURL:     "https://www.mongodb.com/docs/manual/core/aggregation-pipeline-optimization/",
+	},
+	{
+		ID:          "AP010",
+		Title:       "Unbounded `$push` update",
+		Description: "Pushing without `$slice` grows arrays without limit, which inflates documents and index entries.",
+		DocsURL:     "https://www.mongodb.com/docs/manual/reference/operator/update/slice/",
+	},
+}
+
+var ixscanPattern = regexp.MustCompile(`IXSCAN \{([^}]*)\}`)
+
+func GetAntiPatternRule(id string) (AntiPatternRule, bool) {
+	for _, r := range AntiPatternRules {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return AntiPatternRule{}, false
+}
+
+func queryCommand(attr bson.M) interface{} {
+	if cmd, ok := attr["originatingCommand"]; ok && cmd != nil {
+		return cmd
+	}
+	return attr["command"]
+}
+
+// indexedFields returns the fields of the index key patterns listed in a plan summary,
+// e.g. "IXSCAN { a: 1, b: -1 }".
+func indexedFields(planSummary string) map[string]bool {
+	fields := make(map[string]bool)
+	for _, m := range ixscanPattern.FindAllStringSubmatch(planSummary, -1) {
+		for _, part := range strings.Split(m[1], ",") {
+			field := strings.TrimSpace(strings.SplitN(part, ":", 2)[0])
+			if field != "" {
+				fields[field] = true
+			}
+		}
+	}
+	return fields
+}
+
+func commandFilters(cmd interface{}) []interface{} {
+	var filters []interface{}
+	for _, key := range []string{"filter", "query", "q"} {
+		if f, ok := docValue(cmd, key); ok {
+			filters = append(filters, f)
+		}
+	}
+	for _, key := range []string{"updates", "deletes"} {
+		if stmts, ok := docValue(cmd, key); ok {
+			items, _ := arrayElems(stmts)
+			for _, stmt := range items {
+				if f, ok := docValue(stmt, "q"); ok {
+					filters = append(filters, f)
+				}
+			}
+		}
+	}
+	for _, stage := range pipelineStages(cmd) {
+		if stage.Key == "$match" {
+			filters = append(filters, stage.Value)
+		}
+	}
+	return filters
+}
+
+func commandUpdates(cmd interface{}) []interface{} {
+	var updates []interface{}
+	for _, key := range []string{"u", "update"} {
+		if u, ok := docValue(cmd, key); ok {
+			updates = append(updates, u)
+		}
+	}
+	if stmts, ok := docValue(cmd, "updates"); ok {
+		items, _ := arrayElems(stmts)
+		for _, stmt := range items {
+			if u, ok := docValue(stmt, "u"); ok {
+				updates = append(updates, u)
+			}
+		}
+	}
+	return updates
+}
+
+// pipelineStages returns each aggregation stage as a single {stageName: spec} element.
+func pipelineStages(cmd interface{}) []bson.E {
+	raw, ok := docValue(cmd, "pipeline")
+	if !ok {
+		return nil
+	}
+	items, _ := arrayElems(raw)
+	var stages []bson.E
+	for _, item := range items {
+		elems, ok := docElems(item)
+		if ok && len(elems) > 0 {
+			stages = append(stages, elems[0])
+		}
+	}
+	return stages
+}
+
+// walkFilter visits every operator of a query filter together with the field it applies to.
+func walkFilter(filter interface{}, field string, visit func(field, op string, val interface{}, parent []bson.E)) {
+	elems, ok := docElems(filter)
+	if !ok {
+		return
+	}
+	for _, e := range elems {
+		switch {
+		case e.Key == "$and" || e.Key == "$or" || e.Key == "$nor":
+			items, _ := arrayElems(e.Value)
+			for _, item := range items {
+				walkFilter(item, "", visit)
+			}
+		case strings.HasPrefix(e.Key, "$"):
+			visit(field, e.Key, e.Value, elems)
+			if e.Key == "$not" || e.Key == "$elemMatch" {
+				walkFilter(e.Value, field, visit)
+			}
+		default:
+			path := e.Key
+			if field != "" {
+				path = field + "." + e.Key
+			}
+			if _, isDoc := docElems(e.Value); isDoc {
+				walkFilter(e.Value, path, visit)
+			}
+		}
+	}
+}
+
+// walkKeys visits every key of a document, recursing into nested documents and arrays.
+func walkKeys(v interface{}, visit func(key string, val interface{})) {
+	if elems, ok := docElems(v); ok {
+		for _, e := range elems {
+			visit(e.Key, e.Value)
+			walkKeys(e.Value, visit)
+		}
+		return
+	}
+	if items, ok := arrayElems(v); ok {
+		for _, item := range items {
+			walkKeys(item, visit)
+		}
+	}
+}
+
+func regexParts(op string, val interface{}, parent []bson.E) (string, string, bool) {
+	if op == "$regularExpression" {
+		pattern, _ := docValue(val, "pattern")
+		options, _ := docValue(val, "options")
+		p, _ := pattern.(string)
+		o, _ := options.(string)
+		return p, o, true
+	}
+	if op != "$regex" {
+		return "", "", false
+	}
+	var pattern, options string
+	if p, ok := val.(string); ok {
+		pattern = p
+	} else if re, ok := docValue(val, "$regularExpression"); ok {
+		pattern, options, _ = regexParts("$regularExpression", re, nil)
+	}
+	for _, e := range parent {
+		if e.Key == "$options" {
+			if o, ok := e.Value.(string); ok {
+				options += o
+			}
+		}
+	}
+	return pattern, options, true
+}
+
+// formatFragment formats a fragment of a command as JSON, cut to maxFragmentLength characters.
+func formatFragment(v interface{}) string {
+	js, err := bson.MarshalExtJSON(v, false, false)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	fragment := string(js)
+	if utf8.RuneCountInString(fragment) > maxFragmentLength {
+		fragment = string([]rune(fragment)[:maxFragmentLength]) + "…"
+	}
+	return fragment
+}
+
+// fieldFragment formats the condition of a filter on a field, with its literal redacted.
+func fieldFragment(field, op string, val interface{}) string {
+	return formatFragment(GetRedactor().Query(bson.D{{field, bson.D{{op, val}}}}))
+}
+
+// DetectAntiPatterns runs every anti-pattern rule against a single slow query log entry.
+func DetectAntiPatterns(sq SlowQueryEntry) []AntiPatternHit {
+	var hits []AntiPatternHit
+	queryHash, _ := sq.Attr["queryHash"].(string)
+	ns, _ := sq.Attr["ns"].(string)
+	planSummary, _ := sq.Attr["planSummary"].(string)
+	cmd := queryCommand(sq.Attr)
+	add := func(ruleID, fragment string) {
+		hits = append(hits, AntiPatternHit{
+			RuleID:      ruleID,
+			QueryHash:   queryHash,
+			Namespace:   ns,
+			Fragment:    fragment,
+			Occurrences: 1,
+			ExampleID:   sq.ID,
+		})
+	}
+	if cmd == nil {
+		return hits
+	}
+
+	indexed := indexedFields(planSummary)
+	for _, filter := range commandFilters(cmd) {
+		walkFilter(filter, "", func(field, op string, val interface{}, parent []bson.E) {
+			if pattern, options, ok := regexParts(op, val, parent); ok {
+				if !strings.HasPrefix(pattern, "^") && !strings.HasPrefix(pattern, `\A`) {
+					add("AP001", fieldFragment(field, op, val))
+				}
+				if strings.Contains(options, "i") {
+					add("AP002", fieldFragment(field, op, val))
+				}
+				return
+			}
+			switch op {
+			case "$ne", "$nin":
+				if indexed[field] {
+					add("AP004", fieldFragment(field, op, val))
+				}
+			case "$in":
+				if items, ok := arrayElems(val); ok && len(items) > largeInArrayThreshold {
+					add("AP005", fmt.Sprintf(`{"%s": {"$in": [<%d values>]}}`, field, len(items)))
+				}
+			}
+		})
+	}
+
+	walkKeys(cmd, func(key string, val interface{}) {
+		if key == "$where" || key == "$function" {
+			add("AP003", formatFragment(GetRedactor().Query(bson.D{{key, val}})))
+		}
+	})
+
+	if skip, ok := docValue(cmd, "skip"); ok {
+		if n, ok := toFloat64(skip); ok && n > highSkipThreshold {
+			add("AP006", formatFragment(bson.D{{"skip", skip}}))
+		}
+	}
+
+	seenGroup := false
+	matchedFirst := false
+	for _, stage := range pipelineStages(cmd) {
+		switch stage.Key {
+		case "$skip":
+			if n, ok := toFloat64(stage.Value); ok && n > highSkipThreshold {
+				add("AP006", formatFragment(bson.D{stage}))
+			}
+		case "$group":
+			seenGroup = true
+		case "$match":
+			if seenGroup && !matchedFirst {
+				add("AP009", formatFragment(GetRedactor().Command(bson.D{stage})))
+			}
+			matchedFirst = true
+		}
+	}
+
+	if hasSort, _ := sq.Attr["hasSortStage"].(bool); hasSort {
+		if sortSpec, ok := docValue(cmd, "sort"); ok {
+			add("AP008", formatFragment(bson.D{{"sort", sortSpec}}))
+		} else {
+			add("AP008", formatFragment(bson.D{{"planSummary", planSummary}, {"hasSortStage", true}}))
+		}
+	}
+
+	for _, update := range commandUpdates(cmd) {
+		push, ok := docValue(update, "$push")
+		if !ok {
+			continue
+		}
+		elems, _ := docElems(push)
+		for _, e := range elems {
+			_, hasEach := docValue(e.Value, "$each")
+			_, hasSlice := docValue(e.Value, "$slice")
+			if !hasEach || !hasSlice {
+				add("AP010", formatFragment(GetRedactor().Query(bson.D{{"$push", bson.D{e}}})))
+			}
+		}
+	}
+	return hits
+}
+
+// CreateQueryAntiPatterns scans every stored slow query for anti-patterns and stores the hits
+// in the queryAntiPatterns collection, one per rule and shape: the fragments of a shape only
+// differ by their literals, so the first one is kept as an example and the others counted.
+func CreateQueryAntiPatterns(ctx context.Context, dbName string) error {
+	Logger.Info("Scanning slow queries for anti-patterns")
+	byKey := make(map[string]*AntiPatternHit)
+	err := ForEachSlowQuery(ctx, dbName, func(sq SlowQueryEntry) error {
+		for _, hit := range DetectAntiPatterns(sq) {
+			key := hit.RuleID + "|" + hit.QueryHash + "|" + hit.Namespace
+			if existing, ok := byKey[key]; ok {
+				existing.Occurrences++
+				continue
+			}
+			h := hit
+			byKey[key] = &h
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var docs []interface{}
+	for _, hit := range byKey {
+		docs = append(docs, *hit)
+	}
+	Logger.WithFields(logrus.Fields{"hits": len(docs)}).Info("Query anti-pattern scan complete")
+	if len(docs) == 0 {
+		return nil
+	}
+	_, err = InsertQueryAntiPatterns(ctx, docs, dbName)
+	return err
+}
+
+func GroupAntiPatternsByHash(hits []AntiPatternHit) map[string][]AntiPatternHit {
+	grouped := make(map[string][]AntiPatternHit)
+	for _, hit := range hits {
+		grouped[hit.QueryHash] = append(grouped[hit.QueryHash], hit)
+	}
+	return grouped
+}
+
+func antiPatternAnchor(ruleID string) string {
+	return strings.ToLower(ruleID)
+}
+
+// RenderAntiPatternsSection renders the rule engine's findings as a Markdown section that
+// links each hit to its rule in the rule reference.
+func RenderAntiPatternsSection(hits []AntiPatternHit) string {
+	var sb strings.Builder
+	sb.WriteString("## Query anti-patterns\n\n")
+	if len(hits) == 0 {
+		sb.WriteString("No query anti-patterns were detected in the slow query logs.\n")
+		return sb.String()
+	}
+	sorted := make([]AntiPatternHit, len(hits))
+	copy(sorted, hits)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Occurrences != sorted[j].Occurrences {
+			return sorted[i].Occurrences > sorted[j].Occurrences
+		}
+		return sorted[i].RuleID < sorted[j].RuleID
+	})
+	sb.WriteString("| Rule | Namespace | Query hash | Occurrences | Offending fragment |\n")
+	sb.WriteString("|---|---|---|---|---|\n")
+	usedRules := make(map[string]bool)
+	for _, hit := range sorted {
+		usedRules[hit.RuleID] = true
+		sb.WriteString(fmt.Sprintf(
+			"| [%s](#%s) | %s | %s | %s | `%s` |\n",
+			hit.RuleID,
+			antiPatternAnchor(hit.RuleID),
+			hit.Namespace,
+			hit.QueryHash,
+			GetReportLocale().Sprintf("%d", hit.Occurrences),
+			strings.ReplaceAll(hit.Fragment, "|", "\\|"),
+		))
+	}
+	sb.WriteString("\n### Rule reference\n\n")
+	for _, rule := range AntiPatternRules {
+		if !usedRules[rule.ID] {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf(
+			"<a id=\"%s\"></a>**%s: %s.** %s ([docs](%s))\n\n",
+			antiPatternAnchor(rule.ID),
+			rule.ID,
+			rule.Title,
+			rule.Description,
+			rule.DocsURL,
+		))
+	}
+	return sb.String()
+}
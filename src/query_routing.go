@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Routing of a query shape's operations by the mongos routers.
+const (
+	// Every operation targeted a single shard.
+	routingTargeted = "targeted"
+	// Operations targeted several shards, but not all of them.
+	routingMultiShard = "multi-shard"
+	// Operations were sent to every shard (scatter-gather).
+	routingBroadcast = "broadcast"
+	// No operation logged the number of shards it targeted.
+	routingUnknown = "unknown"
+)
+
+// Length of the computed mongos shape keys, in hex characters.
+const routerShapeKeyLength = 16
+
+// routerShapeFields are the command fields that make up the shape of an operation logged by
+// mongos. The others (session, read and write concerns, cursor options...) don't change how
+// it's routed.
+var routerShapeFields = map[string]bool{
+	"filter": true, "query": true, "q": true, "sort": true, "projection": true, "fields": true,
+	"pipeline": true, "key": true, "updates": true, "deletes": true, "hint": true,
+}
+
+// mergeStages are the aggregation stages that can't run on the shards on their own, so that
+// they and the stages after them run on the merging mongos or shard.
+var mergeStages = map[string]bool{
+	"$group": true, "$sort": true, "$limit": true, "$skip": true, "$bucket": true, "$bucketAuto": true,
+	"$sortByCount": true, "$count": true, "$facet": true, "$lookup": true, "$graphLookup": true,
+	"$out": true, "$merge": true, "$unionWith": true, "$setWindowFields": true, "$densify": true,
+	"$fill": true, "$sample": true,
+}
+
+// IsMongosSlowQuery tells whether a slow query was logged by a mongos router, i.e. comes from a
+// mongos log. The mongod entries of a shard stay with the shard's slow queries, even when they
+// report a number of shards, as the operations that a shard routes itself do.
+func IsMongosSlowQuery(logName string) bool {
+	return logName == logMongos
+}
+
+// RouterShapeKey identifies the shape of an operation logged by mongos, which doesn't compute
+// query hashes: its namespace, command and the structure of its filter, sort, projection and
+// pipeline, with the literals left out. The server's queryShapeHash is used when logged.
+func RouterShapeKey(attr map[string]interface{}) string {
+	if hash, ok := attr["queryShapeHash"].(string); ok && hash != "" {
+		return hash
+	}
+	cmd := queryCommand(attr)
+	shape := bson.D{{"ns", attr["ns"]}}
+	if elems, ok := docElems(cmd); ok {
+		for i, e := range elems {
+			if i == 0 {
+				shape = append(shape, bson.E{Key: "command", Value: e.Key})
+			} else if routerShapeFields[e.Key] {
+				shape = append(shape, bson.E{Key: e.Key, Value: literalShape(e.Value)})
+			}
+		}
+	}
+	js, _ := json.Marshal(shape)
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:])[:routerShapeKeyLength]
+}
+
+// literalShape copies a document, keeping its keys and replacing its literals with "?". Arrays
+// of literals, such as $in lists, become a single "?" so that their length doesn't matter.
+func literalShape(v interface{}) interface{} {
+	if elems, ok := docElems(v); ok {
+		doc := make(bson.D, 0, len(elems))
+		for _, e := range elems {
+			doc = append(doc, bson.E{Key: e.Key, Value: literalShape(e.Value)})
+		}
+		return doc
+	}
+	if items, ok := arrayElems(v); ok {
+		arr := bson.A{}
+		for _, item := range items {
+			shape := literalShape(item)
+			if shape == "?" {
+				return "?"
+			}
+			arr = append(arr, shape)
+		}
+		return arr
+	}
+	return "?"
+}
+
+// MergeStages returns the stages of an aggregation that run on the merging mongos or shard,
+// from the first stage that can't run on the shards on their own.
+func MergeStages(cmd interface{}) []string {
+	var stages []string
+	for _, stage := range pipelineStages(cmd) {
+		if len(stages) > 0 || mergeStages[stage.Key] {
+			stages = append(stages, stage.Key)
+		}
+	}
+	return stages
+}
+
+// RoutedShapeID identifies a query shape logged by mongos.
+type RoutedShapeID struct {
+	Namespace string `bson:"ns" json:"ns"`
+	Shape     string `bson:"shape" json:"shape"`
+	OpType    string `bson:"opType" json:"opType"`
+}
+
+// RoutedShape is a query shape as seen by the mongos routers: how long its operations took,
+// and how many shards they targeted.
+type RoutedShape struct {
+	ID                  RoutedShapeID `bson:"_id" json:"_id"`
+	Count               int32         `bson:"count" json:"count"`
+	TotalDurationMillis float64       `bson:"totalDurationMillis" json:"totalDurationMillis"`
+	AvgDurationMillis   float64       `bson:"avgDurationMillis" json:"avgDurationMillis"`
+	MaxDurationMillis   float64       `bson:"maxDurationMillis" json:"maxDurationMillis"`
+	AvgNShards          float64       `bson:"avgNShards" json:"avgNShards"`
+	MinNShards          float64       `bson:"minNShards" json:"minNShards"`
+	MaxNShards          float64       `bson:"maxNShards" json:"maxNShards"`
+	TargetedCount       int32         `bson:"targetedCount" json:"targetedCount"`
+	// UnknownCount counts the operations that didn't log the number of shards they targeted,
+	// which the other shard counts leave out.
+	UnknownCount int32          `bson:"unknownCount" json:"unknownCount"`
+	Example      SlowQueryEntry `bson:"example" json:"example"`
+}
+
+// Routing classifies the shape's operations on a cluster of the given number of shards as
+// targeted, multi-shard or broadcast, from the operations that logged their number of shards.
+func (s RoutedShape) Routing(shards int) string {
+	switch {
+	case s.UnknownCount >= s.Count:
+		return routingUnknown
+	case s.MaxNShards <= 1:
+		return routingTargeted
+	case shards > 1 && s.MinNShards >= float64(shards):
+		return routingBroadcast
+	}
+	return routingMultiShard
+}
+
+// shardCount returns the cluster's number of shards or, when it's unknown, the most shards an
+// operation targeted in the logs, so that operations targeting all of them count as broadcast.
+func shardCount(shapes []RoutedShape, shards int) int {
+	if shards > 0 {
+		return shards
+	}
+	for _, s := range shapes {
+		shards = max(shards, int(s.MaxNShards))
+	}
+	return shards
+}
+
+// FilterFields returns the fields the shape's example filters on, which a shard key needs to
+// include for mongos to target the operation.
+func (s RoutedShape) FilterFields() []string {
+	return queryFilterFields(s.Example.Attr)
+}
+
+// CreateMongosQueryShapes groups the slow queries logged by mongos by shape into the
+// mongosQueryShapes collection. It's a no-op for replica sets, which have no mongos logs.
+func CreateMongosQueryShapes(ctx context.Context, dbName string) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(dbName).Collection("mongosSlowQueries")
+	// Operations without nShards are left out of the shard counts rather than counted as
+	// targeted: $avg, $min and $max ignore the missing values.
+	known := bson.D{{"$isNumber", "$attr.nShards"}}
+	pipeline := mongo.Pipeline{
+		{{"$sort", bson.D{{"attr.durationMillis", -1}}}},
+		{{"$group", bson.D{
+			{"_id", bson.D{
+				{"ns", "$attr.ns"},
+				{"shape", "$shapeKey"},
+				{"opType", bson.D{{"$ifNull", bson.A{"$opType", opRead}}}},
+			}},
+			{"count", bson.D{{"$sum", 1}}},
+			{"totalDurationMillis", bson.D{{"$sum", "$attr.durationMillis"}}},
+			{"avgDurationMillis", bson.D{{"$avg", "$attr.durationMillis"}}},
+			{"maxDurationMillis", bson.D{{"$max", "$attr.durationMillis"}}},
+			{"avgNShards", bson.D{{"$avg", "$attr.nShards"}}},
+			{"minNShards", bson.D{{"$min", "$attr.nShards"}}},
+			{"maxNShards", bson.D{{"$max", "$attr.nShards"}}},
+			{"targetedCount", bson.D{{"$sum", bson.D{{"$cond", bson.A{
+				bson.D{{"$and", bson.A{known, bson.D{{"$lte", bson.A{"$attr.nShards", 1}}}}}}, 1, 0,
+			}}}}}},
+			{"unknownCount", bson.D{{"$sum", bson.D{{"$cond", bson.A{known, 0, 1}}}}}},
+			{"example", bson.D{{"$first", "$$ROOT"}}},
+		}}},
+		{{"$out", bson.D{
+			{"db", dbName},
+			{"coll", "mongosQueryShapes"},
+		}}},
+	}
+	if _, err := collection.Aggregate(ctx, pipeline); err != nil {
+		Logger.Error(err)
+		return err
+	}
+	return nil
+}
+
+// RoutingSummary counts the mongos query shapes of each routing.
+func RoutingSummary(shapes []RoutedShape, shards int) map[string]int {
+	counts := make(map[string]int)
+	for _, s := range shapes {
+		counts[s.Routing(shards)]++
+	}
+	return counts
+}
+
+// RoutingPromptShape is a mongos query shape as described in the slow query prompt.
+type RoutingPromptShape struct {
+	RoutedShape
+	Routing      string
+	FilterFields []string
+	MergeStages  []string
+	// ShardKey is the shard key of the shape's collection, when the shard distribution was read.
+	ShardKey string
+	// Log is the slowest operation's attributes as indented JSON, with its literals redacted
+	// and truncated.
+	Log string
+}
+
+// QueryRoutingData is the data of the query routing section of the slow query prompt.
+type QueryRoutingData struct {
+	// Shards is the number of shards of the cluster or, when it's unknown, the most shards an
+	// operation targeted.
+	Shards int
+	// Targeted, MultiShard and Broadcast count the mongos query shapes of each routing, and
+	// Unknown the shapes whose operations didn't log their number of shards.
+	Targeted   int
+	MultiShard int
+	Broadcast  int
+	Unknown    int
+	// Shapes are the slowest multi-shard and broadcast shapes.
+	Shapes []RoutingPromptShape
+}
+
+// GetQueryRoutingContext renders the query routing section of the slow query prompt, with
+// the topN slowest shapes that aren't targeted, and their shard keys when dist isn't nil. It's
+// empty when no mongos slow query was logged.
+func GetQueryRoutingContext(shapes []RoutedShape, shards int, dist *ShardDistribution, topN int) (string, error) {
+	if len(shapes) == 0 {
+		return "", nil
+	}
+	shards = shardCount(shapes, shards)
+	counts := RoutingSummary(shapes, shards)
+	data := QueryRoutingData{
+		Shards:     shards,
+		Targeted:   counts[routingTargeted],
+		MultiShard: counts[routingMultiShard],
+		Broadcast:  counts[routingBroadcast],
+		Unknown:    counts[routingUnknown],
+	}
+	for _, s := range sortedByTotalDuration(shapes) {
+		if len(data.Shapes) >= topN {
+			break
+		}
+		routing := s.Routing(shards)
+		if routing == routingTargeted || routing == routingUnknown {
+			continue
+		}
+		log, err := shapeLog(s.Example)
+		if err != nil {
+			return "", err
+		}
+		shape := RoutingPromptShape{
+			RoutedShape:  s,
+			Routing:      routing,
+			FilterFields: s.FilterFields(),
+			MergeStages:  MergeStages(queryCommand(s.Example.Attr)),
+			Log:          log,
+		}
+		if coll := dist.Collection(s.ID.Namespace); coll != nil {
+			shape.ShardKey = coll.KeyPattern()
+		}
+		data.Shapes = append(data.Shapes, shape)
+	}
+	return renderPrompt(queryRoutingTemplate, data)
+}
+
+func sortedByTotalDuration(shapes []RoutedShape) []RoutedShape {
+	sorted := make([]RoutedShape, len(shapes))
+	copy(sorted, shapes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].TotalDurationMillis > sorted[j].TotalDurationMillis
+	})
+	return sorted
+}
+
+// RenderQueryRoutingSection lists how the mongos routers routed the slowest query shapes.
+func RenderQueryRoutingSection(shapes []RoutedShape, shards int, topN int) string {
+	if len(shapes) == 0 {
+		return ""
+	}
+	locale := GetReportLocale()
+	known := shards > 0
+	shards = shardCount(shapes, shards)
+	counts := RoutingSummary(shapes, shards)
+	var sb strings.Builder
+	sb.WriteString("## Query routing\n\n")
+	fmt.Fprintf(&sb, "The mongos routers logged %s slow query shapes: %s targeted a single shard, %s several shards, and %s were broadcast to every shard",
+		locale.Sprintf("%d", len(shapes)),
+		locale.Sprintf("%d", counts[routingTargeted]),
+		locale.Sprintf("%d", counts[routingMultiShard]),
+		locale.Sprintf("%d", counts[routingBroadcast]))
+	if known {
+		fmt.Fprintf(&sb, " of the cluster's %s shards", locale.Sprintf("%d", shards))
+	}
+	sb.WriteString(".")
+	if counts[routingUnknown] > 0 {
+		fmt.Fprintf(&sb, " The routing of %s shapes is unknown, as their operations didn't log the shards they targeted.",
+			locale.Sprintf("%d", counts[routingUnknown]))
+	}
+	sb.WriteString("\n\n")
+	sb.WriteString("| Namespace | Operation | Shape | Routing | Operations | Shards per operation (avg / max) | Avg duration (ms) | Max duration (ms) | Filter fields | Merge stages |\n")
+	sb.WriteString("|---|---|---|---|---|---|---|---|---|---|\n")
+	for i, s := range sortedByTotalDuration(shapes) {
+		if i >= topN {
+			break
+		}
+		fields := strings.Join(s.FilterFields(), ", ")
+		if fields == "" {
+			fields = "-"
+		}
+		merge := strings.Join(MergeStages(queryCommand(s.Example.Attr)), " → ")
+		if merge == "" {
+			merge = "-"
+		}
+		routing := s.Routing(shards)
+		nShards := "-"
+		if routing != routingUnknown {
+			nShards = locale.Number(s.AvgNShards, 1) + " / " + locale.Number(s.MaxNShards, 0)
+		}
+		fmt.Fprintf(&sb, "| %s | %s | %s | %s | %s | %s | %s | %s | %s | %s |\n",
+			s.ID.Namespace, s.ID.OpType, s.ID.Shape, routing,
+			locale.Sprintf("%d", s.Count),
+			nShards,
+			locale.Number(s.AvgDurationMillis, 0), locale.Number(s.MaxDurationMillis, 0),
+			fields, merge)
+	}
+	return sb.String()
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// percentileSpec describes a percentile distribution computed while grouping slow queries.
+// The output fields are named after the level and the field, e.g. p95ScannedPerReturned.
+type percentileSpec struct {
+	Field  string
+	Input  interface{}
+	Levels []float64
+}
+
+// maxPercentileSamples is how many values of a group the percentiles are computed from on
+// output stores without $percentile, so that the group and its output document stay bounded.
+const maxPercentileSamples = 10000
+
+// percentileSampleKey is the random key the values of a group are sampled by.
+const percentileSampleKey = "_percentileSample"
+
+func percentileFieldName(level float64, field string) string {
+	return fmt.Sprintf("p%d%s", int(math.Round(level*100)), field)
+}
+
+// percentileAccumulators returns the $group accumulators for the given specs. Output stores on
+// 7.0+ compute the percentiles natively with $percentile, older ones (5.2+, see
+// CheckOutputStoreVersion) collect a random sample of at most maxPercentileSamples values,
+// keyed by percentileSampleStages, so that finalizePercentiles can compute them in Go.
+func percentileAccumulators(specs []percentileSpec, native bool) bson.D {
+	var acc bson.D
+	for _, spec := range specs {
+		if native {
+			levels := bson.A{}
+			for _, l := range spec.Levels {
+				levels = append(levels, l)
+			}
+			acc = append(acc, bson.E{Key: "_pct" + spec.Field, Value: bson.D{
+				{"$percentile", bson.D{
+					{"input", spec.Input},
+					{"p", levels},
+					{"method", "approximate"},
+				}},
+			}})
+		} else {
+			acc = append(acc, bson.E{Key: "_values" + spec.Field, Value: bson.D{
+				{"$topN", bson.D{
+					{"n", maxPercentileSamples},
+					{"sortBy", bson.D{{percentileSampleKey, 1}}},
+					{"output", spec.Input},
+				}},
+			}})
+		}
+	}
+	return acc
+}
+
+// percentileSampleStages returns the stage giving every document the random key its values are
+// sampled by, before the $group. They're a no-op when the percentiles are computed natively.
+func percentileSampleStages(native bool) []bson.D {
+	if native {
+		return nil
+	}
+	return []bson.D{{{"$set", bson.D{{percentileSampleKey, bson.D{{"$rand", bson.D{}}}}}}}}
+}
+
+// percentileStages returns the stages that turn the native $percentile arrays into one field
+// per level. They're a no-op when the percentiles are computed in Go.
+func percentileStages(specs []percentileSpec, native bool) []bson.D {
+	if !native || len(specs) == 0 {
+		return nil
+	}
+	var set bson.D
+	var unset bson.A
+	for _, spec := range specs {
+		for i, l := range spec.Levels {
+			set = append(set, bson.E{Key: percentileFieldName(l, spec.Field), Value: bson.D{
+				{"$arrayElemAt", bson.A{"$_pct" + spec.Field, i}},
+			}})
+		}
+		unset = append(unset, "_pct"+spec.Field)
+	}
+	return []bson.D{
+		{{"$set", set}},
+		{{"$unset", unset}},
+	}
+}
+
+// finalizePercentiles computes the percentiles of the raw values collected by
+// percentileAccumulators on output stores that don't support $percentile.
+func finalizePercentiles(ctx context.Context, coll *mongo.Collection, specs []percentileSpec) error {
+	projection := bson.D{}
+	for _, spec := range specs {
+		projection = append(projection, bson.E{Key: "_values" + spec.Field, Value: 1})
+	}
+	cursor, err := coll.Find(ctx, bson.D{}, options.Find().SetProjection(projection))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	var models []mongo.WriteModel
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		var id interface{}
+		set := bson.D{}
+		unset := bson.D{}
+		for _, e := range doc {
+			if e.Key == "_id" {
+				id = e.Value
+			}
+		}
+		for _, spec := range specs {
+			raw, _ := docValue(doc, "_values"+spec.Field)
+			items, _ := arrayElems(raw)
+			values := make([]float64, 0, len(items))
+			for _, item := range items {
+				if f, ok := toFloat64(item); ok {
+					values = append(values, f)
+				}
+			}
+			sort.Float64s(values)
+			for _, l := range spec.Levels {
+				set = append(set, bson.E{Key: percentileFieldName(l, spec.Field), Value: Percentile(values, l)})
+			}
+			unset = append(unset, bson.E{Key: "_values" + spec.Field, Value: ""})
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{"_id", id}}).
+			SetUpdate(bson.D{{"$set", set}, {"$unset", unset}}))
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	Logger.WithFields(logrus.Fields{"coll": coll.Name(), "docs": len(models)}).Info("Computing percentiles in Go")
+	_, err = coll.BulkWrite(ctx, models)
+	return err
+}
+
+// Percentile returns the nearest-rank percentile of an ascending slice of values.
+func Percentile(sorted []float64, level float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(level*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// ratioExpr divides two slow query attributes, treating missing values as zero and a zero
+// denominator as one so that a query examining keys but returning nothing is still ranked.
+func ratioExpr(numerator, denominator string) bson.D {
+	return bson.D{
+		{"$divide", bson.A{
+			bson.D{{"$ifNull", bson.A{numerator, 0}}},
+			bson.D{{"$max", bson.A{bson.D{{"$ifNull", bson.A{denominator, 0}}}, 1}}},
+		}},
+	}
+}
+
+var targetingPercentileLevels = []float64{0.5, 0.95}
+
+func targetingPercentileSpecs() []percentileSpec {
+	return []percentileSpec{
+		{Field: "ScannedPerReturned", Input: "$scannedPerReturned", Levels: targetingPercentileLevels},
+		{Field: "ScannedObjectsPerReturned", Input: "$scannedObjectsPerReturned", Levels: targetingPercentileLevels},
+	}
+}
+
+var durationPercentileLevels = []float64{0.5, 0.9, 0.99}
+
+func durationPercentileSpecs() []percentileSpec {
+	return []percentileSpec{
+		{Field: "DurationMillis", Input: "$attr.durationMillis", Levels: durationPercentileLevels},
+	}
+}
+
+// shapePercentileSpecs are all the percentile distributions computed per query shape.
+func shapePercentileSpecs() []percentileSpec {
+	return append(targetingPercentileSpecs(), durationPercentileSpecs()...)
+}
+
+// targetingFields are the per-entry query targeting ratios, added before grouping.
+func targetingFields() bson.D {
+	return bson.D{
+		{"scannedPerReturned", ratioExpr("$attr.keysExamined", "$attr.nreturned")},
+		{"scannedObjectsPerReturned", ratioExpr("$attr.docsExamined", "$attr.nreturned")},
+	}
+}
+
+// targetingAccumulators are the $group accumulators shared by the shape and namespace
+// targeting aggregations.
+func targetingAccumulators(native bool) bson.D {
+	acc := bson.D{
+		{"totalKeysExamined", bson.D{{"$sum", "$attr.keysExamined"}}},
+		{"totalDocsExamined", bson.D{{"$sum", "$attr.docsExamined"}}},
+		{"totalNReturned", bson.D{{"$sum", "$attr.nreturned"}}},
+		{"maxScannedPerReturned", bson.D{{"$max", "$scannedPerReturned"}}},
+		{"maxScannedObjectsPerReturned", bson.D{{"$max", "$scannedObjectsPerReturned"}}},
+	}
+	return append(acc, percentileAccumulators(targetingPercentileSpecs(), native)...)
+}
+
+// targetingRatioStage computes the overall ratios of a group from its totals.
+func targetingRatioStage() bson.D {
+	return bson.D{
+		{"$set", bson.D{
+			{"scannedPerReturned", ratioExpr("$totalKeysExamined", "$totalNReturned")},
+			{"scannedObjectsPerReturned", ratioExpr("$totalDocsExamined", "$totalNReturned")},
+		}},
+	}
+}
+
+// CreateSlowQueryTargetingByNamespace aggregates the query targeting ratios of all slow
+// queries per namespace.
+func CreateSlowQueryTargetingByNamespace(ctx context.Context, dbName string) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	native, err := SupportsPercentile(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(dbName).Collection("slowQueries")
+	group := bson.D{{"_id", "$attr.ns"}, {"count", bson.D{{"$sum", 1}}}}
+	group = append(group, targetingAccumulators(native)...)
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"attr.ns", bson.D{{"$exists", true}}}}}},
+		{{"$addFields", targetingFields()}},
+	}
+	pipeline = append(pipeline, percentileSampleStages(native)...)
+	pipeline = append(pipeline, bson.D{{"$group", group}}, targetingRatioStage())
+	pipeline = append(pipeline, percentileStages(targetingPercentileSpecs(), native)...)
+	pipeline = append(pipeline, bson.D{
+		{"$out", bson.D{
+			{"db", dbName},
+			{"coll", "slowQueryTargetingByNamespace"},
+		}},
+	})
+	_, err = collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		Logger.Error(err)
+		return err
+	}
+	if !native {
+		return finalizePercentiles(ctx, client.Database(dbName).Collection("slowQueryTargetingByNamespace"), targetingPercentileSpecs())
+	}
+	return nil
+}
+
+// CreateSlowQueryHistograms buckets the slow queries of every query shape by hour and merges
+// the resulting histogram into the shape's slowQueriesByDriver document.
+func CreateSlowQueryHistograms(ctx context.Context, dbName string) error {
+	client, err := GetMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	collection := client.Database(dbName).Collection("slowQueries")
+	pipeline := slowQueryShapeStages()
+	pipeline = append(pipeline,
+		bson.D{{"$group", bson.D{
+			{"_id", bson.D{
+				{"shape", shapeID()},
+				{"hour", bson.D{{"$dateTrunc", bson.D{{"date", "$t.date"}, {"unit", "hour"}}}}},
+			}},
+			{"count", bson.D{{"$sum", 1}}},
+			{"totalDurationMillis", bson.D{{"$sum", "$attr.durationMillis"}}},
+			{"avgDurationMillis", bson.D{{"$avg", "$attr.durationMillis"}}},
+			{"maxDurationMillis", bson.D{{"$max", "$attr.durationMillis"}}},
+		}}},
+		bson.D{{"$sort", bson.D{{"_id.hour", 1}}}},
+		bson.D{{"$group", bson.D{
+			{"_id", "$_id.shape"},
+			{"hourly", bson.D{{"$push", bson.D{
+				{"hour", "$_id.hour"},
+				{"count", "$count"},
+				{"totalDurationMillis", "$totalDurationMillis"},
+				{"avgDurationMillis", "$avgDurationMillis"},
+				{"maxDurationMillis", "$maxDurationMillis"},
+			}}}},
+		}}},
+		bson.D{{"$merge", bson.D{
+			{"into", bson.D{{"db", dbName}, {"coll", "slowQueriesByDriver"}}},
+			{"on", "_id"},
+			{"whenMatched", "merge"},
+			{"whenNotMatched", "discard"},
+		}}},
+	)
+	_, err = collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		Logger.Error(err)
+	}
+	return err
+}
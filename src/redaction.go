@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Redaction modes of the query literals.
+const (
+	// Keep the literals.
+	redactNone = "none"
+	// Replace the literals with a hash of their value, so that equal values can still be told apart.
+	redactHash = "hash"
+	// Replace the literals with their type, e.g. <string>.
+	redactPlaceholder = "placeholder"
+	// Keep the literals of the allowed fields, and replace the others with their type.
+	redactAllowList = "allowList"
+)
+
+// Length of the hashes replacing the literals in hash mode, in hex characters.
+const redactionHashLength = 12
+
+// redactedDataKeys are the command fields holding user data: query filters, updates, inserted
+// documents and the pipeline stages that embed them. Their literals are redacted, while the
+// rest of the command (sort, projection, limits, plan stats...) is kept as is. Scalar values
+// are command names, such as the collection of {update: "orders"}, and are kept too.
+var redactedDataKeys = map[string]bool{
+	"filter": true, "query": true, "q": true, "u": true, "update": true, "documents": true, "let": true,
+	"$match": true, "$set": true, "$addFields": true, "$replaceWith": true, "$replaceRoot": true,
+}
+
+// redactedStringKeys are strings of a slow query log that can quote user data, such as the
+// duplicate key of an E11000 error.
+var redactedStringKeys = map[string]bool{"errMsg": true}
+
+// structuralOperators are query operators whose argument describes the query rather than the
+// data, and is never redacted.
+var structuralOperators = map[string]bool{"$exists": true, "$type": true, "$options": true, "$meta": true}
+
+// extJSONTypes are the Extended JSON wrappers of typed literals, and the type they're redacted as.
+var extJSONTypes = map[string]string{
+	"$oid": "objectId", "$date": "date", "$numberLong": "number", "$numberInt": "number",
+	"$numberDouble": "number", "$numberDecimal": "number", "$binary": "binData", "$uuid": "binData",
+	"$regularExpression": "regex", "$timestamp": "timestamp",
+}
+
+type RedactionRule struct {
+	// Path is a field path pattern, matched with path.Match: "customer.email", "*.email".
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+}
+
+type RedactionConfig struct {
+	Mode string `json:"mode"`
+	// Rules override the mode for the fields they match; the first matching rule applies.
+	Rules []RedactionRule `json:"rules"`
+	// AllowedFields are the field path patterns whose literals are kept in allowList mode.
+	AllowedFields []string `json:"allowedFields"`
+	// HashSalt is prepended to the literals before hashing them, so that common values
+	// can't be recovered from their hash.
+	HashSalt string `json:"hashSalt"`
+}
+
+// Redactor redacts the literals of query examples before they're sent to the LLM or written
+// to a report. Literals are matched by their field path in the collection's documents, i.e.
+// without the command field and operators around them: the email of
+// {filter: {$or: [{"customer.email": {$eq: "a@b.c"}}]}} is at customer.email.
+type Redactor struct {
+	RedactionConfig
+}
+
+func NewRedactor(rc RedactionConfig) (*Redactor, error) {
+	if rc.Mode == "" {
+		rc.Mode = redactNone
+	}
+	if !isRedactionMode(rc.Mode) {
+		return nil, fmt.Errorf("unknown redaction mode %q, expected %s, %s, %s or %s", rc.Mode, redactNone, redactHash, redactPlaceholder, redactAllowList)
+	}
+	for _, rule := range rc.Rules {
+		if rule.Mode == redactAllowList || !isRedactionMode(rule.Mode) {
+			return nil, fmt.Errorf("invalid redaction mode %q for field %q, expected %s, %s or %s", rule.Mode, rule.Path, redactNone, redactHash, redactPlaceholder)
+		}
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return nil, fmt.Errorf("invalid redaction field pattern %q: %w", rule.Path, err)
+		}
+	}
+	for _, field := range rc.AllowedFields {
+		if _, err := path.Match(field, ""); err != nil {
+			return nil, fmt.Errorf("invalid allowed field pattern %q: %w", field, err)
+		}
+	}
+	return &Redactor{RedactionConfig: rc}, nil
+}
+
+func isRedactionMode(mode string) bool {
+	switch mode {
+	case redactNone, redactHash, redactPlaceholder, redactAllowList:
+		return true
+	}
+	return false
+}
+
+var (
+	redactor     *Redactor
+	redactorOnce sync.Once
+)
+
+// GetRedactor returns the configured redactor. An invalid configuration is rejected at
+// startup, so it falls back to redacting every literal rather than none of them.
+func GetRedactor() *Redactor {
+	redactorOnce.Do(func() {
+		if cfg, err := GetConfig(); err == nil {
+			r, err := NewRedactor(cfg.Redaction)
+			if err == nil {
+				redactor = r
+				return
+			}
+			Logger.Warn(err)
+		}
+		redactor, _ = NewRedactor(RedactionConfig{Mode: redactPlaceholder})
+	})
+	return redactor
+}
+
+// fieldMode returns the redaction mode of the literals of a field path.
+func (r *Redactor) fieldMode(field string) string {
+	for _, rule := range r.Rules {
+		if ok, _ := path.Match(rule.Path, field); ok {
+			return rule.Mode
+		}
+	}
+	if r.Mode != redactAllowList {
+		return r.Mode
+	}
+	for _, allowed := range r.AllowedFields {
+		if ok, _ := path.Match(allowed, field); ok {
+			return redactNone
+		}
+	}
+	return redactPlaceholder
+}
+
+// Disabled tells whether the redactor keeps every literal.
+func (r *Redactor) Disabled() bool {
+	if r.Mode != redactNone {
+		return false
+	}
+	for _, rule := range r.Rules {
+		if rule.Mode != redactNone {
+			return false
+		}
+	}
+	return true
+}
+
+// Command copies a slow query log entry's attributes, a command or any document embedding
+// them, with the literals of their data fields redacted.
+func (r *Redactor) Command(v interface{}) interface{} {
+	if r.Disabled() {
+		return v
+	}
+	return r.command(v)
+}
+
+func (r *Redactor) command(v interface{}) interface{} {
+	if elems, ok := docElems(v); ok {
+		doc := make(bson.D, 0, len(elems))
+		for _, e := range elems {
+			_, isDoc := docElems(e.Value)
+			_, isArray := arrayElems(e.Value)
+			switch {
+			case redactedDataKeys[e.Key] && (isDoc || isArray):
+				doc = append(doc, bson.E{Key: e.Key, Value: r.data(e.Value, "")})
+			case redactedStringKeys[e.Key]:
+				doc = append(doc, bson.E{Key: e.Key, Value: r.literal(e.Value, r.Mode)})
+			default:
+				doc = append(doc, bson.E{Key: e.Key, Value: r.command(e.Value)})
+			}
+		}
+		return doc
+	}
+	if items, ok := arrayElems(v); ok {
+		arr := make(bson.A, 0, len(items))
+		for _, item := range items {
+			arr = append(arr, r.command(item))
+		}
+		return arr
+	}
+	return v
+}
+
+// Query copies a query filter, update or document with its literals redacted.
+func (r *Redactor) Query(v interface{}) interface{} {
+	if r.Disabled() {
+		return v
+	}
+	return r.data(v, "")
+}
+
+func (r *Redactor) data(v interface{}, field string) interface{} {
+	if elems, ok := docElems(v); ok {
+		if len(elems) == 1 && extJSONTypes[elems[0].Key] != "" {
+			return r.literal(v, r.fieldMode(field))
+		}
+		doc := make(bson.D, 0, len(elems))
+		for _, e := range elems {
+			switch {
+			case structuralOperators[e.Key]:
+				doc = append(doc, e)
+			case strings.HasPrefix(e.Key, "$"):
+				doc = append(doc, bson.E{Key: e.Key, Value: r.data(e.Value, field)})
+			default:
+				sub := e.Key
+				if field != "" {
+					sub = field + "." + e.Key
+				}
+				doc = append(doc, bson.E{Key: e.Key, Value: r.data(e.Value, sub)})
+			}
+		}
+		return doc
+	}
+	if items, ok := arrayElems(v); ok {
+		arr := make(bson.A, 0, len(items))
+		for _, item := range items {
+			arr = append(arr, r.data(item, field))
+		}
+		return arr
+	}
+	if v == nil {
+		return nil
+	}
+	return r.literal(v, r.fieldMode(field))
+}
+
+// literal redacts a single value.
+func (r *Redactor) literal(v interface{}, mode string) interface{} {
+	switch mode {
+	case redactHash:
+		js, _ := json.Marshal(v)
+		sum := sha256.Sum256([]byte(r.HashSalt + "\x00" + string(js)))
+		return fmt.Sprintf("<%s:%s>", literalType(v), hex.EncodeToString(sum[:])[:redactionHashLength])
+	case redactPlaceholder, redactAllowList:
+		return "<" + literalType(v) + ">"
+	}
+	return v
+}
+
+// literalType names the BSON type of a literal, as decoded from the logs or the run database.
+func literalType(v interface{}) string {
+	if elems, ok := docElems(v); ok && len(elems) == 1 {
+		if t := extJSONTypes[elems[0].Key]; t != "" {
+			return t
+		}
+	}
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int, int32, int64, float64, bson.Decimal128:
+		return "number"
+	case bson.DateTime:
+		return "date"
+	case bson.ObjectID:
+		return "objectId"
+	case bson.Binary:
+		return "binData"
+	case bson.Regex:
+		return "regex"
+	case bson.Timestamp:
+		return "timestamp"
+	}
+	return "value"
+}
+
+// Describe says how the literals were redacted, for the report header.
+func (r *Redactor) Describe() string {
+	var desc string
+	switch r.Mode {
+	case redactNone:
+		desc = "kept as logged"
+	case redactHash:
+		desc = "replaced with their type and a hash of their value, e.g. `<string:3f2a9c1b0d2e>`"
+	case redactPlaceholder:
+		desc = "replaced with their type, e.g. `<string>`"
+	case redactAllowList:
+		desc = fmt.Sprintf("kept for %s, and replaced with their type elsewhere", strings.Join(r.AllowedFields, ", "))
+		if len(r.AllowedFields) == 0 {
+			desc = "replaced with their type, e.g. `<string>`, as no field is allowed"
+		}
+	}
+	if len(r.Rules) > 0 {
+		var rules []string
+		for _, rule := range r.Rules {
+			rules = append(rules, fmt.Sprintf("%s: %s", rule.Path, rule.Mode))
+		}
+		desc += fmt.Sprintf(", except for %s", strings.Join(rules, ", "))
+	}
+	return desc
+}
+
+// RenderRedactionHeader records at the top of a report how the query literals it was
+// generated from were redacted.
+func RenderRedactionHeader() string {
+	r := GetRedactor()
+	return fmt.Sprintf("> Query literals: redaction mode `%s`; literals %s.\n\n", r.Mode, r.Describe())
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestRedactorCommand(t *testing.T) {
+	// An update command, whose filters and updates are in its updates array.
+	update := bson.D{
+		{"type", "command"},
+		{"command", bson.D{
+			{"update", "orders"},
+			{"updates", bson.A{bson.D{
+				{"q", bson.D{{"email", "a@b.c"}, {"status", "active"}}},
+				{"u", bson.D{{"$set", bson.D{{"name", "Ann"}}}}},
+				{"upsert", true},
+			}}},
+		}},
+	}
+	// A getMore, whose filter is in the command of the cursor it continues.
+	getMore := bson.D{
+		{"command", bson.D{{"getMore", int64(42)}, {"collection", "orders"}}},
+		{"originatingCommand", bson.D{
+			{"find", "orders"},
+			{"filter", bson.D{{"email", "a@b.c"}, {"age", bson.D{{"$gt", 30}}}}},
+			{"limit", 10},
+		}},
+	}
+	// A filter comparing fields in an aggregation expression.
+	expr := bson.D{
+		{"command", bson.D{
+			{"find", "orders"},
+			{"filter", bson.D{
+				{"$expr", bson.D{{"$eq", bson.A{"$email", "a@b.c"}}}},
+				{"tags", bson.D{{"$exists", true}}},
+			}},
+		}},
+	}
+	// A duplicate key error, whose message quotes the key.
+	duplicateKey := bson.D{
+		{"errMsg", `E11000 duplicate key error dup key: { email: "a@b.c" }`},
+		{"durationMillis", 120},
+	}
+
+	none := RedactionConfig{Mode: redactNone}
+	hash := RedactionConfig{Mode: redactHash, HashSalt: "s"}
+	placeholder := RedactionConfig{Mode: redactPlaceholder}
+	allowList := RedactionConfig{Mode: redactAllowList, AllowedFields: []string{"status", "age"}}
+	rule := RedactionConfig{Mode: redactPlaceholder, Rules: []RedactionRule{{Path: "email", Mode: redactHash}}}
+
+	tests := []struct {
+		name   string
+		config RedactionConfig
+		attr   bson.D
+		want   string
+	}{
+		{
+			name:   "updates none",
+			config: none,
+			attr:   update,
+			want:   `{"type":"command","command":{"update":"orders","updates":[{"q":{"email":"a@b.c","status":"active"},"u":{"$set":{"name":"Ann"}},"upsert":true}]}}`,
+		},
+		{
+			name:   "updates hash",
+			config: hash,
+			attr:   update,
+			want:   `{"type":"command","command":{"update":"orders","updates":[{"q":{"email":"<string:335539325cbe>","status":"<string:97a5b0a3982c>"},"u":{"$set":{"name":"<string:4d73d0263a54>"}},"upsert":true}]}}`,
+		},
+		{
+			name:   "updates placeholder",
+			config: placeholder,
+			attr:   update,
+			want:   `{"type":"command","command":{"update":"orders","updates":[{"q":{"email":"<string>","status":"<string>"},"u":{"$set":{"name":"<string>"}},"upsert":true}]}}`,
+		},
+		{
+			name:   "updates allowList",
+			config: allowList,
+			attr:   update,
+			want:   `{"type":"command","command":{"update":"orders","updates":[{"q":{"email":"<string>","status":"active"},"u":{"$set":{"name":"<string>"}},"upsert":true}]}}`,
+		},
+		{
+			name:   "updates rule",
+			config: rule,
+			attr:   update,
+			want:   `{"type":"command","command":{"update":"orders","updates":[{"q":{"email":"<string:99f369b22437>","status":"<string>"},"u":{"$set":{"name":"<string>"}},"upsert":true}]}}`,
+		},
+		{
+			name:   "originatingCommand none",
+			config: none,
+			attr:   getMore,
+			want:   `{"command":{"getMore":42,"collection":"orders"},"originatingCommand":{"find":"orders","filter":{"email":"a@b.c","age":{"$gt":30}},"limit":10}}`,
+		},
+		{
+			name:   "originatingCommand hash",
+			config: hash,
+			attr:   getMore,
+			want:   `{"command":{"getMore":42,"collection":"orders"},"originatingCommand":{"find":"orders","filter":{"email":"<string:335539325cbe>","age":{"$gt":"<number:2b1a3522a794>"}},"limit":10}}`,
+		},
+		{
+			name:   "originatingCommand placeholder",
+			config: placeholder,
+			attr:   getMore,
+			want:   `{"command":{"getMore":42,"collection":"orders"},"originatingCommand":{"find":"orders","filter":{"email":"<string>","age":{"$gt":"<number>"}},"limit":10}}`,
+		},
+		{
+			name:   "originatingCommand allowList",
+			config: allowList,
+			attr:   getMore,
+			want:   `{"command":{"getMore":42,"collection":"orders"},"originatingCommand":{"find":"orders","filter":{"email":"<string>","age":{"$gt":30}},"limit":10}}`,
+		},
+		{
+			name:   "originatingCommand rule",
+			config: rule,
+			attr:   getMore,
+			want:   `{"command":{"getMore":42,"collection":"orders"},"originatingCommand":{"find":"orders","filter":{"email":"<string:99f369b22437>","age":{"$gt":"<number>"}},"limit":10}}`,
+		},
+		{
+			name:   "$expr none",
+			config: none,
+			attr:   expr,
+			want:   `{"command":{"find":"orders","filter":{"$expr":{"$eq":["$email","a@b.c"]},"tags":{"$exists":true}}}}`,
+		},
+		{
+			name:   "$expr hash",
+			config: hash,
+			attr:   expr,
+			want:   `{"command":{"find":"orders","filter":{"$expr":{"$eq":["<string:a1564e6928c9>","<string:335539325cbe>"]},"tags":{"$exists":true}}}}`,
+		},
+		{
+			name:   "$expr placeholder",
+			config: placeholder,
+			attr:   expr,
+			want:   `{"command":{"find":"orders","filter":{"$expr":{"$eq":["<string>","<string>"]},"tags":{"$exists":true}}}}`,
+		},
+		{
+			name:   "$expr allowList",
+			config: allowList,
+			attr:   expr,
+			want:   `{"command":{"find":"orders","filter":{"$expr":{"$eq":["<string>","<string>"]},"tags":{"$exists":true}}}}`,
+		},
+		{
+			name:   "$expr rule",
+			config: rule,
+			attr:   expr,
+			want:   `{"command":{"find":"orders","filter":{"$expr":{"$eq":["<string>","<string>"]},"tags":{"$exists":true}}}}`,
+		},
+		{
+			name:   "errMsg none",
+			config: none,
+			attr:   duplicateKey,
+			want:   `{"errMsg":"E11000 duplicate key error dup key: { email: \"a@b.c\" }","durationMillis":120}`,
+		},
+		{
+			name:   "errMsg hash",
+			config: hash,
+			attr:   duplicateKey,
+			want:   `{"errMsg":"<string:ad601aa48320>","durationMillis":120}`,
+		},
+		{
+			name:   "errMsg placeholder",
+			config: placeholder,
+			attr:   duplicateKey,
+			want:   `{"errMsg":"<string>","durationMillis":120}`,
+		},
+		{
+			name:   "errMsg allowList",
+			config: allowList,
+			attr:   duplicateKey,
+			want:   `{"errMsg":"<string>","durationMillis":120}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRedactor(tt.config)
+			if err != nil {
+				t.Fatalf("NewRedactor() error = %v", err)
+			}
+			got, err := marshalJSON(r.Command(tt.attr), "")
+			if err != nil {
+				t.Fatalf("marshalJSON() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Command() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactorQuery(t *testing.T) {
+	filter := bson.D{
+		{"customer", bson.D{{"email", "a@b.c"}}},
+		{"createdAt", bson.D{{"$gte", bson.D{{"$date", "2026-01-01T00:00:00Z"}}}}},
+		{"name", bson.D{{"$regex", "^Ann"}, {"$options", "i"}}},
+	}
+	tests := []struct {
+		name   string
+		config RedactionConfig
+		want   string
+	}{
+		{
+			name:   "placeholder",
+			config: RedactionConfig{Mode: redactPlaceholder},
+			want:   `{"customer":{"email":"<string>"},"createdAt":{"$gte":"<date>"},"name":{"$regex":"<string>","$options":"i"}}`,
+		},
+		{
+			name:   "allowList by field path",
+			config: RedactionConfig{Mode: redactAllowList, AllowedFields: []string{"customer.*"}},
+			want:   `{"customer":{"email":"a@b.c"},"createdAt":{"$gte":"<date>"},"name":{"$regex":"<string>","$options":"i"}}`,
+		},
+		{
+			name:   "rule overriding the mode",
+			config: RedactionConfig{Mode: redactPlaceholder, Rules: []RedactionRule{{Path: "*.email", Mode: redactNone}}},
+			want:   `{"customer":{"email":"a@b.c"},"createdAt":{"$gte":"<date>"},"name":{"$regex":"<string>","$options":"i"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRedactor(tt.config)
+			if err != nil {
+				t.Fatalf("NewRedactor() error = %v", err)
+			}
+			got, err := marshalJSON(r.Query(filter), "")
+			if err != nil {
+				t.Fatalf("marshalJSON() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Query() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
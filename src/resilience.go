@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genai"
+)
+
+// ErrCircuitOpen is returned without calling a service whose circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// RetryConfig tunes the retries, timeouts and circuit breaker of the calls to a service.
+// DownloadTimeoutSeconds bounds the calls that stream a large body, such as log archives,
+// instead of TimeoutSeconds.
+type RetryConfig struct {
+	MaxAttempts            int `json:"maxAttempts"`
+	BaseDelayMillis        int `json:"baseDelayMillis"`
+	MaxDelayMillis         int `json:"maxDelayMillis"`
+	TimeoutSeconds         int `json:"timeoutSeconds"`
+	DownloadTimeoutSeconds int `json:"downloadTimeoutSeconds"`
+	BreakerThreshold       int `json:"breakerThreshold"`
+	BreakerCooldownSeconds int `json:"breakerCooldownSeconds"`
+}
+
+var (
+	defaultAtlasRetry = RetryConfig{MaxAttempts: 5, BaseDelayMillis: 500, MaxDelayMillis: 30000, TimeoutSeconds: 300, DownloadTimeoutSeconds: 3600, BreakerThreshold: 5, BreakerCooldownSeconds: 60}
+	defaultLLMRetry   = RetryConfig{MaxAttempts: 4, BaseDelayMillis: 2000, MaxDelayMillis: 60000, TimeoutSeconds: 600, BreakerThreshold: 3, BreakerCooldownSeconds: 120}
+)
+
+// withDefaults fills the unset fields of a retry configuration from a default one.
+func (rc RetryConfig) withDefaults(def RetryConfig) RetryConfig {
+	if rc.MaxAttempts <= 0 {
+		rc.MaxAttempts = def.MaxAttempts
+	}
+	if rc.BaseDelayMillis <= 0 {
+		rc.BaseDelayMillis = def.BaseDelayMillis
+	}
+	if rc.MaxDelayMillis <= 0 {
+		rc.MaxDelayMillis = def.MaxDelayMillis
+	}
+	if rc.TimeoutSeconds <= 0 {
+		rc.TimeoutSeconds = def.TimeoutSeconds
+	}
+	if rc.DownloadTimeoutSeconds <= 0 {
+		rc.DownloadTimeoutSeconds = def.DownloadTimeoutSeconds
+	}
+	if rc.BreakerThreshold <= 0 {
+		rc.BreakerThreshold = def.BreakerThreshold
+	}
+	if rc.BreakerCooldownSeconds <= 0 {
+		rc.BreakerCooldownSeconds = def.BreakerCooldownSeconds
+	}
+	return rc
+}
+
+// CircuitBreaker stops calling a service after consecutive failures, and lets a single call
+// through once the cooldown has elapsed.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	failures  int
+	openedAt  time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Since(b.openedAt) >= b.cooldown {
+		// Half-open: the next failure reopens the circuit for another cooldown.
+		b.openedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// Failure records a failed call and reports whether it opened the circuit.
+func (b *CircuitBreaker) Failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		opened := b.failures == b.threshold
+		b.openedAt = time.Now()
+		return opened
+	}
+	return false
+}
+
+// Resilience wraps the calls to an external service with per-call timeouts, retries with
+// exponential backoff and jitter, and a circuit breaker.
+type Resilience struct {
+	Service string
+	Config  RetryConfig
+	Breaker *CircuitBreaker
+}
+
+func NewResilience(service string, rc RetryConfig) *Resilience {
+	return &Resilience{
+		Service: service,
+		Config:  rc,
+		Breaker: NewCircuitBreaker(rc.BreakerThreshold, time.Duration(rc.BreakerCooldownSeconds)*time.Second),
+	}
+}
+
+// Do runs call until it succeeds, fails with a non-retryable error or runs out of attempts.
+// The call returns the HTTP response it got, if any, so that its status and Retry-After header
+// can be inspected.
+func (r *Resilience) Do(ctx context.Context, operation string, call func(ctx context.Context) (*http.Response, error)) error {
+	return r.DoWithTimeout(ctx, operation, time.Duration(r.Config.TimeoutSeconds)*time.Second, call)
+}
+
+// DoWithTimeout is Do with a per-call timeout other than the configured one, for calls that
+// stream a body too large to fit in it.
+func (r *Resilience) DoWithTimeout(ctx context.Context, operation string, timeout time.Duration, call func(ctx context.Context) (*http.Response, error)) error {
+	summary := GetRunSummary()
+	var err error
+	for attempt := 1; attempt <= r.Config.MaxAttempts; attempt++ {
+		if !r.Breaker.Allow() {
+			summary.RecordCall(r.Service, false)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w (last error: %v)", r.Service, operation, ErrCircuitOpen, err)
+			}
+			return fmt.Errorf("%s %s: %w", r.Service, operation, ErrCircuitOpen)
+		}
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		var response *http.Response
+		response, err = call(callCtx)
+		cancel()
+		if err == nil {
+			r.Breaker.Success()
+			summary.RecordCall(r.Service, true)
+			return nil
+		}
+		retryable, retryAfter := classifyError(ctx, err, response)
+		if !retryable {
+			summary.RecordCall(r.Service, false)
+			return err
+		}
+		if r.Breaker.Failure() {
+			summary.RecordCircuitOpen(r.Service)
+			Logger.WithFields(logrus.Fields{"service": r.Service}).Warn("Circuit breaker opened")
+		}
+		if attempt == r.Config.MaxAttempts {
+			break
+		}
+		delay := r.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		summary.RecordRetry(r.Service)
+		Logger.WithFields(logrus.Fields{
+			"service":   r.Service,
+			"operation": operation,
+			"attempt":   attempt,
+			"delay":     delay.String(),
+		}).Warn("Retrying after transient error: ", err)
+		select {
+		case <-ctx.Done():
+			summary.RecordCall(r.Service, false)
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	summary.RecordCall(r.Service, false)
+	return fmt.Errorf("%s %s failed after %d attempts: %w", r.Service, operation, r.Config.MaxAttempts, err)
+}
+
+// backoff returns the full-jitter exponential delay before the given retry.
+func (r *Resilience) backoff(attempt int) time.Duration {
+	ceiling := time.Duration(r.Config.BaseDelayMillis) * time.Millisecond << (attempt - 1)
+	maxDelay := time.Duration(r.Config.MaxDelayMillis) * time.Millisecond
+	if ceiling <= 0 || ceiling > maxDelay {
+		ceiling = maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+var retryableStatusCodes = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// classifyError reports whether a failed call is worth retrying, and how long the service
+// asked to wait before doing so.
+func classifyError(ctx context.Context, err error, response *http.Response) (bool, time.Duration) {
+	if ctx.Err() != nil {
+		// The run itself was cancelled, as opposed to the call timing out.
+		return false, 0
+	}
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		return retryableStatusCodes[apiErr.Code], genaiRetryDelay(apiErr)
+	}
+	if response != nil {
+		return retryableStatusCodes[response.StatusCode], parseRetryAfter(response.Header.Get("Retry-After"))
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed),
+		errors.As(err, &netErr):
+		return true, 0
+	}
+	return false, 0
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// genaiRetryDelay reads the delay Gemini asks for in the RetryInfo detail of its errors.
+func genaiRetryDelay(apiErr genai.APIError) time.Duration {
+	for _, detail := range apiErr.Details {
+		if detail["@type"] != "type.googleapis.com/google.rpc.RetryInfo" {
+			continue
+		}
+		if s, ok := detail["retryDelay"].(string); ok {
+			if d, err := time.ParseDuration(s); err == nil {
+				return d
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Stages of a run, in order.
+const (
+	stageDownload            = "download"
+	stageIngest              = "ingest"
+	stageSlowQueriesByDriver = "slowQueriesByDriver"
+	stageHistograms          = "slowQueryHistograms"
+	stageTargeting           = "slowQueryTargeting"
+	stageAntiPatterns        = "queryAntiPatterns"
+	stageRouting             = "mongosQueryShapes"
+	stageSharding            = "shardDistribution"
+	stageIndexes             = "indexes"
+	stageSlowQueryReport     = "slowQueryReport"
+	stageMetricsReport       = "metricsReport"
+)
+
+// Ingestion states of a downloaded log file.
+const (
+	filePending   = "pending"
+	fileIngesting = "ingesting"
+	fileIngested  = "ingested"
+)
+
+// ingestedCollections hold the documents ingested from the log files, tagged with their host.
+var ingestedCollections = []string{"slowQueries", "mongosSlowQueries", "primaryChangeEvents", "clientMetadata"}
+
+type ManifestFile struct {
+	Host string `bson:"host" json:"host"`
+	// LogName is the Atlas log the file was downloaded from; empty for the mongod log.
+	LogName    string    `bson:"logName,omitempty" json:"logName,omitempty"`
+	Path       string    `bson:"path" json:"path"`
+	SHA256     string    `bson:"sha256" json:"sha256"`
+	Size       int64     `bson:"size" json:"size"`
+	Status     string    `bson:"status" json:"status"`
+	IngestedAt time.Time `bson:"ingestedAt,omitempty" json:"ingestedAt,omitempty"`
+}
+
+type ManifestStage struct {
+	Name        string    `bson:"name" json:"name"`
+	CompletedAt time.Time `bson:"completedAt" json:"completedAt"`
+}
+
+// RunManifest records what a run has done so far, so that it can be resumed from its first
+// incomplete stage. It's stored in the run database.
+type RunManifest struct {
+	RunID       string   `bson:"_id" json:"runId"`
+	ProjectID   string   `bson:"projectId" json:"projectId"`
+	ClusterName string   `bson:"clusterName" json:"clusterName"`
+	ConfigHash  string   `bson:"configHash" json:"configHash"`
+	WindowStart int64    `bson:"windowStart" json:"windowStart"`
+	WindowEnd   int64    `bson:"windowEnd" json:"windowEnd"`
+	Hosts       []string `bson:"hosts" json:"hosts"`
+	// Shards is the number of shards of a sharded cluster, and 0 for a replica set.
+	Shards  int             `bson:"shards" json:"shards"`
+	Files   []ManifestFile  `bson:"files" json:"files"`
+	Stages  []ManifestStage `bson:"stages" json:"stages"`
+	Created time.Time       `bson:"created" json:"created"`
+	Updated time.Time       `bson:"updated" json:"updated"`
+}
+
+// ConfigHash fingerprints the configuration a run was started with.
+func ConfigHash(cfg *Config) (string, error) {
+	js, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// NewRunManifest starts the manifest of a new run over the configured period.
+func NewRunManifest(cfg *Config, runID string) (*RunManifest, error) {
+	start, end, err := ConvertISO8601DurationToUnixTimestamp(cfg.Period)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period: %w", err)
+	}
+	configHash, err := ConfigHash(cfg)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &RunManifest{
+		RunID:       runID,
+		ProjectID:   cfg.ProjectId,
+		ClusterName: cfg.ClusterName,
+		ConfigHash:  configHash,
+		WindowStart: start,
+		WindowEnd:   end,
+		Created:     now,
+		Updated:     now,
+	}, nil
+}
+
+// Window returns the time window of the run. Its metrics are fetched over the same window as its
+// logs, so that a resumed or replayed run analyzes the same measurements.
+func (m *RunManifest) Window() (time.Time, time.Time) {
+	return time.Unix(m.WindowStart, 0).UTC(), time.Unix(m.WindowEnd, 0).UTC()
+}
+
+// LoadRunManifest loads the manifest of a past run to resume it.
+func LoadRunManifest(ctx context.Context, cfg *Config, runID string) (*RunManifest, error) {
+	m, err := GetRunManifest(ctx, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the manifest of run %s: %w", runID, err)
+	}
+	if configHash, err := ConfigHash(cfg); err == nil && configHash != m.ConfigHash {
+		Logger.WithFields(logrus.Fields{"run": runID}).Warn("The configuration changed since the run started")
+	}
+	Logger.WithFields(logrus.Fields{"run": runID, "completedStages": len(m.Stages)}).Info("Resuming run")
+	return m, nil
+}
+
+func (m *RunManifest) Save(ctx context.Context) error {
+	m.Updated = time.Now()
+	if err := UpsertRunManifest(ctx, m); err != nil {
+		Logger.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (m *RunManifest) StageDone(name string) bool {
+	for _, s := range m.Stages {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CompleteStage records that a stage completed and saves the manifest.
+func (m *RunManifest) CompleteStage(ctx context.Context, name string) error {
+	if !m.StageDone(name) {
+		m.Stages = append(m.Stages, ManifestStage{Name: name, CompletedAt: time.Now()})
+	}
+	Logger.WithFields(logrus.Fields{"run": m.RunID, "stage": name}).Info("Stage completed")
+	return m.Save(ctx)
+}
+
+// RecordDownloads adds the downloaded log file of each "host:port" to the manifest.
+func (m *RunManifest) RecordDownloads(hostLogMapping map[string]HostLog) error {
+	for host, log := range hostLogMapping {
+		checksum, size, err := fileChecksum(log.Path)
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %w", log.Path, err)
+		}
+		logName := log.LogName
+		if logName == logMongod {
+			logName = ""
+		}
+		m.Hosts = appendUnique(m.Hosts, host)
+		m.setFile(ManifestFile{Host: host, LogName: logName, Path: log.Path, SHA256: checksum, Size: size, Status: filePending})
+	}
+	return nil
+}
+
+func (m *RunManifest) setFile(file ManifestFile) {
+	for i, f := range m.Files {
+		if f.Host == file.Host {
+			m.Files[i] = file
+			return
+		}
+	}
+	m.Files = append(m.Files, file)
+}
+
+// IngestedHosts returns the "host:port" of every file of the given Atlas log that was ingested.
+func (m *RunManifest) IngestedHosts(logName string) []string {
+	var hosts []string
+	for _, f := range m.Files {
+		if f.Status == fileIngested && f.Log() == logName {
+			hosts = append(hosts, f.Host)
+		}
+	}
+	return hosts
+}
+
+// Log returns the Atlas log the file was downloaded from.
+func (f ManifestFile) Log() string {
+	if f.LogName == "" {
+		return logMongod
+	}
+	return f.LogName
+}
+
+// Verify reports whether a downloaded file is still on disk, unchanged.
+func (f ManifestFile) Verify() bool {
+	checksum, _, err := fileChecksum(f.Path)
+	return err == nil && checksum == f.SHA256
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ServiceStats counts the calls made to an external service during a run.
+type ServiceStats struct {
+	Calls        int `bson:"calls" json:"calls"`
+	Failures     int `bson:"failures" json:"failures"`
+	Retries      int `bson:"retries" json:"retries"`
+	CircuitOpens int `bson:"circuitOpens" json:"circuitOpens"`
+	CacheHits    int `bson:"cacheHits" json:"cacheHits"`
+}
+
+// Reports of a run.
+const (
+	slowQueryReport = "slowQueries"
+	metricsReport   = "metrics"
+)
+
+// Outcomes of a run, and the exit codes they map to.
+const (
+	RunComplete = "complete"
+	RunPartial  = "partial"
+	RunFailed   = "failed"
+)
+
+var runExitCodes = map[string]int{
+	RunComplete: 0,
+	RunFailed:   1,
+	RunPartial:  2,
+}
+
+// Kinds of data gaps.
+const (
+	gapHost      = "host metrics"
+	gapPartition = "disk partition"
+	gapMetric    = "metric"
+	gapShape     = "query shape"
+	gapShard     = "shard"
+	gapSection   = "section"
+	gapAnalysis  = "LLM analysis"
+)
+
+// DataGap is a piece of data a report was generated without.
+type DataGap struct {
+	Report  string `bson:"report" json:"report"`
+	Kind    string `bson:"kind" json:"kind"`
+	Subject string `bson:"subject" json:"subject"`
+	Reason  string `bson:"reason" json:"reason"`
+}
+
+// RunSummary records how a run went, and is stored in the run database when it ends.
+type RunSummary struct {
+	mu            sync.Mutex
+	Started       time.Time
+	Services      map[string]*ServiceStats
+	DataGaps      []DataGap
+	FailedReports []string
+	Status        string
+}
+
+// RunSummaryRecord is the stored form of a run summary.
+type RunSummaryRecord struct {
+	Started       time.Time               `bson:"started" json:"started"`
+	Finished      time.Time               `bson:"finished" json:"finished"`
+	Status        string                  `bson:"status" json:"status"`
+	Services      map[string]ServiceStats `bson:"services" json:"services"`
+	DataGaps      []DataGap               `bson:"dataGaps" json:"dataGaps"`
+	FailedReports []string                `bson:"failedReports" json:"failedReports"`
+}
+
+var (
+	runSummary     *RunSummary
+	runSummaryOnce sync.Once
+)
+
+func GetRunSummary() *RunSummary {
+	runSummaryOnce.Do(func() {
+		runSummary = &RunSummary{Started: time.Now(), Services: make(map[string]*ServiceStats)}
+	})
+	return runSummary
+}
+
+func (s *RunSummary) service(name string) *ServiceStats {
+	stats, ok := s.Services[name]
+	if !ok {
+		stats = &ServiceStats{}
+		s.Services[name] = stats
+	}
+	return stats
+}
+
+func (s *RunSummary) RecordCall(service string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.service(service)
+	stats.Calls++
+	if !ok {
+		stats.Failures++
+	}
+}
+
+func (s *RunSummary) RecordRetry(service string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.service(service).Retries++
+}
+
+func (s *RunSummary) RecordCacheHit(service string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.service(service).CacheHits++
+}
+
+func (s *RunSummary) RecordCircuitOpen(service string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.service(service).CircuitOpens++
+}
+
+// RecordGap records that a report is missing some data, and why.
+func (s *RunSummary) RecordGap(report, kind, subject string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	Logger.WithFields(logrus.Fields{"report": report, "kind": kind, "subject": subject}).Warn("Data gap: ", err)
+	s.DataGaps = append(s.DataGaps, DataGap{Report: report, Kind: kind, Subject: subject, Reason: err.Error()})
+}
+
+// Gaps returns the data gaps of a report.
+func (s *RunSummary) Gaps(report string) []DataGap {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var gaps []DataGap
+	for _, gap := range s.DataGaps {
+		if gap.Report == report {
+			gaps = append(gaps, gap)
+		}
+	}
+	return gaps
+}
+
+// RecordReportFailure records that a report couldn't be generated at all, or lacks its LLM
+// analysis.
+func (s *RunSummary) RecordReportFailure(report string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.FailedReports = append(s.FailedReports, report)
+}
+
+// Finish sets the outcome of the run: it failed when no report could be analyzed, and is
+// partial when a report failed or was generated with data gaps.
+func (s *RunSummary) Finish(reports int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case len(s.FailedReports) >= reports:
+		s.Status = RunFailed
+	case len(s.FailedReports) > 0 || len(s.DataGaps) > 0:
+		s.Status = RunPartial
+	default:
+		s.Status = RunComplete
+	}
+	return s.Status
+}
+
+// ExitCode maps the outcome of the run to the process exit code.
+func (s *RunSummary) ExitCode() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if code, ok := runExitCodes[s.Status]; ok {
+		return code
+	}
+	return runExitCodes[RunFailed]
+}
+
+// Record returns a copy of the summary as it stands.
+func (s *RunSummary) Record() RunSummaryRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := RunSummaryRecord{
+		Started:       s.Started,
+		Finished:      time.Now(),
+		Status:        s.Status,
+		Services:      make(map[string]ServiceStats),
+		DataGaps:      append([]DataGap{}, s.DataGaps...),
+		FailedReports: append([]string{}, s.FailedReports...),
+	}
+	for name, stats := range s.Services {
+		record.Services[name] = *stats
+	}
+	return record
+}
+
+// Save logs the summary of the run and stores it in the run database.
+func (s *RunSummary) Save(ctx context.Context, dbName string) error {
+	record := s.Record()
+	for name, stats := range record.Services {
+		Logger.WithFields(logrus.Fields{
+			"service":      name,
+			"calls":        stats.Calls,
+			"failures":     stats.Failures,
+			"retries":      stats.Retries,
+			"circuitOpens": stats.CircuitOpens,
+			"cacheHits":    stats.CacheHits,
+		}).Info("Run summary")
+	}
+	Logger.WithFields(logrus.Fields{"status": record.Status, "dataGaps": len(record.DataGaps), "failedReports": record.FailedReports}).Info("Run finished")
+	if _, err := InsertRunSummary(ctx, record, dbName); err != nil {
+		Logger.Error(err)
+		return err
+	}
+	return nil
+}
+
+// RenderDataGapsSection lists the data a report was generated without.
+func RenderDataGapsSection(gaps []DataGap) string {
+	if len(gaps) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("## Data gaps\n\n")
+	sb.WriteString("This report was generated without the following data, so its conclusions may be incomplete.\n\n")
+	sb.WriteString("| Missing | Subject | Reason |\n")
+	sb.WriteString("|---|---|---|\n")
+	for _, gap := range gaps {
+		fmt.Fprintf(&sb, "| %s | %s | %s |\n", gap.Kind, gap.Subject, strings.ReplaceAll(gap.Reason, "|", "\\|"))
+	}
+	return sb.String()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// RankedShape is a query shape selected for analysis, along with the strategy that picked it
+// and a human-readable reason.
+type RankedShape struct {
+	SlowQueryByDriver
+	Score    float64
+	Strategy string
+	// Reason is the reason with its numbers formatted for the prompts; LocalizedReason formats
+	// them for the report.
+	Reason string
+	reason func(locale *ReportLocale) string
+}
+
+// setReason sets the reason of the shape, formatted for a given locale by reason.
+func (s *RankedShape) setReason(reason func(locale *ReportLocale) string) {
+	s.reason = reason
+	s.Reason = reason(promptLocale)
+}
+
+// LocalizedReason returns the reason of the shape with its numbers formatted for locale.
+func (s RankedShape) LocalizedReason(locale *ReportLocale) string {
+	if s.reason == nil {
+		return s.Reason
+	}
+	return s.reason(locale)
+}
+
+// RankingStrategy orders query shapes by how much they deserve to be analyzed.
+type RankingStrategy interface {
+	Name() string
+	Rank(shapes []SlowQueryByDriver) []RankedShape
+}
+
+// metricStrategy ranks shapes by a single metric.
+type metricStrategy struct {
+	name   string
+	label  string
+	unit   string
+	metric func(SlowQueryByDriver) float64
+}
+
+func (s metricStrategy) Name() string {
+	return s.name
+}
+
+func (s metricStrategy) Rank(shapes []SlowQueryByDriver) []RankedShape {
+	ranked := make([]RankedShape, 0, len(shapes))
+	for _, shape := range shapes {
+		ranked = append(ranked, RankedShape{SlowQueryByDriver: shape, Score: s.metric(shape), Strategy: s.name})
+	}
+	sortRankedShapes(ranked)
+	for i := range ranked {
+		score := ranked[i].Score
+		ranked[i].setReason(func(locale *ReportLocale) string {
+			return fmt.Sprintf("ranked #%d by %s (%s %s)", i+1, s.label, locale.Number(score, 0), s.unit)
+		})
+	}
+	return ranked
+}
+
+// collscanFirstStrategy ranks COLLSCAN shapes ahead of everything else, and by total
+// duration within each group.
+type collscanFirstStrategy struct{}
+
+func (collscanFirstStrategy) Name() string {
+	return "collscanFirst"
+}
+
+func (collscanFirstStrategy) Rank(shapes []SlowQueryByDriver) []RankedShape {
+	ranked := make([]RankedShape, 0, len(shapes))
+	for _, shape := range shapes {
+		score := float64(shape.TotalDurationMillis)
+		if shape.ID.IsCollscan {
+			// Any COLLSCAN outranks any index-assisted shape.
+			score += 1e15
+		}
+		ranked = append(ranked, RankedShape{SlowQueryByDriver: shape, Score: score, Strategy: "collscanFirst"})
+	}
+	sortRankedShapes(ranked)
+	for i := range ranked {
+		total := float64(ranked[i].TotalDurationMillis)
+		if ranked[i].ID.IsCollscan {
+			ranked[i].setReason(func(locale *ReportLocale) string {
+				return fmt.Sprintf("ranked #%d: COLLSCAN shape with %s ms of total slow time", i+1, locale.Number(total, 0))
+			})
+		} else {
+			ranked[i].setReason(func(locale *ReportLocale) string {
+				return fmt.Sprintf("ranked #%d: index-assisted shape with %s ms of total slow time, after all COLLSCAN shapes", i+1, locale.Number(total, 0))
+			})
+		}
+	}
+	return ranked
+}
+
+// compositeStrategy ranks shapes by a weighted sum of metrics, each normalized by its maximum
+// across all shapes.
+type compositeStrategy struct {
+	weights map[string]float64
+}
+
+var defaultRankingWeights = map[string]float64{
+	"totalTime": 0.4,
+	"maxTime":   0.2,
+	"bytesRead": 0.2,
+	"collscan":  0.2,
+}
+
+var compositeMetrics = map[string]func(SlowQueryByDriver) float64{
+	"totalTime":    func(s SlowQueryByDriver) float64 { return float64(s.TotalDurationMillis) },
+	"maxTime":      func(s SlowQueryByDriver) float64 { return float64(s.MaxDurationMillis) },
+	"p99":          func(s SlowQueryByDriver) float64 { return s.P99DurationMillis },
+	"count":        func(s SlowQueryByDriver) float64 { return float64(s.Count) },
+	"bytesRead":    func(s SlowQueryByDriver) float64 { return float64(s.TotalBytesRead) },
+	"docsExamined": func(s SlowQueryByDriver) float64 { return float64(s.TotalDocsExamined) },
+	"collscan": func(s SlowQueryByDriver) float64 {
+		if s.ID.IsCollscan {
+			return 1
+		}
+		return 0
+	},
+}
+
+func (compositeStrategy) Name() string {
+	return "composite"
+}
+
+func (s compositeStrategy) Rank(shapes []SlowQueryByDriver) []RankedShape {
+	weights := s.weights
+	if len(weights) == 0 {
+		weights = defaultRankingWeights
+	}
+	var names []string
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	maxima := make(map[string]float64)
+	for _, name := range names {
+		for _, shape := range shapes {
+			if v := compositeMetrics[name](shape); v > maxima[name] {
+				maxima[name] = v
+			}
+		}
+	}
+	ranked := make([]RankedShape, 0, len(shapes))
+	type term struct {
+		name       string
+		normalized float64
+	}
+	for _, shape := range shapes {
+		var score float64
+		var terms []term
+		for _, name := range names {
+			if maxima[name] == 0 {
+				continue
+			}
+			normalized := compositeMetrics[name](shape) / maxima[name]
+			score += weights[name] * normalized
+			terms = append(terms, term{name, normalized})
+		}
+		r := RankedShape{SlowQueryByDriver: shape, Score: score, Strategy: "composite"}
+		r.setReason(func(locale *ReportLocale) string {
+			var parts []string
+			for _, t := range terms {
+				parts = append(parts, fmt.Sprintf("%s %s×%s", t.name, locale.Number(t.normalized, 2), locale.Number(weights[t.name], 2)))
+			}
+			return strings.Join(parts, ", ")
+		})
+		ranked = append(ranked, r)
+	}
+	sortRankedShapes(ranked)
+	for i := range ranked {
+		score, terms := ranked[i].Score, ranked[i].reason
+		ranked[i].setReason(func(locale *ReportLocale) string {
+			return fmt.Sprintf("ranked #%d by composite score %s (%s)", i+1, locale.Number(score, 2), terms(locale))
+		})
+	}
+	return ranked
+}
+
+func sortRankedShapes(ranked []RankedShape) {
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].TotalDurationMillis > ranked[j].TotalDurationMillis
+	})
+}
+
+const defaultRankingStrategy = "totalTime"
+
+// GetRankingStrategy returns the ranking strategy registered under name.
+func GetRankingStrategy(name string, weights map[string]float64) (RankingStrategy, error) {
+	if name == "" {
+		name = defaultRankingStrategy
+	}
+	switch name {
+	case "totalTime":
+		return metricStrategy{"totalTime", "total slow time", "ms", compositeMetrics["totalTime"]}, nil
+	case "maxTime":
+		return metricStrategy{"maxTime", "slowest execution", "ms", compositeMetrics["maxTime"]}, nil
+	case "p99":
+		return metricStrategy{"p99", "p99 duration", "ms", compositeMetrics["p99"]}, nil
+	case "count":
+		return metricStrategy{"count", "number of slow executions", "executions", compositeMetrics["count"]}, nil
+	case "bytesRead":
+		return metricStrategy{"bytesRead", "total bytes read", "bytes", compositeMetrics["bytesRead"]}, nil
+	case "docsExamined":
+		return metricStrategy{"docsExamined", "total documents examined", "documents", compositeMetrics["docsExamined"]}, nil
+	case "collscanFirst":
+		return collscanFirstStrategy{}, nil
+	case "composite":
+		for metric := range weights {
+			if _, ok := compositeMetrics[metric]; !ok {
+				return nil, fmt.Errorf("unsupported ranking weight '%s'", metric)
+			}
+		}
+		return compositeStrategy{weights: weights}, nil
+	}
+	return nil, fmt.Errorf("unsupported query shape ranking strategy '%s'", name)
+}
+
+// SelectTopShapes takes the topN shapes of a ranking, then makes sure at least minCollscans
+// COLLSCAN shapes are included by swapping out the lowest ranked index-assisted shapes. A
+// negative topN selects no shapes.
+func SelectTopShapes(ranked []RankedShape, topN int, minCollscans int) []RankedShape {
+	topN = max(0, min(topN, len(ranked)))
+	selected := make([]RankedShape, topN)
+	copy(selected, ranked[:topN])
+	collscans := 0
+	for _, shape := range selected {
+		if shape.ID.IsCollscan {
+			collscans++
+		}
+	}
+	next := topN
+	for collscans < minCollscans && next < len(ranked) {
+		candidate := ranked[next]
+		next++
+		if !candidate.ID.IsCollscan {
+			continue
+		}
+		replaced := false
+		for i := len(selected) - 1; i >= 0; i-- {
+			if !selected[i].ID.IsCollscan {
+				ranking := candidate
+				candidate.setReason(func(locale *ReportLocale) string {
+					return fmt.Sprintf("included by the minimum COLLSCAN rule (at least %d COLLSCAN shapes), %s", minCollscans, ranking.LocalizedReason(locale))
+				})
+				selected = append(selected[:i], selected[i+1:]...)
+				selected = append(selected, candidate)
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			break
+		}
+		collscans++
+	}
+	return selected
+}
+
+// GetTopQueryShapesByExecutionTime ranks every read query shape with the configured strategy
+// and returns the shapes selected for analysis.
+func GetTopQueryShapesByExecutionTime(ctx context.Context, dbName string, topN int, strategyName string) ([]RankedShape, error) {
+	return getTopShapes(ctx, dbName, topN, strategyName, readShapesFilter())
+}
+
+func getTopShapes(ctx context.Context, dbName string, topN int, strategyName string, filter bson.D) ([]RankedShape, error) {
+	cfg, _ := GetConfig()
+	strategy, err := GetRankingStrategy(strategyName, cfg.RankingWeights)
+	if err != nil {
+		return nil, err
+	}
+	shapes, err := ListQueryShapes(ctx, dbName, filter)
+	if err != nil {
+		return nil, err
+	}
+	return SelectTopShapes(strategy.Rank(shapes), topN, cfg.MinCollscanShapes), nil
+}
+
+// RenderShapeSelectionSection renders a Markdown section explaining why each analyzed query
+// shape was selected.
+func RenderShapeSelectionSection(shapes []RankedShape) string {
+	var sb strings.Builder
+	sb.WriteString("## Query shape selection\n\n")
+	sb.WriteString("| # | Query hash | Namespace | Driver | Plan | Strategy | Reason |\n")
+	sb.WriteString("|---|---|---|---|---|---|---|\n")
+	locale := GetReportLocale()
+	for i, shape := range shapes {
+		sb.WriteString(fmt.Sprintf(
+			"| %d | %s | %s | %s | %s | %s | %s |\n",
+			i+1,
+			shape.ID.Hash,
+			shape.ID.Namespace,
+			shape.ID.Driver,
+			planLabel(shape.ID.IsCollscan),
+			shape.Strategy,
+			shape.LocalizedReason(locale),
+		))
+	}
+	return sb.String()
+}
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// How much of a collection's shard key the filter of a shape has conditions on.
+const (
+	// Every field of the shard key: mongos can target the shards owning the matching ranges.
+	shardKeyFull = "full"
+	// A prefix of the shard key: mongos can still target ranges, but they may span more shards.
+	shardKeyPrefix = "prefix"
+	// Not the first field of the shard key: the operation is broadcast to every shard.
+	shardKeyMissing = "none"
+)
+
+// Balancer modes, as reported by balancerStatus.
+const (
+	balancerFull = "full"
+	balancerOff  = "off"
+)
+
+const (
+	defaultShardImbalanceRatio = 1.5
+	shardDistributionTimeout   = 30 * time.Second
+	// shardDistributionID is the _id of the snapshot in the shardDistribution collection.
+	shardDistributionID = "snapshot"
+)
+
+// ShardingConfig is the read-only connection to the analyzed cluster its shard keys and data
+// distribution are read from.
+type ShardingConfig struct {
+	// MongoURI connects to the cluster's mongos routers, as a user that can read the config
+	// database, such as one with the clusterMonitor role. The analysis is skipped when empty.
+	MongoURI string `json:"mongoUri"`
+	// ImbalanceRatio is how many times the average of the shards a shard's data or slow query
+	// time has to exceed for it to be reported as imbalanced.
+	ImbalanceRatio float64 `json:"imbalanceRatio"`
+}
+
+func (sc ShardingConfig) withDefaults() ShardingConfig {
+	if sc.ImbalanceRatio == 0 {
+		sc.ImbalanceRatio = defaultShardImbalanceRatio
+	}
+	return sc
+}
+
+func (sc ShardingConfig) Validate() error {
+	if sc.withDefaults().ImbalanceRatio <= 1 {
+		return fmt.Errorf("sharding imbalanceRatio must be greater than 1, got %g", sc.ImbalanceRatio)
+	}
+	if sc.MongoURI != "" {
+		if err := options.Client().ApplyURI(sc.MongoURI).Validate(); err != nil {
+			return fmt.Errorf("invalid sharding mongoUri: %w", err)
+		}
+	}
+	return nil
+}
+
+// ShardInfo is a shard of the cluster, as registered in config.shards.
+type ShardInfo struct {
+	Name     string   `bson:"name" json:"name"`
+	Hosts    []string `bson:"hosts" json:"hosts"`
+	Draining bool     `bson:"draining" json:"draining"`
+}
+
+// BalancerState is whether the balancer is enabled, and whether it was migrating chunks when
+// the distribution was read.
+type BalancerState struct {
+	Mode            string `bson:"mode" json:"mode"`
+	InBalancerRound bool   `bson:"inBalancerRound" json:"inBalancerRound"`
+}
+
+// ShardShare is the part of a sharded collection a shard owns. OwnedDocuments and
+// OwnedSizeBytes are only known on MongoDB 6.0.3 and later.
+type ShardShare struct {
+	Shard          string `bson:"shard" json:"shard"`
+	Chunks         int    `bson:"chunks" json:"chunks"`
+	JumboChunks    int    `bson:"jumboChunks" json:"jumboChunks"`
+	OwnedDocuments int64  `bson:"ownedDocuments" json:"ownedDocuments"`
+	OwnedSizeBytes int64  `bson:"ownedSizeBytes" json:"ownedSizeBytes"`
+}
+
+// ShardedCollection is a sharded collection, its shard key and how its data is spread over the
+// shards.
+type ShardedCollection struct {
+	Namespace string       `bson:"ns" json:"ns"`
+	Key       []IndexKey   `bson:"key" json:"key"`
+	Unique    bool         `bson:"unique" json:"unique"`
+	NoBalance bool         `bson:"noBalance" json:"noBalance"`
+	Shards    []ShardShare `bson:"shards" json:"shards"`
+}
+
+// ShardDistribution is a snapshot of the config database of a sharded cluster. Error records
+// why it couldn't be read, so that the reports can list it as a data gap.
+type ShardDistribution struct {
+	ID          string              `bson:"_id" json:"-"`
+	CollectedAt time.Time           `bson:"collectedAt" json:"collectedAt"`
+	Shards      []ShardInfo         `bson:"shards" json:"shards"`
+	Balancer    BalancerState       `bson:"balancer" json:"balancer"`
+	Collections []ShardedCollection `bson:"collections" json:"collections"`
+	Error       string              `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// CollectShardDistribution reads the shard keys and data distribution of the run's cluster,
+// and stores them in the shardDistribution collection. It's a no-op for replica sets, and when
+// no connection to the cluster is configured. A cluster that can't be read is recorded in the
+// snapshot rather than failing the run.
+func CollectShardDistribution(ctx context.Context, dbName string) error {
+	cfg, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.Sharding.MongoURI == "" {
+		return nil
+	}
+	m, err := GetRunManifest(ctx, dbName)
+	if err != nil {
+		return err
+	}
+	if m.Shards == 0 {
+		return nil
+	}
+	dist, err := ReadShardDistribution(ctx, cfg.Sharding.MongoURI)
+	if err != nil {
+		Logger.Warn("Failed to read the shard distribution: ", err)
+		dist = &ShardDistribution{Error: err.Error()}
+	}
+	dist.ID = shardDistributionID
+	dist.CollectedAt = time.Now()
+	return UpsertShardDistribution(ctx, dbName, dist)
+}
+
+// ReadShardDistribution connects to a sharded cluster and reads its shards, balancer state,
+// shard keys and chunks from the config database. It only runs reads and status commands.
+func ReadShardDistribution(ctx context.Context, uri string) (*ShardDistribution, error) {
+	ctx, cancel := context.WithTimeout(ctx, shardDistributionTimeout)
+	defer cancel()
+	client, err := mongo.Connect(options.Client().ApplyURI(uri).SetAppName("mongodb-insights-provider"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the cluster: %w", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	var dist ShardDistribution
+	if dist.Shards, err = readShards(ctx, client); err != nil {
+		return nil, err
+	}
+	if len(dist.Shards) == 0 {
+		return nil, errors.New("config.shards is empty, the connection string isn't a mongos of a sharded cluster")
+	}
+	if dist.Balancer, err = readBalancerState(ctx, client); err != nil {
+		return nil, err
+	}
+	if dist.Collections, err = readShardedCollections(ctx, client); err != nil {
+		return nil, err
+	}
+	if err := readOwnedData(ctx, client, dist.Collections); err != nil {
+		// $shardedDataDistribution only exists since 6.0.3, chunk counts are enough to go on.
+		Logger.Info("Owned data per shard unavailable, falling back to chunk counts: ", err)
+	}
+	return &dist, nil
+}
+
+func readShards(ctx context.Context, client *mongo.Client) ([]ShardInfo, error) {
+	cursor, err := client.Database("config").Collection("shards").Find(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config.shards: %w", err)
+	}
+	var docs []struct {
+		ID       string `bson:"_id"`
+		Host     string `bson:"host"`
+		Draining bool   `bson:"draining"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to read config.shards: %w", err)
+	}
+	shards := make([]ShardInfo, 0, len(docs))
+	for _, doc := range docs {
+		// The host of a shard is its replica set's connection string, e.g. rs0/h1:27017,h2:27017.
+		hosts := doc.Host
+		if _, members, ok := strings.Cut(hosts, "/"); ok {
+			hosts = members
+		}
+		shards = append(shards, ShardInfo{Name: doc.ID, Hosts: strings.Split(hosts, ","), Draining: doc.Draining})
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Name < shards[j].Name })
+	return shards, nil
+}
+
+// readBalancerState runs balancerStatus, falling back to the balancer settings of the config
+// database for users that can't run it.
+func readBalancerState(ctx context.Context, client *mongo.Client) (BalancerState, error) {
+	var state BalancerState
+	err := client.Database("admin").RunCommand(ctx, bson.D{{"balancerStatus", 1}}).Decode(&state)
+	if err == nil {
+		return state, nil
+	}
+	Logger.Info("balancerStatus failed, reading the balancer settings instead: ", err)
+	var settings struct {
+		Stopped bool   `bson:"stopped"`
+		Mode    string `bson:"mode"`
+	}
+	err = client.Database("config").Collection("settings").FindOne(ctx, bson.D{{"_id", "balancer"}}).Decode(&settings)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return BalancerState{Mode: balancerFull}, nil
+	case err != nil:
+		return state, fmt.Errorf("failed to read the balancer settings: %w", err)
+	case settings.Stopped || settings.Mode == balancerOff:
+		return BalancerState{Mode: balancerOff}, nil
+	}
+	return BalancerState{Mode: balancerFull}, nil
+}
+
+// readShardedCollections reads the shard keys of config.collections and counts the chunks of
+// config.chunks per shard. Chunks reference their collection by uuid since MongoDB 5.0, and by
+// namespace before. The collections of the config database itself are left out.
+func readShardedCollections(ctx context.Context, client *mongo.Client) ([]ShardedCollection, error) {
+	config := client.Database("config")
+	cursor, err := config.Collection("collections").Find(ctx, bson.D{{"dropped", bson.D{{"$ne", true}}}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config.collections: %w", err)
+	}
+	var docs []struct {
+		ID        string      `bson:"_id"`
+		Key       bson.D      `bson:"key"`
+		Unique    bool        `bson:"unique"`
+		NoBalance bool        `bson:"noBalance"`
+		UUID      interface{} `bson:"uuid"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to read config.collections: %w", err)
+	}
+	collections := make(map[string]*ShardedCollection)
+	var namespaces []string
+	for _, doc := range docs {
+		if strings.HasPrefix(doc.ID, "config.") {
+			continue
+		}
+		coll := &ShardedCollection{Namespace: doc.ID, Key: shardKeyFields(doc.Key), Unique: doc.Unique, NoBalance: doc.NoBalance}
+		collections[doc.ID] = coll
+		if doc.UUID != nil {
+			collections[chunkCollectionKey(doc.UUID)] = coll
+		}
+		namespaces = append(namespaces, doc.ID)
+	}
+
+	pipeline := mongo.Pipeline{
+		{{"$group", bson.D{
+			{"_id", bson.D{
+				{"coll", bson.D{{"$ifNull", bson.A{"$uuid", "$ns"}}}},
+				{"shard", "$shard"},
+			}},
+			{"chunks", bson.D{{"$sum", 1}}},
+			{"jumboChunks", bson.D{{"$sum", bson.D{{"$cond", bson.A{bson.D{{"$eq", bson.A{"$jumbo", true}}}, 1, 0}}}}}},
+		}}},
+	}
+	cursor, err = config.Collection("chunks").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count the chunks per shard: %w", err)
+	}
+	var counts []struct {
+		ID struct {
+			Coll  interface{} `bson:"coll"`
+			Shard string      `bson:"shard"`
+		} `bson:"_id"`
+		Chunks      int `bson:"chunks"`
+		JumboChunks int `bson:"jumboChunks"`
+	}
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, fmt.Errorf("failed to count the chunks per shard: %w", err)
+	}
+	for _, c := range counts {
+		if coll := collections[chunkCollectionKey(c.ID.Coll)]; coll != nil {
+			coll.Shards = append(coll.Shards, ShardShare{Shard: c.ID.Shard, Chunks: c.Chunks, JumboChunks: c.JumboChunks})
+		}
+	}
+
+	sort.Strings(namespaces)
+	result := make([]ShardedCollection, 0, len(namespaces))
+	for _, ns := range namespaces {
+		coll := collections[ns]
+		sort.Slice(coll.Shards, func(i, j int) bool { return coll.Shards[i].Shard < coll.Shards[j].Shard })
+		result = append(result, *coll)
+	}
+	return result, nil
+}
+
+// chunkCollectionKey returns the key a chunk's collection reference is looked up with.
+func chunkCollectionKey(v interface{}) string {
+	if b, ok := v.(bson.Binary); ok {
+		return fmt.Sprintf("uuid:%x", b.Data)
+	}
+	return fmt.Sprint(v)
+}
+
+// shardKeyFields converts a shard key pattern, such as {customerId: 1, _id: "hashed"}.
+func shardKeyFields(key bson.D) []IndexKey {
+	fields := make([]IndexKey, 0, len(key))
+	for _, e := range key {
+		t := fmt.Sprint(e.Value)
+		if n, ok := toFloat64(e.Value); ok {
+			t = "1"
+			if n < 0 {
+				t = "-1"
+			}
+		}
+		fields = append(fields, IndexKey{Field: e.Key, Type: t})
+	}
+	return fields
+}
+
+// readOwnedData adds the documents and bytes each shard owns of the collections, which the
+// balancer evens out since MongoDB 6.0, rather than chunk counts.
+func readOwnedData(ctx context.Context, client *mongo.Client, collections []ShardedCollection) error {
+	cursor, err := client.Database("admin").Aggregate(ctx, mongo.Pipeline{{{"$shardedDataDistribution", bson.D{}}}})
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		Namespace string `bson:"ns"`
+		Shards    []struct {
+			ShardName         string `bson:"shardName"`
+			NumOwnedDocuments int64  `bson:"numOwnedDocuments"`
+			OwnedSizeBytes    int64  `bson:"ownedSizeBytes"`
+		} `bson:"shards"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return err
+	}
+	byNamespace := make(map[string]*ShardedCollection)
+	for i := range collections {
+		byNamespace[collections[i].Namespace] = &collections[i]
+	}
+	for _, doc := range docs {
+		coll := byNamespace[doc.Namespace]
+		if coll == nil {
+			continue
+		}
+		for _, s := range doc.Shards {
+			share := coll.share(s.ShardName)
+			share.OwnedDocuments = s.NumOwnedDocuments
+			share.OwnedSizeBytes = s.OwnedSizeBytes
+		}
+	}
+	return nil
+}
+
+// share returns the share of a shard, adding it when the shard owns no chunk.
+func (c *ShardedCollection) share(shard string) *ShardShare {
+	for i := range c.Shards {
+		if c.Shards[i].Shard == shard {
+			return &c.Shards[i]
+		}
+	}
+	c.Shards = append(c.Shards, ShardShare{Shard: shard})
+	return &c.Shards[len(c.Shards)-1]
+}
+
+// KeyPattern formats the shard key, e.g. { customerId: 1, orderDate: 1 }.
+func (c ShardedCollection) KeyPattern() string {
+	var parts []string
+	for _, k := range c.Key {
+		value := k.Type
+		if value != "1" && value != "-1" {
+			value = fmt.Sprintf("%q", value)
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s", k.Field, value))
+	}
+	return "{ " + strings.Join(parts, ", ") + " }"
+}
+
+func (c ShardedCollection) Chunks() (chunks, jumbo int) {
+	for _, s := range c.Shards {
+		chunks += s.Chunks
+		jumbo += s.JumboChunks
+	}
+	return chunks, jumbo
+}
+
+// bySize tells whether the owned data sizes are known, to measure the balance with rather
+// than chunk counts.
+func (c ShardedCollection) bySize() bool {
+	for _, s := range c.Shards {
+		if s.OwnedSizeBytes > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ShardKeyUsage tells how much of a shard key a filter on the given fields has conditions on.
+// Only the presence of the fields is checked: a hashed field also needs an equality condition
+// for the operation to be targeted.
+func ShardKeyUsage(key []IndexKey, fields []string) string {
+	n := 0
+	for _, k := range key {
+		if !contains(fields, k.Field) {
+			break
+		}
+		n++
+	}
+	switch {
+	case len(key) > 0 && n == len(key):
+		return shardKeyFull
+	case n > 0:
+		return shardKeyPrefix
+	}
+	return shardKeyMissing
+}
+
+// queryFilterFields returns the fields the filters of a slow operation have conditions on.
+func queryFilterFields(attr bson.M) []string {
+	fields := make(map[string]bool)
+	for _, filter := range commandFilters(queryCommand(attr)) {
+		filterFields(filter, "", fields)
+	}
+	return sortedKeys(fields)
+}
+
+// activeShards returns the shards that aren't being drained, which the balancer spreads the
+// data over.
+func (d *ShardDistribution) activeShards() []string {
+	var shards []string
+	for _, s := range d.Shards {
+		if !s.Draining {
+			shards = append(shards, s.Name)
+		}
+	}
+	return shards
+}
+
+// Collection returns the sharded collection of a namespace, or nil when it isn't sharded.
+func (d *ShardDistribution) Collection(ns string) *ShardedCollection {
+	if d == nil {
+		return nil
+	}
+	for i := range d.Collections {
+		if d.Collections[i].Namespace == ns {
+			return &d.Collections[i]
+		}
+	}
+	return nil
+}
+
+// shardOfHost maps the host:port and hostname of every shard member to its shard.
+func (d *ShardDistribution) shardOfHost() map[string]string {
+	shards := make(map[string]string)
+	for _, s := range d.Shards {
+		for _, host := range s.Hosts {
+			host = strings.ToLower(host)
+			shards[host] = s.Name
+			if hostname, _, err := net.SplitHostPort(host); err == nil {
+				if _, ok := shards[hostname]; !ok {
+					shards[hostname] = s.Name
+				}
+			}
+		}
+	}
+	return shards
+}
+
+// CollectionBalance is how evenly a sharded collection is spread over the shards. Ratio is the
+// heaviest shard's data size, or chunk count when sizes are unknown, over the average of the
+// active shards.
+type CollectionBalance struct {
+	Namespace   string
+	ShardKey    string
+	Metric      string
+	Ratio       float64
+	Heaviest    string
+	Chunks      int
+	JumboChunks int
+	NoBalance   bool
+	Imbalanced  bool
+}
+
+// CollectionBalances measures the balance of every sharded collection. A collection with fewer
+// chunks than shards can't be spread evenly, and isn't reported as imbalanced.
+func (d *ShardDistribution) CollectionBalances(threshold float64) []CollectionBalance {
+	active := d.activeShards()
+	var balances []CollectionBalance
+	for _, c := range d.Collections {
+		chunks, jumbo := c.Chunks()
+		b := CollectionBalance{Namespace: c.Namespace, ShardKey: c.KeyPattern(), Metric: "chunks", Chunks: chunks, JumboChunks: jumbo, NoBalance: c.NoBalance}
+		bySize := c.bySize()
+		if bySize {
+			b.Metric = "data size"
+		}
+		var total, heaviest float64
+		for _, s := range c.Shards {
+			if !contains(active, s.Shard) {
+				continue
+			}
+			v := float64(s.Chunks)
+			if bySize {
+				v = float64(s.OwnedSizeBytes)
+			}
+			total += v
+			if v > heaviest {
+				heaviest, b.Heaviest = v, s.Shard
+			}
+		}
+		if total > 0 && len(active) > 0 {
+			b.Ratio = heaviest / (total / float64(len(active)))
+		}
+		b.Imbalanced = b.Ratio > threshold && chunks >= len(active)
+		balances = append(balances, b)
+	}
+	return balances
+}
+
+// HostLoad is the slow query load of a host, as logged.
+type HostLoad struct {
+	Host           string  `bson:"_id"`
+	SlowQueries    int     `bson:"slowQueries"`
+	DurationMillis float64 `bson:"durationMillis"`
+}
+
+// ShardLoad is the data and slow query load of a shard.
+type ShardLoad struct {
+	Shard          string
+	Draining       bool
+	Chunks         int
+	OwnedSizeBytes int64
+	// Logged is whether the log of one of the shard's members was ingested. The slow query
+	// load of a shard that wasn't logged is unknown rather than zero.
+	Logged         bool
+	SlowQueries    int
+	DurationMillis float64
+	// Ratio is the shard's slow query time over the average of the active shards that were
+	// logged.
+	Ratio float64
+	Hot   bool
+}
+
+// ShardLoads adds up the data and slow query load of every shard, from the slow queries its
+// members logged. Hosts that aren't members of a shard, such as mongos routers, are ignored.
+// The ingested hosts are the members whose logs were ingested, and the shards without any are
+// left out of the average. Draining shards are left out of it too, as the balancer moves their
+// data away.
+func (d *ShardDistribution) ShardLoads(hosts []HostLoad, ingested []string, threshold float64) []ShardLoad {
+	loads := make([]ShardLoad, len(d.Shards))
+	index := make(map[string]int)
+	for i, s := range d.Shards {
+		loads[i] = ShardLoad{Shard: s.Name, Draining: s.Draining}
+		index[s.Name] = i
+	}
+	for _, c := range d.Collections {
+		for _, s := range c.Shards {
+			if i, ok := index[s.Shard]; ok {
+				loads[i].Chunks += s.Chunks
+				loads[i].OwnedSizeBytes += s.OwnedSizeBytes
+			}
+		}
+	}
+	shardOfHost := d.shardOfHost()
+	for _, host := range ingested {
+		if shard, ok := shardOf(shardOfHost, host); ok {
+			loads[index[shard]].Logged = true
+		}
+	}
+	for _, h := range hosts {
+		if shard, ok := shardOf(shardOfHost, h.Host); ok {
+			loads[index[shard]].SlowQueries += h.SlowQueries
+			loads[index[shard]].DurationMillis += h.DurationMillis
+		}
+	}
+	active := d.activeShards()
+	var total float64
+	var counted int
+	for _, l := range loads {
+		if l.Logged && contains(active, l.Shard) {
+			total += l.DurationMillis
+			counted++
+		}
+	}
+	if total > 0 {
+		avg := total / float64(counted)
+		for i := range loads {
+			if loads[i].Logged {
+				loads[i].Ratio = loads[i].DurationMillis / avg
+				loads[i].Hot = loads[i].Ratio > threshold
+			}
+		}
+	}
+	return loads
+}
+
+// shardOf returns the shard of a "host:port" or hostname.
+func shardOf(shardOfHost map[string]string, host string) (string, bool) {
+	host = strings.ToLower(host)
+	shard, ok := shardOfHost[host]
+	if !ok {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			shard, ok = shardOfHost[hostname]
+		}
+	}
+	return shard, ok
+}
+
+// ShapeShardKey is whether an analyzed shape's filter includes the shard key of its collection.
+type ShapeShardKey struct {
+	Label        string
+	Namespace    string
+	ShardKey     string
+	FilterFields []string
+	Usage        string
+}
+
+// ShapeShardKeys checks the analyzed shapes on sharded collections. Inserts are left out, as
+// mongos routes them by the shard key of the inserted documents.
+func (d *ShardDistribution) ShapeShardKeys(shapes []ShapeFields, examples []SlowQueryEntry) []ShapeShardKey {
+	var checks []ShapeShardKey
+	for i, shape := range shapes {
+		coll := d.Collection(shape.Namespace)
+		if coll == nil || examples[i].OpType == opInsert {
+			continue
+		}
+		fields := queryFilterFields(examples[i].Attr)
+		checks = append(checks, ShapeShardKey{
+			Label:        shape.Label(),
+			Namespace:    shape.Namespace,
+			ShardKey:     coll.KeyPattern(),
+			FilterFields: fields,
+			Usage:        ShardKeyUsage(coll.Key, fields),
+		})
+	}
+	return checks
+}
+
+// ShardingData is the data of the shard distribution section of the slow query prompt.
+type ShardingData struct {
+	Balancer   BalancerState
+	Threshold  float64
+	Shards     []ShardLoad
+	Imbalanced []CollectionBalance
+	// Jumbo are the collections with jumbo chunks, which the balancer can't move.
+	Jumbo  []CollectionBalance
+	Shapes []ShapeShardKey
+}
+
+// shardingAnalysis is the shard distribution of a run combined with its slow query load.
+type shardingAnalysis struct {
+	Distribution *ShardDistribution
+	Data         ShardingData
+}
+
+// analyzeSharding combines a shard distribution with the run's slow query load, the hosts
+// whose logs were ingested and its analyzed shapes.
+func analyzeSharding(dist *ShardDistribution, hosts []HostLoad, ingested []string, shapes []ShapeFields, examples []SlowQueryEntry, threshold float64) *shardingAnalysis {
+	data := ShardingData{
+		Balancer:  dist.Balancer,
+		Threshold: threshold,
+		Shards:    dist.ShardLoads(hosts, ingested, threshold),
+		Shapes:    dist.ShapeShardKeys(shapes, examples),
+	}
+	for _, b := range dist.CollectionBalances(threshold) {
+		if b.Imbalanced {
+			data.Imbalanced = append(data.Imbalanced, b)
+		}
+		if b.JumboChunks > 0 {
+			data.Jumbo = append(data.Jumbo, b)
+		}
+	}
+	return &shardingAnalysis{Distribution: dist, Data: data}
+}
+
+// GetShardingContext renders the shard distribution section of the slow query prompt.
+func GetShardingContext(sa *shardingAnalysis) (string, error) {
+	if sa == nil {
+		return "", nil
+	}
+	return renderPrompt(shardDistributionTemplate, sa.Data)
+}
+
+// RenderShardDistributionSection lists the balance of the shards and sharded collections, and
+// whether the analyzed shapes filter on the shard key.
+func RenderShardDistributionSection(sa *shardingAnalysis) string {
+	if sa == nil {
+		return ""
+	}
+	locale := GetReportLocale()
+	data := sa.Data
+	var sb strings.Builder
+	sb.WriteString("## Shard distribution\n\n")
+	fmt.Fprintf(&sb, "Read from the config database on %s: %s shards, %s sharded collections. The balancer is `%s`",
+		locale.DateTime(sa.Distribution.CollectedAt),
+		locale.Sprintf("%d", len(sa.Distribution.Shards)),
+		locale.Sprintf("%d", len(sa.Distribution.Collections)),
+		data.Balancer.Mode)
+	if data.Balancer.InBalancerRound {
+		sb.WriteString(" and was migrating chunks")
+	}
+	fmt.Fprintf(&sb, ". Shards and collections above %s× the average are flagged.\n\n", locale.Number(data.Threshold, 1))
+
+	sb.WriteString("| Shard | Chunks | Owned data | Slow queries | Slow query time (ms) | × average | Flag |\n")
+	sb.WriteString("|---|---|---|---|---|---|---|\n")
+	for _, s := range data.Shards {
+		size := "-"
+		if s.OwnedSizeBytes > 0 {
+			size = locale.Bytes(float64(s.OwnedSizeBytes))
+		}
+		var flags []string
+		if s.Hot {
+			flags = append(flags, "hot")
+		}
+		if s.Draining {
+			flags = append(flags, "draining")
+		}
+		slowQueries, duration, ratio := "-", "-", "-"
+		if s.Logged {
+			slowQueries, duration, ratio = locale.Sprintf("%d", s.SlowQueries), locale.Number(s.DurationMillis, 0), locale.Number(s.Ratio, 2)
+		} else {
+			flags = append(flags, "not logged")
+		}
+		fmt.Fprintf(&sb, "| %s | %s | %s | %s | %s | %s | %s |\n",
+			s.Shard, locale.Sprintf("%d", s.Chunks), size, slowQueries, duration, ratio, strings.Join(flags, ", "))
+	}
+
+	balances := append(append([]CollectionBalance(nil), data.Imbalanced...), data.Jumbo...)
+	sort.SliceStable(balances, func(i, j int) bool { return balances[i].Ratio > balances[j].Ratio })
+	if len(balances) > 0 {
+		sb.WriteString("\n| Collection | Shard key | Chunks | Jumbo chunks | Heaviest shard | × average | Measured by | Balancing |\n")
+		sb.WriteString("|---|---|---|---|---|---|---|---|\n")
+		seen := make(map[string]bool)
+		for _, b := range balances {
+			if seen[b.Namespace] {
+				continue
+			}
+			seen[b.Namespace] = true
+			balancing := "on"
+			if b.NoBalance || data.Balancer.Mode == balancerOff {
+				balancing = "off"
+			}
+			fmt.Fprintf(&sb, "| %s | `%s` | %s | %s | %s | %s | %s | %s |\n",
+				b.Namespace, b.ShardKey, locale.Sprintf("%d", b.Chunks), locale.Sprintf("%d", b.JumboChunks),
+				b.Heaviest, locale.Number(b.Ratio, 2), b.Metric, balancing)
+		}
+	} else {
+		sb.WriteString("\nNo sharded collection is imbalanced or has jumbo chunks.\n")
+	}
+
+	if len(data.Shapes) > 0 {
+		sb.WriteString("\n| Shape | Collection | Shard key | Filter fields | Shard key in filter |\n")
+		sb.WriteString("|---|---|---|---|---|\n")
+		for _, s := range data.Shapes {
+			fields := strings.Join(s.FilterFields, ", ")
+			if fields == "" {
+				fields = "-"
+			}
+			fmt.Fprintf(&sb, "| %s | %s | `%s` | %s | %s |\n", s.Label, s.Namespace, s.ShardKey, fields, s.Usage)
+		}
+	}
+	return sb.String()
+}
@@ -1,6 +1,9 @@
 package main
 
-const (
-	NORMALZIED_CPU    = "Normalized CPU above 50% is considered medium, above 80% is considered high, and above 90% is considered critical."
-	NORMALZIED_MEMORY = "Normalized Memory above 50% is considered normal, above 75% is considered high, and above 90% is considered critical."
-)
+// DefaultThresholdProfile is used when the configuration doesn't define thresholds.
+var DefaultThresholdProfile = ThresholdProfile{
+	Metrics: map[string]ThresholdBands{
+		"SYSTEM_NORMALIZED_CPU_USER": {Description: "Normalized CPU", Warn: 50, High: 80, Critical: 90},
+		memoryPercentUsedMetric:      {Description: "Normalized Memory", High: 75, Critical: 90},
+	},
+}
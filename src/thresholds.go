@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ThresholdBands are the lower bounds of the warn, high and critical bands of a metric, in the
+// metric's units. A zero bound means the metric has no such band.
+type ThresholdBands struct {
+	Description string  `json:"description,omitempty"`
+	Warn        float64 `json:"warn,omitempty"`
+	High        float64 `json:"high,omitempty"`
+	Critical    float64 `json:"critical,omitempty"`
+}
+
+// ThresholdOverride replaces the bands of some metrics on hosts with a given role (primary,
+// secondary, mongos, config...), on clusters of a given tier (M30, M40...), or both.
+type ThresholdOverride struct {
+	HostRole string                    `json:"hostRole,omitempty"`
+	Tier     string                    `json:"tier,omitempty"`
+	Metrics  map[string]ThresholdBands `json:"metrics"`
+}
+
+type ThresholdProfile struct {
+	Metrics   map[string]ThresholdBands `json:"metrics"`
+	Overrides []ThresholdOverride       `json:"overrides,omitempty"`
+}
+
+func (b ThresholdBands) validate(metric string) error {
+	bounds := []float64{b.Warn, b.High, b.Critical}
+	prev := 0.0
+	for _, bound := range bounds {
+		if bound == 0 {
+			continue
+		}
+		if bound < prev {
+			return fmt.Errorf("threshold bands of %s must be ordered warn <= high <= critical", metric)
+		}
+		prev = bound
+	}
+	return nil
+}
+
+func (p ThresholdProfile) validate() error {
+	for metric, bands := range p.Metrics {
+		if err := bands.validate(metric); err != nil {
+			return err
+		}
+	}
+	for _, o := range p.Overrides {
+		if o.HostRole == "" && o.Tier == "" {
+			return fmt.Errorf("threshold overrides need a hostRole, a tier, or both")
+		}
+		for metric, bands := range o.Metrics {
+			if err := bands.validate(metric); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadThresholdProfile returns the thresholds defined in the file at thresholdsFile, or else
+// in the thresholds section of the configuration, or else the default profile.
+func LoadThresholdProfile(cfg *Config) (ThresholdProfile, error) {
+	profile := DefaultThresholdProfile
+	if cfg.ThresholdsFile != "" {
+		fileContents, err := os.ReadFile(cfg.ThresholdsFile)
+		if err != nil {
+			return profile, fmt.Errorf("failed to read thresholds file: %w", err)
+		}
+		var fromFile ThresholdProfile
+		if err := json.Unmarshal(fileContents, &fromFile); err != nil {
+			return profile, fmt.Errorf("failed to parse thresholds file: %w", err)
+		}
+		profile = fromFile
+	} else if cfg.Thresholds != nil {
+		profile = *cfg.Thresholds
+	}
+	if err := profile.validate(); err != nil {
+		return profile, err
+	}
+	return profile, nil
+}
+
+func (o ThresholdOverride) matches(role, tier string) bool {
+	return (o.HostRole == "" || strings.EqualFold(o.HostRole, role)) &&
+		(o.Tier == "" || strings.EqualFold(o.Tier, tier))
+}
+
+// ThresholdResolver resolves the thresholds that apply to each host.
+type ThresholdResolver struct {
+	Profile   ThresholdProfile
+	HostRoles map[string]string
+	Tier      string
+}
+
+// ForHost returns the profile's bands, with the matching overrides applied in order. An
+// override only replaces the bounds it sets, and keeps the others of the metric.
+func (r ThresholdResolver) ForHost(host string) map[string]ThresholdBands {
+	bands := make(map[string]ThresholdBands, len(r.Profile.Metrics))
+	for metric, b := range r.Profile.Metrics {
+		bands[metric] = b
+	}
+	role := r.HostRoles[host]
+	for _, o := range r.Profile.Overrides {
+		if !o.matches(role, r.Tier) {
+			continue
+		}
+		for metric, b := range o.Metrics {
+			bands[metric] = bands[metric].merge(b)
+		}
+	}
+	return bands
+}
+
+// merge returns the bands with the description and the non-zero bounds of an override.
+func (b ThresholdBands) merge(o ThresholdBands) ThresholdBands {
+	if o.Description != "" {
+		b.Description = o.Description
+	}
+	if o.Warn != 0 {
+		b.Warn = o.Warn
+	}
+	if o.High != 0 {
+		b.High = o.High
+	}
+	if o.Critical != 0 {
+		b.Critical = o.Critical
+	}
+	return b
+}
+
+func (b ThresholdBands) String() string {
+	var parts []string
+	if b.Warn > 0 {
+		parts = append(parts, fmt.Sprintf("above %g is warn", b.Warn))
+	}
+	if b.High > 0 {
+		parts = append(parts, fmt.Sprintf("above %g is high", b.High))
+	}
+	if b.Critical > 0 {
+		parts = append(parts, fmt.Sprintf("above %g is critical", b.Critical))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func describeBands(bands map[string]ThresholdBands) []string {
+	var metrics []string
+	for metric := range bands {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	var lines []string
+	for _, metric := range metrics {
+		b := bands[metric]
+		name := metric
+		if b.Description != "" {
+			name = fmt.Sprintf("%s (%s)", metric, b.Description)
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, b))
+	}
+	return lines
+}
+
+// GetThresholdDefinitions words the threshold profile for the LLM, so that the report uses
+// the configured definitions of warn, high and critical.
+func (r ThresholdResolver) GetThresholdDefinitions() string {
+	defs := "Use these definitions of warn, high and critical, and don't apply other thresholds:\n"
+	for _, line := range describeBands(r.Profile.Metrics) {
+		defs += "- " + line + "\n"
+	}
+	for _, o := range r.Profile.Overrides {
+		if !o.matches(o.HostRole, r.Tier) {
+			continue
+		}
+		var scope []string
+		if o.HostRole != "" {
+			scope = append(scope, o.HostRole+" hosts")
+		}
+		if o.Tier != "" {
+			scope = append(scope, o.Tier+" clusters")
+		}
+		defs += fmt.Sprintf("On %s:\n", strings.Join(scope, " of "))
+		merged := make(map[string]ThresholdBands, len(o.Metrics))
+		for metric, b := range o.Metrics {
+			merged[metric] = r.Profile.Metrics[metric].merge(b)
+		}
+		for _, line := range describeBands(merged) {
+			defs += "  - " + line + "\n"
+		}
+	}
+	return defs
+}
+
+// NewThresholdResolver loads the configured threshold profile and resolves the role of every
+// host and the tier of the cluster that its overrides may refer to.
+func NewThresholdResolver(ctx context.Context, ac *AtlasClient, cfg *Config, hosts []string) (ThresholdResolver, error) {
+	profile, err := LoadThresholdProfile(cfg)
+	if err != nil {
+		return ThresholdResolver{}, err
+	}
+	resolver := ThresholdResolver{Profile: profile}
+	if len(profile.Overrides) == 0 {
+		return resolver, nil
+	}
+	resolver.HostRoles, err = ac.GetProcessRoles(ctx, cfg.ProjectId, hosts)
+	if err != nil {
+		return resolver, err
+	}
+	resolver.Tier, err = ac.GetClusterTier(ctx, cfg.ProjectId, cfg.ClusterName)
+	if err != nil {
+		return resolver, err
+	}
+	return resolver, nil
+}
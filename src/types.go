@@ -1,11 +1,17 @@
 package main
 
-import "go.mongodb.org/mongo-driver/v2/bson"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
 
 type SlowQueryByID struct {
 	Driver     string `bson:"driver" json:"driver"`
 	Hash       string `bson:"hash" json:"hash"`
 	IsCollscan bool   `bson:"isCollscan" json:"isCollscan"`
+	Namespace  string `bson:"ns" json:"ns"`
+	OpType     string `bson:"opType" json:"opType"`
 }
 
 type SlowQueryByDriver struct {
@@ -23,7 +29,74 @@ type SlowQueryByDriver struct {
 	AvgWritten          float64       `bson:"avgWritten" json:"avgWritten"` // Pointer to int64 to represent null
 	AvgDurationMillis   float64       `bson:"avgDurationMillis" json:"avgDurationMillis"`
 	AvgNumYields        float64       `bson:"avgNumYields" json:"avgNumYields"`
-	QueryExample        bson.M        `bson:"queryExample" json:"queryExample"` // bson.M to represent a generic BSON/JSON object, not omitted
+	Namespace           string        `bson:"ns" json:"ns"`
+	TotalKeysExamined   int64         `bson:"totalKeysExamined" json:"totalKeysExamined"`
+	TotalDocsExamined   int64         `bson:"totalDocsExamined" json:"totalDocsExamined"`
+	TotalNReturned      int64         `bson:"totalNReturned" json:"totalNReturned"`
+	TargetingRatios     `bson:",inline"`
+	P50DurationMillis   float64        `bson:"p50DurationMillis" json:"p50DurationMillis"`
+	P90DurationMillis   float64        `bson:"p90DurationMillis" json:"p90DurationMillis"`
+	P99DurationMillis   float64        `bson:"p99DurationMillis" json:"p99DurationMillis"`
+	Hourly              []HourlyBucket `bson:"hourly" json:"hourly"`
+	WriteStats          `bson:",inline"`
+	ContentionStats     `bson:",inline"`
+	QueryExample        bson.M `bson:"queryExample" json:"queryExample"` // bson.M to represent a generic BSON/JSON object, not omitted
+}
+
+// TargetingRatios holds the keys examined (scanned) and documents examined (scanned objects)
+// per returned document of a group of slow queries: the overall ratio of the group's totals,
+// and the distribution of the per-query ratios.
+type TargetingRatios struct {
+	ScannedPerReturned           float64 `bson:"scannedPerReturned" json:"scannedPerReturned"`
+	P50ScannedPerReturned        float64 `bson:"p50ScannedPerReturned" json:"p50ScannedPerReturned"`
+	P95ScannedPerReturned        float64 `bson:"p95ScannedPerReturned" json:"p95ScannedPerReturned"`
+	MaxScannedPerReturned        float64 `bson:"maxScannedPerReturned" json:"maxScannedPerReturned"`
+	ScannedObjectsPerReturned    float64 `bson:"scannedObjectsPerReturned" json:"scannedObjectsPerReturned"`
+	P50ScannedObjectsPerReturned float64 `bson:"p50ScannedObjectsPerReturned" json:"p50ScannedObjectsPerReturned"`
+	P95ScannedObjectsPerReturned float64 `bson:"p95ScannedObjectsPerReturned" json:"p95ScannedObjectsPerReturned"`
+	MaxScannedObjectsPerReturned float64 `bson:"maxScannedObjectsPerReturned" json:"maxScannedObjectsPerReturned"`
+}
+
+// WriteStats holds the write-specific counters of a query shape. They're all zero for reads.
+type WriteStats struct {
+	TotalNMatched       int64 `bson:"totalNMatched" json:"totalNMatched"`
+	TotalNModified      int64 `bson:"totalNModified" json:"totalNModified"`
+	TotalNInserted      int64 `bson:"totalNInserted" json:"totalNInserted"`
+	TotalNDeleted       int64 `bson:"totalNDeleted" json:"totalNDeleted"`
+	TotalKeysInserted   int64 `bson:"totalKeysInserted" json:"totalKeysInserted"`
+	TotalKeysDeleted    int64 `bson:"totalKeysDeleted" json:"totalKeysDeleted"`
+	TotalWriteConflicts int64 `bson:"totalWriteConflicts" json:"totalWriteConflicts"`
+	MaxWriteConflicts   int64 `bson:"maxWriteConflicts" json:"maxWriteConflicts"`
+	MultiUpdates        int32 `bson:"multiUpdates" json:"multiUpdates"`
+	MaxNModified        int64 `bson:"maxNModified" json:"maxNModified"`
+}
+
+// ContentionStats holds the total time a query shape spent reading from disk and waiting on
+// locks, the storage engine, execution tickets, admission queues and flow control.
+type ContentionStats struct {
+	TotalDiskReadMicros    float64 `bson:"totalDiskReadMicros" json:"totalDiskReadMicros"`
+	TotalLockWaitMicros    float64 `bson:"totalLockWaitMicros" json:"totalLockWaitMicros"`
+	TotalStorageWaitMicros float64 `bson:"totalStorageWaitMicros" json:"totalStorageWaitMicros"`
+	TotalQueueWaitMicros   float64 `bson:"totalQueueWaitMicros" json:"totalQueueWaitMicros"`
+	TotalFlowControlMicros float64 `bson:"totalFlowControlMicros" json:"totalFlowControlMicros"`
+	TotalCpuNanos          float64 `bson:"totalCpuNanos" json:"totalCpuNanos"`
+}
+
+type HourlyBucket struct {
+	Hour                time.Time `bson:"hour" json:"hour"`
+	Count               int32     `bson:"count" json:"count"`
+	TotalDurationMillis float64   `bson:"totalDurationMillis" json:"totalDurationMillis"`
+	AvgDurationMillis   float64   `bson:"avgDurationMillis" json:"avgDurationMillis"`
+	MaxDurationMillis   float64   `bson:"maxDurationMillis" json:"maxDurationMillis"`
+}
+
+type NamespaceTargeting struct {
+	Namespace         string `bson:"_id" json:"ns"`
+	Count             int32  `bson:"count" json:"count"`
+	TotalKeysExamined int64  `bson:"totalKeysExamined" json:"totalKeysExamined"`
+	TotalDocsExamined int64  `bson:"totalDocsExamined" json:"totalDocsExamined"`
+	TotalNReturned    int64  `bson:"totalNReturned" json:"totalNReturned"`
+	TargetingRatios   `bson:",inline"`
 }
 
 type SlowQueryEntry struct {
@@ -37,4 +110,15 @@ type SlowQueryEntry struct {
 	Host    string        `bson:"host" json:"host"`
 	CtxHost string        `bson:"ctxHost" json:"ctxHost"`
 	Driver  string        `bson:"driver" json:"driver"`
+	OpType  string        `bson:"opType" json:"opType"`
+}
+
+type AntiPatternHit struct {
+	RuleID    string `bson:"ruleId" json:"ruleId"`
+	QueryHash string `bson:"queryHash" json:"queryHash"`
+	Namespace string `bson:"ns" json:"ns"`
+	// Fragment is the offending part of the first slow query of the shape the rule matched.
+	Fragment    string        `bson:"fragment" json:"fragment"`
+	Occurrences int32         `bson:"occurrences" json:"occurrences"`
+	ExampleID   bson.ObjectID `bson:"exampleId" json:"exampleId"`
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	// Index keys written per inserted document above which a shape is flagged for write
+	// amplification.
+	highKeysPerInsertThreshold = 10
+	// Documents modified by a single multi-update above which it's flagged as unbounded.
+	largeMultiUpdateThreshold = 1000
+)
+
+// writeFields are the per-entry write fields, added before grouping.
+func writeFields() bson.D {
+	return bson.D{
+		{"isMultiUpdate", bson.D{
+			{"$or", bson.A{
+				bson.D{{"$eq", bson.A{"$attr.command.multi", true}}},
+				bson.D{{"$in", bson.A{true, bson.D{{"$ifNull", bson.A{"$attr.command.updates.multi", bson.A{}}}}}}},
+			}},
+		}},
+	}
+}
+
+// writeAccumulators are the $group accumulators of the write-specific counters.
+func writeAccumulators() bson.D {
+	return bson.D{
+		{"totalNMatched", bson.D{{"$sum", "$attr.nMatched"}}},
+		{"totalNModified", bson.D{{"$sum", "$attr.nModified"}}},
+		{"totalNInserted", bson.D{{"$sum", "$attr.ninserted"}}},
+		{"totalNDeleted", bson.D{{"$sum", "$attr.ndeleted"}}},
+		{"totalKeysInserted", bson.D{{"$sum", "$attr.keysInserted"}}},
+		{"totalKeysDeleted", bson.D{{"$sum", "$attr.keysDeleted"}}},
+		{"totalWriteConflicts", bson.D{{"$sum", "$attr.writeConflicts"}}},
+		{"maxWriteConflicts", bson.D{{"$max", "$attr.writeConflicts"}}},
+		{"multiUpdates", bson.D{{"$sum", bson.D{{"$cond", bson.A{"$isMultiUpdate", 1, 0}}}}}},
+		{"maxNModified", bson.D{{"$max", "$attr.nModified"}}},
+	}
+}
+
+func IsWriteOpType(opType string) bool {
+	for _, op := range writeOpTypes {
+		if op == opType {
+			return true
+		}
+	}
+	return false
+}
+
+func writeShapesFilter() bson.D {
+	return bson.D{{"_id.opType", bson.D{{"$in", writeOpTypes}}}}
+}
+
+func readShapesFilter() bson.D {
+	return bson.D{{"_id.opType", bson.D{{"$nin", writeOpTypes}}}}
+}
+
+// WriteShapeHints returns the deterministic write-path findings of a write shape, used to
+// steer the LLM towards write-specific recommendations.
+func WriteShapeHints(shape SlowQueryByDriver) []string {
+	var hints []string
+	docsWritten := shape.TotalNInserted + shape.TotalNModified + shape.TotalNDeleted
+	keysWritten := shape.TotalKeysInserted + shape.TotalKeysDeleted
+	if docsWritten > 0 {
+		keysPerDoc := float64(keysWritten) / float64(docsWritten)
+		if keysPerDoc >= highKeysPerInsertThreshold {
+			hints = append(hints, fmt.Sprintf("%.1f index keys written per document written: possibly too many indexes on %s", keysPerDoc, shape.ID.Namespace))
+		}
+	}
+	if shape.TotalWriteConflicts > 0 {
+		hints = append(hints, fmt.Sprintf("%d write conflicts (max %d in one operation): possible hot documents", shape.TotalWriteConflicts, shape.MaxWriteConflicts))
+	}
+	if shape.MultiUpdates > 0 && shape.ID.IsCollscan {
+		hints = append(hints, fmt.Sprintf("%d multi:true updates without an index (COLLSCAN)", shape.MultiUpdates))
+	}
+	if shape.MultiUpdates > 0 && shape.MaxNModified >= largeMultiUpdateThreshold {
+		hints = append(hints, fmt.Sprintf("multi:true update modified up to %d documents in one operation: unbounded multi-update", shape.MaxNModified))
+	}
+	if shape.TotalLockWaitMicros > 0 {
+		hints = append(hints, fmt.Sprintf("%.0f ms spent waiting for locks", shape.TotalLockWaitMicros/1000))
+	}
+	if shape.TotalFlowControlMicros > 0 {
+		hints = append(hints, fmt.Sprintf("%.0f ms throttled by flow control: secondaries are lagging", shape.TotalFlowControlMicros/1000))
+	}
+	return hints
+}
+
+// slowWritesInstructions asks for a dedicated report section with write-specific
+// recommendations.
+func slowWritesInstructions() (string, error) {
+	return renderPrompt(slowWritesInstructionsTemplate, nil)
+}
+
+// slowWriteShapeSection describes write shape no. n of the report and embeds its slowest log.
+func slowWriteShapeSection(n int, sq SlowQueryEntry, shape RankedShape) (string, error) {
+	log, err := shapeLog(sq)
+	if err != nil {
+		return "", err
+	}
+	return renderPrompt(slowWriteShapeTemplate, ShapePromptData{
+		Number:    n,
+		Driver:    sq.Driver,
+		Shape:     shape,
+		Breakdown: GetTimeBreakdown(shape.SlowQueryByDriver),
+		Hints:     WriteShapeHints(shape.SlowQueryByDriver),
+		Log:       log,
+	})
+}
+
+// GetTopWriteShapes ranks the slow write shapes with the configured strategy.
+func GetTopWriteShapes(ctx context.Context, dbName string, topN int, strategyName string) ([]RankedShape, error) {
+	return getTopShapes(ctx, dbName, topN, strategyName, writeShapesFilter())
+}